@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// chaosMonkey kills a random emulator every so often, so that the command
+// can be tested against backend outages. The session restarts the killed
+// emulator after the configured downtime.
+type chaosMonkey struct {
+	s        *Session
+	interval time.Duration // mean time between kills
+
+	mu     sync.Mutex
+	killed map[string]bool // emulators killed and not yet restarted
+	stop   chan struct{}
+}
+
+// startChaos starts killing emulators of s, about every interval.
+func startChaos(s *Session, interval time.Duration) *chaosMonkey {
+	m := &chaosMonkey{s: s, interval: interval, killed: make(map[string]bool), stop: make(chan struct{})}
+	go m.run()
+	return m
+}
+
+func (m *chaosMonkey) run() {
+	for {
+		// Anywhere from half to one and a half intervals.
+		d := m.interval/2 + time.Duration(rand.Int63n(int64(m.interval)+1))
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(d):
+		}
+		e := m.s.Emulators[rand.Intn(len(m.s.Emulators))]
+		m.mu.Lock()
+		if m.killed[e.Name] {
+			m.mu.Unlock()
+			continue
+		}
+		m.killed[e.Name] = true
+		m.mu.Unlock()
+		slog.Warn("Chaos: killing emulator", "emulator", e.Name)
+		e.group.kill()
+	}
+}
+
+// caused reports whether the monkey killed the named emulator since the
+// last call. It is safe to call on a nil monkey.
+func (m *chaosMonkey) caused(name string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	killed := m.killed[name]
+	delete(m.killed, name)
+	return killed
+}
+
+// Stop stops killing emulators.
+func (m *chaosMonkey) Stop() {
+	close(m.stop)
+}
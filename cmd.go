@@ -5,173 +5,327 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"flag"
-	"io"
-	"io/ioutil"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
-	"os/signal"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 )
 
-var verbose = flag.Bool("v", false, "Pipe stdout/stderr from emulators")
+var expectFlags, datastoreArgs, pubsubArgs, fixtureFlags, readySentinels, jvmOptions stringsFlag
 
-func main() {
-	flag.Parse()
+var verbose verboseFlag
 
-	if err := syscall.Setpgid(os.Getpid(), os.Getpid()); err != nil {
-		log.Fatalf("setpgid: %v", err)
-	}
-	forwardSignals()
-
-	datastore := &Emulator{
-		Command:       []string{"gcloud", "-q", "beta", "emulators", "pubsub", "start"},
-		EnvCommand:    []string{"gcloud", "-q", "beta", "emulators", "pubsub", "env-init"},
-		ReadySentinel: "Server started, listening",
-	}
-	if err := datastore.Start(); err != nil {
-		log.Fatalf("Could not start datastore: %v", err)
-	}
+func init() {
+	flag.Var(&verbose, "v", "Copy emulator output to stderr; -v=NAME[,NAME...] for only some emulators")
+	flag.Var(verboseList{&verbose}, "verbose", "Emulators to copy output to stderr from, e.g. pubsub,datastore")
+	flag.Var(&expectFlags, "expect", "Call count expectation checked after the command exits, e.g. datastore:Commit>=1 (repeatable)")
+	flag.Var(&datastoreArgs, "datastore-arg", "Extra argument for \"gcloud emulators datastore start\" (repeatable)")
+	flag.Var(&pubsubArgs, "pubsub-arg", "Extra argument for \"gcloud emulators pubsub start\" (repeatable)")
+	flag.Var(&readySentinels, "ready-sentinel", "Regular expression matching an emulator's output once it is ready, as NAME=REGEXP, replacing its built-in startup message (repeatable)")
+	flag.Var(&jvmOptions, "jvm-options", "Options for the emulators' JVMs, e.g. -Xmx256m, or for one emulator, as NAME=OPTIONS, passed in JAVA_TOOL_OPTIONS (repeatable)")
+	flag.Var(&fixtureFlags, "fixtures", "JSON file of entities to load into the Datastore emulator before the command runs (repeatable)")
+}
 
-	pubsub := &Emulator{
-		Command:       []string{"gcloud", "-q", "beta", "emulators", "datastore", "start", "--no-legacy"},
-		EnvCommand:    []string{"gcloud", "-q", "beta", "emulators", "datastore", "env-init"},
-		ReadySentinel: "is now running",
-	}
-	if err := pubsub.Start(); err != nil {
-		log.Fatalf("Could not start pubsub: %v", err)
-	}
+var (
+	configPath   = flag.String("config", "", "Path to a JSON configuration file")
+	readyTimeout = flag.Duration("ready-timeout", 2*time.Minute, "How long to wait for each emulator to start")
+	supervise    = flag.Bool("supervise", false, "Restart emulators that crash while the command runs, on the same port")
+	superviseSig = flag.String("supervise-signal", "", "With -supervise, signal to send the command after restarting an emulator, e.g. HUP")
+	chaos        = flag.Duration("chaos", 0, "Kill a random emulator about this often while the command runs, restarting it after -chaos-downtime (default: off)")
+	chaosDown    = flag.Duration("chaos-downtime", 2*time.Second, "With -chaos, how long a killed emulator stays down")
+	autoInstall  = flag.Bool("auto-install", false, "Install gcloud components that an emulator fails to start without, then retry, instead of asking first")
+	startRetries = flag.Int("start-retries", 0, "How many times to restart an emulator that crashes or times out before it is ready")
+	readiness    = flag.String("readiness", "probe", "How to tell that an emulator is ready: probe, polling its HTTP port, falling back to its startup message; or sentinel, only its startup message")
+	stopTimeout  = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for each emulator to stop before killing it (0 waits forever)")
+	execMode     = flag.Bool("exec", false, "Replace with_emulators with the command once the emulators are ready")
+	artifacts    = flag.String("artifacts", "", "Directory for diagnostics written when an emulator fails (default: temp dir)")
+	verifyUsage  = flag.String("verify-usage", "off", "Check that the command called every emulator: off, warn or fail")
+	daemon       = flag.Bool("daemon", false, "With start, run the emulators in the background and return once they are ready")
+	project      = flag.String("project", "", "Project ID for the emulators, exported as GOOGLE_CLOUD_PROJECT and GCLOUD_PROJECT (overrides the config)")
+	uiAddr       = flag.String("ui", "", "Address to serve a web dashboard of the emulators' contents on, e.g. localhost:4000")
+	metricsAddr  = flag.String("metrics", "", "Address to serve Prometheus metrics about the emulators and command on, at /metrics, e.g. localhost:9464")
+	apiAddr      = flag.String("api", "", "With start, localhost address to serve an HTTP API controlling the emulators on, e.g. localhost:4002")
+	healthAddr   = flag.String("health", "", "Address to serve /healthz on, reporting each emulator's status, for liveness checks, e.g. localhost:4001")
+	tune         = flag.Bool("tune", false, "When running Go tests, set GOMAXPROCS and -p to leave CPU for the emulators")
+	shared       = flag.Bool("shared", false, "Share emulators with other -shared invocations, starting them in a daemon if none is running")
+	keepAlive    = flag.Bool("keep-alive", false, "With run, leave the emulators running after the command exits, until interrupted or stopped")
+	timings      = flag.String("timings", "off", "Report emulator startup and command times on stderr once the command exits: off, text or json")
+	sharedIdle   = flag.Duration("shared-idle", 5*time.Second, "How long a shared daemon waits after its last client exits before stopping")
+	readyFile    = flag.String("ready-file", "", "File to write, as JSON, once the emulators and configured resources are ready; removed when they stop")
+	eventsFormat = flag.String("events", "off", "Write lifecycle events to -events-fd: off, or json for a line of JSON per event")
+	eventsFD     = flag.Int("events-fd", 1, "File descriptor to write -events to (default: stdout)")
+	outputFD     = flag.Int("output-fd", 0, "File descriptor to copy every emulator's output to, tagged with its name, whether or not -v copies it to stderr")
+	timestamps   = flag.String("timestamps", "off", "With -v, timestamp each line of emulator output: off, rfc3339, or relative to the start of with_emulators")
+	logDir       = flag.String("log-dir", "", "Directory to append each emulator's output to, as NAME.log, kept after the emulators stop")
+	logMaxSize   = flag.Int64("log-max-size", 10, "Size in MB at which -log-dir files are rotated, keeping 3 old files")
+	logFormat    = flag.String("log-format", "", "Format of with_emulators' own log messages: text or json (default: plain lines)")
+	quiet        = flag.Bool("quiet", false, "Only log errors, keeping with_emulators' progress messages out of the command's output (same as -log-level=error)")
+	logLevel     = flag.String("log-level", "info", "Lowest level of with_emulators' own log messages to write: debug, info, warn or error")
+	rpcLogPath   = flag.String("rpc-log", "", "File to log every call the command makes to the emulators to, with its method, resource, latency and status")
+	unixSockets  = flag.Bool("unix", false, "Also serve each emulator on a Unix domain socket, through a proxy, exporting its path as e.g. PUBSUB_EMULATOR_SOCKET")
+	tlsProxy     = flag.Bool("tls", false, "Serve the emulators over TLS, through proxies with a throwaway CA whose certificate is exported as "+envCACert)
+	mtlsProxy    = flag.Bool("mtls", false, "Like -tls, but require a client certificate, exported with its key as "+envClientCert+" and "+envClientKey)
+	recordPath   = flag.String("record", "", "File to record the command's calls to the emulators, and their responses, to, for -replay")
+	replayPath   = flag.String("replay", "", "Recording made with -record to answer the command's calls from, instead of starting the emulators")
+	childDir     = flag.String("dir", "", "Working directory to run the command in (default: the current directory)")
+	envClear     = flag.Bool("env-clear", false, "Run the command with only the emulators' variables, and those allowed by -env-whitelist, instead of with_emulators' whole environment")
+	envWhitelist = flag.String("env-whitelist", "", "Comma-separated variables that the command inherits with -env-clear, which it implies, e.g. PATH,HOME,GO*")
+	envFile      = flag.String("env-file", "", "File to write the emulators' environment to, in dotenv format, once they are ready; removed when they stop")
+)
 
-	datastore.WaitReady()
-	pubsub.WaitReady()
+// Emulator addresses and data. Unset, each emulator listens on a free port
+// and keeps its data in gcloud's default directory.
+var (
+	backend              = flag.String("backend", "local", "How to run the emulators: local, with gcloud; docker or podman, in containers of -image (docker falls back to podman if only it is installed); java, from their standalone distributions, without gcloud; or remote, using emulators already running at -NAME-host-port")
+	image                = flag.String("image", defaultImage, "With -backend=docker or podman, the image to run the emulators in")
+	cacheDir             = flag.String("cache-dir", "", "With -backend=java, directory to download the emulators to (default: with_emulators in the user cache directory)")
+	bind                 = flag.String("bind", "localhost", "Address for the emulators to listen on, with free or -shard ports; 0.0.0.0 makes them reachable from containers and other machines")
+	limitMemory          = flag.String("limit-memory", "", "Memory limit for each emulator's processes, e.g. 512M, using a cgroup on Linux or the container's limit (default: unlimited)")
+	limitCPU             = flag.Float64("limit-cpu", 0, "CPU limit for each emulator's processes, in CPUs, e.g. 1.5, using a cgroup on Linux or the container's limit (default: unlimited)")
+	datastoreHostPort    = flag.String("datastore-host-port", "", "Address for the Datastore emulator to listen on (default: a free port on localhost)")
+	pubsubHostPort       = flag.String("pubsub-host-port", "", "Address for the Pub/Sub emulator to listen on (default: a free port on localhost)")
+	datastoreConsistency = flag.String("datastore-consistency", "", "Fraction of Datastore emulator transactions that are applied immediately, from 0 to 1; 1.0 makes queries strongly consistent (default: the emulator's, 0.9)")
+	datastoreEmulator    = flag.String("datastore-emulator", "datastore", "Emulator serving Datastore: datastore, or firestore in Datastore mode")
+	datastoreIndex       = flag.String("datastore-index", "", "index.yaml defining the composite indexes for the Datastore emulator")
+	datastoreImport      = flag.String("datastore-import", "", "Datastore managed export (its overall_export_metadata file, or directory) to import at startup")
+	datastoreExport      = flag.String("datastore-export", "", "Directory to export the Datastore emulator's entities to, as a managed export, after the command exits")
+	datastoreDataDir     = flag.String("datastore-data-dir", "", "Directory for the Datastore emulator to store its data in, kept across runs")
+	shard                = flag.Int("shard", -1, "Shard index, giving the emulators fixed ports and data directories of their own (default: from "+strings.Join(shardEnv, ", ")+", if set)")
+)
 
-	env := os.Environ()
-	env = append(env, datastore.Env()...)
-	env = append(env, pubsub.Env()...)
+// defaultReadyTimeout is used for readyWhen resources when the config does not
+// set readyTimeout.
+const defaultReadyTimeout = time.Minute
 
-	cmd := exec.Command(flag.Args()[0], flag.Args()[1:]...)
-	cmd.SysProcAttr = sysprocattr()
-	cmd.Env = env
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	cmdErr := cmd.Run()
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if !contains(timestampFormats, *timestamps) {
+		fmt.Fprintf(os.Stderr, "invalid -timestamps %q, want off, rfc3339 or relative\n", *timestamps)
+		os.Exit(2)
+	}
 
-	if err := datastore.Stop(); err != nil {
-		log.Fatalf("Could not stop datastore: %v", err)
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "with_emulators: no command given")
+		usage()
+		os.Exit(2)
 	}
-	if err := pubsub.Stop(); err != nil {
-		log.Fatalf("Could not stop pubsub: %v", err)
+	if dashed(os.Args[1:], len(args)) {
+		// After "--", the first argument is always a command to run, even if
+		// it is named like a subcommand.
+		os.Exit(runMain(args))
 	}
-	if cmdErr != nil {
-		log.Fatal(cmdErr)
+	switch args[0] {
+	case "run":
+		flag.CommandLine.Parse(args[1:])
+		os.Exit(runMain(flag.Args()))
+	case "start":
+		flag.CommandLine.Parse(args[1:])
+		os.Exit(startMain(flag.Args()))
+	case "stop":
+		os.Exit(stopMain(args[1:]))
+	case "ds":
+		os.Exit(dsMain(args[1:]))
+	case "env":
+		os.Exit(envMain(args[1:]))
+	case "status":
+		os.Exit(statusMain(args[1:]))
+	case "logs":
+		os.Exit(logsMain(args[1:]))
+	case "reset":
+		os.Exit(resetMain(args[1:]))
+	case "restart":
+		os.Exit(restartMain(args[1:]))
+	case "publish":
+		os.Exit(publishMain(args[1:]))
+	case "shell":
+		os.Exit(shellMain(args[1:]))
+	case "snapshot":
+		os.Exit(snapshotMain(args[1:]))
+	case "tap":
+		os.Exit(tapMain(args[1:]))
+	case "wait-for":
+		os.Exit(waitForMain(args[1:]))
+	case "generate":
+		os.Exit(generateMain(args[1:]))
+	case "compose":
+		os.Exit(composeMain(args[1:]))
+	case "doctor":
+		os.Exit(doctorMain(args[1:]))
+	case "completion":
+		os.Exit(completionMain(args[1:]))
+	case "reap":
+		os.Exit(reapMain(args[1:]))
 	}
+	// For compatibility, anything else is a command to run.
+	os.Exit(runMain(args))
 }
 
-func sysprocattr() *syscall.SysProcAttr {
-	return &syscall.SysProcAttr{
-		Setpgid: true,
-		Pgid:    os.Getpid(),
-	}
+// dashed reports whether the flags in args were ended by "--", given that
+// n arguments were left after them.
+func dashed(args []string, n int) bool {
+	i := len(args) - n - 1
+	return i >= 0 && args[i] == "--"
 }
 
-type Emulator struct {
-	cmd   *exec.Cmd
-	ready chan struct{}
-
-	Command       []string
-	EnvCommand    []string
-	ReadySentinel string
+// subcommands lists the subcommands, with their arguments, for usage and
+// for shell completion.
+var subcommands = [][2]string{
+	{"run [flags] COMMAND [ARGS...]", "run COMMAND with emulators (the default)"},
+	{"start [flags]", "start emulators and wait until interrupted (or, with -daemon, return)"},
+	{"stop", "stop the emulators of a running session"},
+	{"env", "print the environment of a running session"},
+	{"status", "list running sessions"},
+	{"logs [EMULATOR...]", "print emulator logs of a running session"},
+	{"ds get|list|dump", "print entities from a running session's Datastore emulator"},
+	{"reset", "delete all data in a running session's emulators"},
+	{"restart EMULATOR...", "restart emulators of a running session, on the same ports"},
+	{"publish -topic T -data D", "publish a message to a running session's topic"},
+	{"shell", "explore a running session's emulators interactively"},
+	{"snapshot save|restore NAME", "save or restore the state of a running session's emulators"},
+	{"tap [TOPIC...]", "print messages published to a running session's topics"},
+	{"wait-for RESOURCE...", "wait for emulator resources to exist"},
+	{"generate testmain", "write a TestMain that uses with_emulators"},
+	{"generate devcontainer", "write devcontainer.json properties that start the emulators"},
+	{"compose", "write a Docker Compose file running the emulators"},
+	{"doctor", "check that the emulators can start, and explain how to fix what stops them"},
+	{"completion bash|zsh|fish", "print a shell completion script"},
 }
 
-func (e *Emulator) Start() error {
-	if e.ready != nil {
-		return errors.New("already started")
-	}
-	e.ready = make(chan struct{})
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: with_emulators [flags] [--] COMMAND [ARGS...]
+       with_emulators SUBCOMMAND [ARGS...]
 
-	e.cmd = exec.Command(e.Command[0], e.Command[1:]...)
-	e.cmd.SysProcAttr = sysprocattr()
-	out := ioutil.Discard
-	if *verbose {
-		out = os.Stderr
-	}
-	e.cmd.Stderr = &watchFor{
-		base:     out,
-		sentinel: e.ReadySentinel,
-		c:        e.ready,
+Subcommands:
+`)
+	for _, c := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", c[0], c[1])
 	}
-	if *verbose {
-		e.cmd.Stdout = os.Stdout
-	}
-	return e.cmd.Start()
+	fmt.Fprint(os.Stderr, `
+Flags for run and start:
+`)
+	flag.PrintDefaults()
 }
 
-func (e *Emulator) WaitReady() {
-	<-e.ready
+// loadConfig loads the -config file, if any, and applies flags that
+// override it.
+func loadConfig() (*Config, error) {
+	cfg := &Config{}
+	if *configPath != "" {
+		var err error
+		if cfg, err = LoadConfig(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	if *project != "" {
+		cfg.Project = *project
+	}
+	return cfg, nil
 }
 
-func (e *Emulator) Stop() error {
-	if err := syscall.Kill(-os.Getpid(), syscall.SIGTERM); err != nil {
-		return err
+// checkExpectations logs the expectations that were not met by the calls
+// counted by proxies, and reports whether all of them were met.
+func checkExpectations(expectations []Expectation, proxies map[string]*Proxy) bool {
+	ok := true
+	for _, x := range expectations {
+		p := proxies[x.Emulator]
+		if p == nil {
+			slog.Error("Expectation names an unknown emulator", "expectation", x, "emulator", x.Emulator)
+			ok = false
+			continue
+		}
+		if err := x.Check(p.Calls()); err != nil {
+			slog.Error(err.Error())
+			ok = false
+		}
 	}
-	e.cmd.Wait()
-	return nil
+	return ok
 }
 
-func (e *Emulator) Env() []string {
-	cmd := exec.Command(e.EnvCommand[0], e.EnvCommand[1:]...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Fatalf("could not get env: %v", err)
+// checkUsage returns an error naming the emulators that the command made
+// no calls to, which usually means its clients were not configured to use
+// the emulators.
+func checkUsage(proxies map[string]*Proxy) error {
+	var unused []string
+	for name, p := range proxies {
+		if p.Total() == 0 {
+			unused = append(unused, name)
+		} else if verbose.any() {
+			slog.Info("Emulator calls", "emulator", name, "calls", formatCalls(p.Calls()))
+		}
 	}
-	env := strings.Split(string(out), "\n")
-	for i, v := range env {
-		env[i] = strings.Replace(v, "export ", "", -1)
+	if len(unused) == 0 {
+		return nil
 	}
-	return env
+	sort.Strings(unused)
+	return fmt.Errorf("command made no calls to the %s emulator(s); check that its clients use the emulator environment variables",
+		strings.Join(unused, ", "))
 }
 
-type watchFor struct {
-	base     io.Writer
-	buf      bytes.Buffer
-	sentinel string
-	c        chan struct{}
-	done     bool
+// diagnose writes a diagnostics bundle for failure and logs where it is.
+func diagnose(failure error, emulators []*Emulator, env []string) {
+	dir, err := writeDiagnostics(*artifacts, failure, emulators, env)
+	if err != nil {
+		slog.Error("Could not write diagnostics", "err", err)
+		return
+	}
+	slog.Info("Diagnostics written", "dir", dir)
 }
 
-func (r *watchFor) Write(data []byte) (n int, err error) {
-	n, err = r.base.Write(data)
-	if r.done || err != nil {
-		return
+// exitCode returns the exit code to use for a child that finished with err,
+// following the shell convention of 128+N for a child killed by signal N.
+// It reports false if err does not describe the child exiting.
+func exitCode(err error) (int, bool) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
 	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), true
+	}
+	return exitErr.ExitCode(), true
+}
 
-	n, err = r.buf.Write(data)
-	if strings.Contains(r.buf.String(), r.sentinel) {
-		close(r.c)
-		r.done = true
+// sessionProject returns the project that emulator resources are created
+// and looked up in: the configured project or, by default, the one
+// reported by the Datastore emulator.
+func sessionProject(cfg *Config, env []string) string {
+	if cfg.Project != "" {
+		return cfg.Project
 	}
-	return
+	return lookupEnv(env, "DATASTORE_PROJECT_ID")
 }
 
-func forwardSignals() {
-	pgroup, err := os.FindProcess(-os.Getpid())
-	if err != nil {
-		log.Fatalf("Could not find proc 0: %v", err)
-	}
-	sigch := make(chan os.Signal, 1)
-	go func() {
-		select {
-		case sig := <-sigch:
-			// Forward the signal.
-			pgroup.Signal(sig)
+// waitReadyWhen blocks until the resources listed in cfg.ReadyWhen exist.
+func waitReadyWhen(ctx context.Context, cfg *Config, env []string) error {
+	if len(cfg.ReadyWhen) == 0 {
+		return nil
+	}
+	var rs []Resource
+	for _, s := range cfg.ReadyWhen {
+		r, err := ParseResource(s)
+		if err != nil {
+			return err
 		}
-	}()
-	signal.Notify(sigch,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGHUP,
-	)
+		rs = append(rs, r)
+	}
+	project := sessionProject(cfg, env)
+	timeout := time.Duration(cfg.ReadyTimeout)
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return WaitResources(ctx, rs, env, project)
 }
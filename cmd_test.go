@@ -0,0 +1,96 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitReadyExited(t *testing.T) {
+	e := &Emulator{
+		Command:       []string{"sh", "-c", "echo port in use >&2; exit 3"},
+		ReadySentinel: "is now running",
+		ReadyTimeout:  10 * time.Second,
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	err := e.WaitReady(context.Background())
+	if err == nil {
+		t.Fatal("WaitReady: got nil error, want exit error")
+	}
+	for _, want := range []string{"exited with code 3", "port in use"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("WaitReady error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestWaitReadyProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	e := &Emulator{
+		Command:       []string{"sh", "-c", "sleep 10"},
+		ReadySentinel: "never printed",
+		HostPort:      strings.TrimPrefix(srv.URL, "http://"),
+		HealthPath:    "/",
+		ReadyTimeout:  10 * time.Second,
+		StopTimeout:   time.Second,
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if err := e.WaitReady(context.Background()); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+}
+
+func TestEmulatorDone(t *testing.T) {
+	e := &Emulator{Name: "crashy", Command: []string{"sh", "-c", "echo out of memory >&2; exit 3"}}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-e.Done(); err == nil || !strings.Contains(err.Error(), "crashy emulator exited with code 3") {
+		t.Errorf("Done after a crash: got %v, want exit error", err)
+	}
+
+	e = &Emulator{Name: "sleepy", Command: []string{"sh", "-c", "sleep 10"}, StopTimeout: time.Second}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := e.Done()
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Done after Stop: got %v, want nil", err)
+	}
+}
+
+func TestDashed(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		n    int
+		want bool
+	}{
+		{[]string{"go", "test"}, 2, false},
+		{[]string{"-v", "go", "test"}, 2, false},
+		{[]string{"--", "env"}, 1, true},
+		{[]string{"-v", "--", "go", "test", "--"}, 3, true},
+		{[]string{"go", "--", "test"}, 3, false},
+		{[]string{"--"}, 0, true},
+		{nil, 0, false},
+	} {
+		if got := dashed(tt.args, tt.n); got != tt.want {
+			t.Errorf("dashed(%q, %d) = %v, want %v", tt.args, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// completionMain implements the completion subcommand, which prints a
+// completion script for a shell, e.g.
+//
+//	source <(with_emulators completion bash)
+func completionMain(args []string) int {
+	if len(args) != 1 || completionTemplates[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: with_emulators completion bash|zsh|fish")
+		return 2
+	}
+	if err := writeCompletion(os.Stdout, args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "completion: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// completion is what the scripts complete.
+type completion struct {
+	Subcommands []subcommand
+	Flags       []completionFlag
+	Emulators   []string
+
+	// EmulatorArgs lists the subcommands whose arguments are emulators.
+	EmulatorArgs []string
+}
+
+type subcommand struct {
+	Name, Help string
+}
+
+type completionFlag struct {
+	Name, Help string
+	Bool       bool // takes no value
+}
+
+func newCompletion() *completion {
+	c := &completion{Emulators: emulatorNames()}
+	for _, sc := range subcommands {
+		name := strings.Fields(sc[0])[0]
+		if strings.Contains(sc[0], "EMULATOR") {
+			c.EmulatorArgs = append(c.EmulatorArgs, name)
+		}
+		if len(c.Subcommands) > 0 && c.Subcommands[len(c.Subcommands)-1].Name == name {
+			continue // e.g. generate testmain and generate devcontainer
+		}
+		c.Subcommands = append(c.Subcommands, subcommand{name, sc[1]})
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		help := strings.SplitN(f.Usage, "\n", 2)[0]
+		c.Flags = append(c.Flags, completionFlag{f.Name, help, ok && b.IsBoolFlag()})
+	})
+	return c
+}
+
+// writeCompletion writes the completion script for shell to w.
+func writeCompletion(w io.Writer, shell string) error {
+	return completionTemplates[shell].Execute(w, newCompletion())
+}
+
+var completionFuncs = template.FuncMap{
+	"join": strings.Join,
+	"subcommandNames": func(subcommands []subcommand) string {
+		var names []string
+		for _, sc := range subcommands {
+			names = append(names, sc.Name)
+		}
+		return strings.Join(names, " ")
+	},
+	"flagNames": func(flags []completionFlag, bools bool) string {
+		var names []string
+		for _, f := range flags {
+			if !bools || f.Bool {
+				names = append(names, "-"+f.Name)
+			}
+		}
+		return strings.Join(names, " ")
+	},
+	// zsh quotes a string for a single-quoted _arguments spec, escaping
+	// the brackets that delimit descriptions.
+	"zsh": func(s string) string {
+		return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`).Replace(s)
+	},
+	// fish quotes a string for a single-quoted fish argument.
+	"fish": func(s string) string {
+		return strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s)
+	},
+}
+
+var completionTemplates = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Funcs(completionFuncs).Parse(`# bash completion for with_emulators, from "with_emulators completion bash".
+_with_emulators() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" sub="" w i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		w="${COMP_WORDS[i]}"
+		case "$w" in
+		-*)
+			# COMP_WORDS splits -flag=value at the =.
+			if [[ "${COMP_WORDS[i+1]}" == "=" ]]; then
+				((i += 2))
+			elif [[ " {{flagNames .Flags true}} " != *" $w "* ]]; then
+				((i++)) # the flag's value
+			fi
+			;;
+		*)
+			sub="$w"
+			break
+			;;
+		esac
+	done
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "{{flagNames .Flags false}}" -- "$cur"))
+	elif [[ -z "$sub" ]]; then
+		COMPREPLY=($(compgen -W "{{subcommandNames .Subcommands}}" -- "$cur"))
+	elif [[ " {{join .EmulatorArgs " "}} " == *" $sub "* ]]; then
+		COMPREPLY=($(compgen -W "{{join .Emulators " "}}" -- "$cur"))
+	fi
+}
+complete -o default -F _with_emulators with_emulators
+`)),
+
+	"zsh": template.Must(template.New("zsh").Funcs(completionFuncs).Parse(`#compdef with_emulators
+# zsh completion for with_emulators, from "with_emulators completion zsh".
+_with_emulators() {
+	local -a subcommands
+	subcommands=({{range .Subcommands}}
+		'{{zsh .Name}}:{{zsh .Help}}'{{end}}
+	)
+	_arguments -C{{range .Flags}} \
+		'-{{.Name}}{{if not .Bool}}={{end}}[{{zsh .Help}}]{{if not .Bool}}:{{.Name}}:_files{{end}}'{{end}} \
+		'1:subcommand:->subcommand' \
+		'*::argument:->argument'
+	case $state in
+	subcommand)
+		_describe subcommand subcommands
+		;;
+	argument)
+		case $words[1] in
+		{{join .EmulatorArgs "|"}})
+			_values emulator {{join .Emulators " "}}
+			;;
+		*)
+			_files
+			;;
+		esac
+		;;
+	esac
+}
+if [ "$funcstack[1]" = "_with_emulators" ]; then
+	_with_emulators "$@"
+else
+	compdef _with_emulators with_emulators
+fi
+`)),
+
+	"fish": template.Must(template.New("fish").Funcs(completionFuncs).Parse(`# fish completion for with_emulators, from "with_emulators completion fish".
+{{range .Subcommands -}}
+complete -c with_emulators -n __fish_use_subcommand -a {{.Name}} -d '{{fish .Help}}'
+{{end -}}
+{{range .Flags -}}
+complete -c with_emulators -o {{.Name}}{{if not .Bool}} -r{{end}} -d '{{fish .Help}}'
+{{end -}}
+complete -c with_emulators -n '__fish_seen_subcommand_from {{join .EmulatorArgs " "}}' -f -a '{{join .Emulators " "}}'
+`)),
+}
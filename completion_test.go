@@ -0,0 +1,66 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompletion(t *testing.T) {
+	for shell := range completionTemplates {
+		var buf bytes.Buffer
+		if err := writeCompletion(&buf, shell); err != nil {
+			t.Fatalf("%s: %v", shell, err)
+		}
+		for _, want := range []string{"restart", "completion", "pubsub", "config"} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("%s completion doesn't mention %s", shell, want)
+			}
+		}
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash")
+	}
+	dir, err := ioutil.TempDir("", "with_emulators-completion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "completion.bash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCompletion(f, "bash"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for _, c := range []struct {
+		words string
+		want  string
+	}{
+		{"with_emulators re", "reset restart"},
+		{"with_emulators -config = x.json -v res", "reset restart"},
+		{"with_emulators -config x.json restart p", "pubsub"},
+		{"with_emulators -shut", "-shutdown-timeout"},
+		{"with_emulators run go te", ""},
+	} {
+		script := "source " + f.Name() + "; COMP_WORDS=(" + c.words + "); COMP_CWORD=$((${#COMP_WORDS[@]} - 1)); _with_emulators; echo \"${COMPREPLY[*]}\""
+		out, err := exec.Command(bash, "-c", script).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != c.want {
+			t.Errorf("completing %q: got %q, want %q", c.words, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// missingComponentsRE matches gcloud's messages about components that a
+// command needs but are not installed, such as
+// "requires the installation of components: [pubsub-emulator]" and
+// "You need the [cloud-datastore-emulator] component".
+var missingComponentsRE = regexp.MustCompile(`installation of components: \[([^\]]+)\]|You need the \[([^\]]+)\] component`)
+
+// missingComponents returns the gcloud components that output, from an
+// emulator that failed to start, says are missing.
+func missingComponents(output string) []string {
+	var components []string
+	for _, m := range missingComponentsRE.FindAllStringSubmatch(output, -1) {
+		list := m[1] + m[2]
+		for _, c := range strings.Split(list, ",") {
+			if c = strings.TrimSpace(c); c != "" && !contains(components, c) {
+				components = append(components, c)
+			}
+		}
+	}
+	return components
+}
+
+// installMissing installs the gcloud components that e failed to start
+// without, with -auto-install or if the user agrees, and reports whether
+// e can be restarted with them. installed records the components already
+// installed by the session, which are not installed again.
+func installMissing(e *Emulator, installed map[string]bool) bool {
+	if e.Container != nil || e.output == nil {
+		return false
+	}
+	var components []string
+	for _, c := range missingComponents(e.output.String()) {
+		if !installed[c] {
+			components = append(components, c)
+		}
+	}
+	if len(components) == 0 {
+		// Nothing missing, or installed for another emulator.
+		return len(missingComponents(e.output.String())) > 0
+	}
+	install := "gcloud components install " + strings.Join(components, " ")
+	if !*autoInstall && !confirm(fmt.Sprintf("The %s emulator needs gcloud components that aren't installed. Run %q?", e.Name, install)) {
+		slog.Error("Missing gcloud components; install them, or use -auto-install", "emulator", e.Name, "command", install)
+		return false
+	}
+	slog.Info("Installing gcloud components", "components", strings.Join(components, ","))
+	cmd := exec.Command("gcloud", append([]string{"components", "install", "--quiet"}, components...)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		slog.Error("Could not install gcloud components", "command", install, "err", err)
+		return false
+	}
+	for _, c := range components {
+		installed[c] = true
+	}
+	return true
+}
+
+// confirm asks the user a yes/no question on the terminal, and reports
+// whether they answered yes. It returns false without asking if stdin is not
+// a terminal.
+func confirm(question string) bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(fi, null) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// composeMain implements the compose subcommand, which writes a Docker
+// Compose file with a service per emulator, and an env file pointing an
+// application service at them.
+func composeMain(args []string) int {
+	fs := flag.NewFlagSet("compose", flag.ContinueOnError)
+	config := fs.String("config", *configPath, "Configuration file to take the project and emulator arguments from")
+	proj := fs.String("project", *project, "Project ID for the emulators (overrides the config)")
+	img := fs.String("image", *image, "Image to run the emulators in")
+	out := fs.String("o", "compose.emulators.yaml", "Compose file to write")
+	envOut := fs.String("env-file", "emulators.env", "Env file to write, for the application service's env_file")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: with_emulators compose [flags]\n\n")
+		fmt.Fprintf(os.Stderr, "Writes a Docker Compose file with a service per emulator, and an env file pointing other services at them.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	cfg := &Config{}
+	if *config != "" {
+		var err error
+		if cfg, err = LoadConfig(*config); err != nil {
+			fmt.Fprintf(os.Stderr, "compose: %v\n", err)
+			return 1
+		}
+	}
+	if *proj != "" {
+		cfg.Project = *proj
+	}
+
+	yaml, env, err := generateCompose(cfg, *img, filepath.Base(*envOut))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compose: %v\n", err)
+		return 1
+	}
+	var b bytes.Buffer
+	writeEnv(&b, env, "dotenv")
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{{*out, yaml}, {*envOut, b.Bytes()}} {
+		if err := ioutil.WriteFile(f.path, f.data, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "compose: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// composeService is an emulator's service in a Compose file.
+type composeService struct {
+	Name    string
+	Image   string
+	Command []string
+	Port    string
+	Env     []string
+}
+
+var composeTemplate = template.Must(template.New("compose").Funcs(template.FuncMap{
+	"quote": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v) // JSON is valid YAML
+		return string(b), err
+	},
+}).Parse(`# Generated by "with_emulators compose". Point an application service at
+# the emulators with:
+#
+#   env_file: {{.EnvFile}}
+#   depends_on:{{range .Services}}
+#     {{.Name}}:
+#       condition: service_healthy{{end}}
+services:{{range .Services}}
+  {{.Name}}:
+    image: {{quote .Image}}
+    command: {{quote .Command}}{{if .Env}}
+    environment: {{quote .Env}}{{end}}
+    ports:
+      - {{quote (printf "127.0.0.1:%s:%s" .Port .Port)}}
+    healthcheck:
+      test: {{quote (printf "curl -fs http://localhost:%s/ || exit 1" .Port)}}
+      interval: 2s
+      timeout: 2s
+      retries: 60
+{{end}}`))
+
+// generateCompose returns a Compose file running the emulators configured
+// by cfg in containers of image, and the environment pointing other
+// services at them. envFile names the env file holding it.
+func generateCompose(cfg *Config, image, envFile string) ([]byte, []string, error) {
+	data := struct {
+		EnvFile  string
+		Services []composeService
+	}{EnvFile: envFile}
+	env := projectEnv(cfg)
+	for _, e := range defaultEmulators() {
+		port := strconv.Itoa(e.DefaultPort)
+		cmd := append(e.Command[:len(e.Command):len(e.Command)], "--host-port=0.0.0.0:"+port)
+		if cfg.Project != "" {
+			cmd = append(cmd, "--project="+cfg.Project)
+		}
+		cmd = append(cmd, cfg.Args[e.Name]...)
+		var svcEnv []string
+		if opts := cfg.JVMOptions[e.Name]; len(opts) > 0 {
+			svcEnv = append(svcEnv, javaToolOptions("", opts))
+		}
+		data.Services = append(data.Services, composeService{
+			Name:    e.Name,
+			Image:   image,
+			Command: cmd,
+			Port:    port,
+			Env:     svcEnv,
+		})
+		// Services reach each other by name.
+		env = append(env, aliasEnv([]string{e.HostEnv + "=" + e.Name + ":" + port}, cfg.EnvAliases)...)
+		if e.Name == "datastore" && cfg.Project != "" {
+			env = append(env, "DATASTORE_PROJECT_ID="+cfg.Project)
+		}
+	}
+	var b bytes.Buffer
+	if err := composeTemplate.Execute(&b, data); err != nil {
+		return nil, nil, err
+	}
+	return b.Bytes(), env, nil
+}
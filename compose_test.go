@@ -0,0 +1,45 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateCompose(t *testing.T) {
+	cfg := &Config{
+		Project:    "p",
+		Args:       map[string][]string{"datastore": {"--store-on-disk=false"}},
+		JVMOptions: map[string][]string{"pubsub": {"-Xmx256m", "-Xss1m"}},
+	}
+	yaml, env, err := generateCompose(cfg, "img", "emulators.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"  datastore:\n    image: \"img\"\n",
+		`"--host-port=0.0.0.0:8081","--project=p","--store-on-disk=false"]`,
+		"  pubsub:\n",
+		`environment: ["JAVA_TOOL_OPTIONS=-Xmx256m -Xss1m"]`,
+		`- "127.0.0.1:8085:8085"`,
+		"#   env_file: emulators.env\n",
+	} {
+		if !strings.Contains(string(yaml), want) {
+			t.Errorf("compose file missing %q:\n%s", want, yaml)
+		}
+	}
+	wantEnv := []string{
+		"GOOGLE_CLOUD_PROJECT=p",
+		"GCLOUD_PROJECT=p",
+		"DATASTORE_EMULATOR_HOST=datastore:8081",
+		"DATASTORE_PROJECT_ID=p",
+		"PUBSUB_EMULATOR_HOST=pubsub:8085",
+	}
+	if !reflect.DeepEqual(env, wantEnv) {
+		t.Errorf("env = %q, want %q", env, wantEnv)
+	}
+}
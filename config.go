@@ -0,0 +1,257 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON configuration file passed with -config.
+type Config struct {
+	// Project is the project ID the emulators use, exported to the command
+	// as GOOGLE_CLOUD_PROJECT and GCLOUD_PROJECT. It is also used to look
+	// up emulator resources.
+	// Defaults to the project configured in gcloud, or "with-emulators", as
+	// exported to the command in DATASTORE_PROJECT_ID.
+	Project string `json:"project"`
+
+	// Emulators lists the emulators to start, by name, e.g. ["pubsub"].
+	// Defaults to all of them. A daemon started with "start -daemon"
+	// starts and stops emulators to match when its config is reloaded
+	// with SIGHUP.
+	Emulators []string `json:"emulators"`
+
+	// Projects maps logical names to additional project IDs, for code that
+	// uses several projects, e.g. publishing to another project's topic.
+	// Each is exported to the command as NAME_PROJECT_ID, with NAME
+	// upper-cased, and the emulators accept requests for any of them.
+	Projects map[string]string `json:"projects"`
+
+	// Args maps emulator names to extra arguments for their gcloud start
+	// commands, e.g. {"datastore": ["--store-on-disk=false"]}. They come
+	// before arguments from the -datastore-arg and -pubsub-arg flags.
+	Args map[string][]string `json:"args"`
+
+	// Fixtures lists files of Datastore entities to load into the Datastore
+	// emulator once it is ready. See Fixture for the format.
+	Fixtures []string `json:"fixtures"`
+
+	// Topics lists Pub/Sub topics, with their subscriptions, to create
+	// once the Pub/Sub emulator is ready.
+	Topics []Topic `json:"topics"`
+
+	// ReadyWhen lists resources that must exist before the command is run,
+	// e.g. "pubsub:topic/foo" or "datastore:kind/Bar".
+	// See ParseResource for the accepted forms.
+	ReadyWhen []string `json:"readyWhen"`
+
+	// ReadyTimeout bounds how long to wait for ReadyWhen resources.
+	ReadyTimeout Duration `json:"readyTimeout"`
+
+	// Expect lists call count expectations checked after the command
+	// exits, e.g. "datastore:Commit>=1". See ParseExpectation.
+	Expect []string `json:"expect"`
+
+	// Notify lists hooks that are sent lifecycle events, such as an
+	// emulator crashing.
+	Notify []Hook `json:"notify"`
+
+	// Hooks are shell commands to run as the session starts and stops,
+	// e.g. {"postReady": ["./scripts/seed.sh"]}. See Hooks.
+	Hooks Hooks `json:"hooks"`
+
+	// Faults lists failures to inject into the command's calls to the
+	// emulators, through a proxy, to test its retry logic.
+	Faults []*Fault `json:"faults"`
+
+	// Throttle maps emulator names to added latency and bandwidth limits
+	// for the command's calls, through a proxy, to test it under realistic
+	// network conditions.
+	Throttle map[string]*Throttle `json:"throttle"`
+
+	// Remote maps emulator names to the host:port of emulators running
+	// elsewhere, such as on a CI service, used with -backend=remote.
+	Remote map[string]string `json:"remote"`
+
+	// JVMOptions maps emulator names to options for their JVMs, passed in
+	// JAVA_TOOL_OPTIONS, e.g. {"pubsub": ["-Xmx256m"]} to keep the emulators
+	// from using gigabytes of memory on small CI runners.
+	JVMOptions map[string][]string `json:"jvmOptions"`
+
+	// EnvAliases maps the names of variables exported to the command to
+	// more names to export their values as, for applications that read
+	// their own configuration keys, e.g.
+	// {"PUBSUB_EMULATOR_HOST": ["MYAPP_PUBSUB_ADDR"]}. The variables are
+	// still exported under their own names too.
+	EnvAliases map[string][]string `json:"envAliases"`
+
+	// ReadySentinel maps emulator names to regular expressions matching
+	// the output that shows the emulator is ready, replacing the built-in
+	// startup messages, e.g. after a gcloud release changes them.
+	ReadySentinel map[string]Regexp `json:"readySentinel"`
+
+	// LogFilter maps emulator names to filters for the output copied to
+	// the terminal with -v, e.g. to drop the JVM's INFO lines.
+	LogFilter map[string]*LogFilter `json:"logFilter"`
+}
+
+// LogFilter selects lines of emulator output. A line is dropped if it
+// matches an Exclude pattern and no Include pattern.
+type LogFilter struct {
+	Include []Regexp `json:"include"`
+	Exclude []Regexp `json:"exclude"`
+}
+
+// Keep reports whether line passes the filter.
+func (f *LogFilter) Keep(line []byte) bool {
+	if f == nil {
+		return true
+	}
+	for _, re := range f.Include {
+		if re.Match(line) {
+			return true
+		}
+	}
+	for _, re := range f.Exclude {
+		if re.Match(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// Regexp is a regular expression that is encoded in JSON as a string.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (re *Regexp) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("regexp must be a string: %v", err)
+	}
+	v, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	re.Regexp = v
+	return nil
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string, e.g. "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, t := range cfg.Topics {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("%s: topics: %v", path, err)
+		}
+	}
+	for _, s := range cfg.ReadyWhen {
+		if _, err := ParseResource(s); err != nil {
+			return nil, fmt.Errorf("%s: readyWhen: %v", path, err)
+		}
+	}
+	for _, s := range cfg.Expect {
+		if _, err := ParseExpectation(s); err != nil {
+			return nil, fmt.Errorf("%s: expect: %v", path, err)
+		}
+	}
+	for _, name := range cfg.Emulators {
+		if !contains(emulatorNames(), name) {
+			return nil, fmt.Errorf("%s: emulators: unknown emulator %q", path, name)
+		}
+	}
+	for name := range cfg.Args {
+		if !contains(emulatorNames(), name) {
+			return nil, fmt.Errorf("%s: args: unknown emulator %q", path, name)
+		}
+	}
+	for name := range cfg.LogFilter {
+		if !contains(emulatorNames(), name) {
+			return nil, fmt.Errorf("%s: logFilter: unknown emulator %q", path, name)
+		}
+	}
+	for _, f := range cfg.Faults {
+		if err := f.validate(); err != nil {
+			return nil, fmt.Errorf("%s: faults: %v", path, err)
+		}
+	}
+	for name, t := range cfg.Throttle {
+		if !contains(emulatorNames(), name) {
+			return nil, fmt.Errorf("%s: throttle: unknown emulator %q", path, name)
+		}
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("%s: throttle: %s: %v", path, name, err)
+		}
+	}
+	for name := range cfg.Remote {
+		if !contains(emulatorNames(), name) {
+			return nil, fmt.Errorf("%s: remote: unknown emulator %q", path, name)
+		}
+	}
+	for name := range cfg.JVMOptions {
+		if !contains(emulatorNames(), name) {
+			return nil, fmt.Errorf("%s: jvmOptions: unknown emulator %q", path, name)
+		}
+	}
+	for name := range cfg.ReadySentinel {
+		if !contains(emulatorNames(), name) {
+			return nil, fmt.Errorf("%s: readySentinel: unknown emulator %q", path, name)
+		}
+	}
+	for name, id := range cfg.Projects {
+		if projectVar(name) == "_PROJECT_ID" || id == "" {
+			return nil, fmt.Errorf("%s: projects: invalid project %q: %q", path, name, id)
+		}
+	}
+	for name, aliases := range cfg.EnvAliases {
+		for _, alias := range aliases {
+			if alias == "" || strings.ContainsAny(alias, "= ") {
+				return nil, fmt.Errorf("%s: envAliases: %s: invalid variable name %q", path, name, alias)
+			}
+		}
+	}
+	for _, h := range cfg.Notify {
+		if err := h.validate(); err != nil {
+			return nil, fmt.Errorf("%s: notify: %v", path, err)
+		}
+	}
+	if err := cfg.Hooks.validate(); err != nil {
+		return nil, fmt.Errorf("%s: hooks: %v", path, err)
+	}
+	return cfg, nil
+}
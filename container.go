@@ -0,0 +1,114 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// defaultImage is the Cloud SDK image that includes the emulators.
+const defaultImage = "gcr.io/google.com/cloudsdktool/cloud-sdk:emulators"
+
+// containerDataDir is where an emulator's DataDir is mounted in its
+// container.
+const containerDataDir = "/data"
+
+// Container runs an emulator's Command in a container, rather than with a
+// local gcloud and Java install.
+type Container struct {
+	Runtime string // container CLI: "docker" or "podman"
+	Image   string
+	Name    string // container name, unique to the session
+}
+
+// containerRuntime returns the container CLI for -backend: podman for
+// podman, and for docker, docker, or podman where only Podman is installed,
+// as is common where Docker Desktop isn't allowed.
+func containerRuntime(backend string) (string, error) {
+	if backend == "docker" {
+		if _, err := exec.LookPath("docker"); err == nil {
+			return "docker", nil
+		}
+	}
+	if _, err := exec.LookPath("podman"); err != nil {
+		if backend == "docker" {
+			return "", fmt.Errorf("-backend=docker: neither docker nor podman is installed")
+		}
+		return "", fmt.Errorf("-backend=podman: %v", err)
+	}
+	return "podman", nil
+}
+
+// containerize makes e run in a container with runtime, for -backend.
+func containerize(e *Emulator, runtime, image string) {
+	e.Container = &Container{
+		Runtime: runtime,
+		Image:   image,
+		Name:    fmt.Sprintf("with_emulators-%d-%s", os.Getpid(), e.Name),
+	}
+}
+
+// command returns the command line that runs cmd in the container, with
+// the variables in env and limits, if set, publishing the port of hostPort
+// there, and mounting dataDir, if set, at containerDataDir.
+func (c *Container) command(hostPort, dataDir string, env []string, limits *Limits, cmd []string) []string {
+	host, port, _ := net.SplitHostPort(hostPort)
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	publish := port + ":" + port
+	if !isWildcard(host) {
+		publish = net.JoinHostPort(host, port) + ":" + port
+	}
+	// --init runs a minimal init as PID 1, which passes on signals.
+	args := []string{c.Runtime, "run", "--rm", "--init", "--name", c.Name, "-p", publish}
+	if dataDir != "" {
+		mount := dataDir + ":" + containerDataDir
+		if c.Runtime == "podman" {
+			// Relabel the directory for SELinux, which rootless Podman
+			// enforces.
+			mount += ":Z"
+		}
+		args = append(args, "-v", mount)
+	}
+	for _, kv := range env {
+		args = append(args, "-e", kv)
+	}
+	if limits != nil {
+		args = append(args, limits.containerArgs()...)
+	}
+	args = append(args, c.Image)
+	return append(args, cmd...)
+}
+
+// listen returns the --host-port and --data-dir arguments for an emulator
+// in the container, for the emulator's hostPort and dataDir.
+func (c *Container) listen(hostPort, dataDir string) (string, string) {
+	_, port, _ := net.SplitHostPort(hostPort)
+	if dataDir != "" {
+		dataDir = containerDataDir
+	}
+	return "0.0.0.0:" + port, dataDir
+}
+
+// stop asks the container to stop, killing it after timeout, if not zero.
+func (c *Container) stop(timeout time.Duration) {
+	args := []string{"stop"}
+	if timeout > 0 {
+		args = append(args, "--time", strconv.Itoa(int((timeout+time.Second-1)/time.Second)))
+	}
+	exec.Command(c.Runtime, append(args, c.Name)...).Run()
+}
+
+// remove removes the container, if it exists, e.g. after its emulator
+// was killed, which leaves the container running.
+func (c *Container) remove() {
+	exec.Command(c.Runtime, "rm", "-f", c.Name).Run()
+}
@@ -0,0 +1,320 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A session that started its emulators serves HTTP on a Unix socket in
+// stateDir, named after its PID, so that other with_emulators processes
+// can ask it to act on them, e.g. "with_emulators restart pubsub". Only
+// the session's process can start and stop its emulators, since it holds
+// them. With -api, start serves the same API on a localhost port, for IDE
+// plugins, test frameworks and scripts, refusing requests from web pages:
+//
+//	GET  /emulators               the status of each emulator
+//	GET  /emulators/NAME          the status of one
+//	POST /emulators/NAME/start    start it, if stopped, and wait until ready
+//	POST /emulators/NAME/stop     stop it, keeping its port for start
+//	POST /emulators/NAME/restart  restart it, on the same port
+//	POST /emulators/NAME/reset    delete its data
+//
+// Responses are an EmulatorStatus, a list of them, or {"error": MESSAGE}.
+
+// controlActions are the actions of POST /emulators/NAME/ACTION.
+var controlActions = []string{"start", "stop", "restart", "reset"}
+
+// controlPath returns the path of the control socket of the session with
+// the given PID.
+func controlPath(pid int) string {
+	return filepath.Join(stateDir(), strconv.Itoa(pid)+".sock")
+}
+
+// controlRequest asks the session's main loop to act on an emulator.
+type controlRequest struct {
+	action string // one of controlActions
+	name   string // the emulator
+	result chan error
+}
+
+// Control returns a channel receiving the requests made through the
+// session's control socket, which the caller must pass to handle. The
+// first call starts serving the socket. Sessions that didn't start their
+// emulators return nil.
+func (s *Session) Control() <-chan controlRequest {
+	if s.control != nil || s.clientPath != "" || len(s.Emulators) == 0 {
+		return s.control
+	}
+	s.control = make(chan controlRequest)
+	path := controlPath(os.Getpid())
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		slog.Warn("Could not serve control socket", "path", path, "err", err)
+		return s.control
+	}
+	s.controlPath = path
+	s.controlServer = &http.Server{Handler: http.HandlerFunc(s.serveControl)}
+	go s.controlServer.Serve(l)
+	return s.control
+}
+
+// serveAPI serves the control API on addr, a localhost address, for -api.
+func (s *Session) serveAPI(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopback(host) {
+		return fmt.Errorf("-api %s: the API is unauthenticated, so must listen on localhost", addr)
+	}
+	if s.Control() == nil {
+		return fmt.Errorf("-api: the session has no emulators of its own to control")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.apiServer = &http.Server{Handler: localOnly(http.HandlerFunc(s.serveControl))}
+	go s.apiServer.Serve(l)
+	slog.Info("Control API running", "url", "http://"+l.Addr().String()+"/emulators")
+	return nil
+}
+
+// localOnly wraps the -api handler to refuse requests from web pages. Being
+// on localhost keeps other machines out, but the developer's browser can
+// still reach it: a page can POST to it cross-origin (an "Origin" it
+// doesn't share), or reach it under its own domain by DNS rebinding (a
+// "Host" other than a loopback name).
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if !isLoopback(strings.Trim(host, "[]")) {
+			controlError(w, http.StatusForbidden, fmt.Sprintf("host %q is not localhost", r.Host))
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			controlError(w, http.StatusForbidden, fmt.Sprintf("cross-origin request from %s", origin))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveControl serves the control API.
+func (s *Session) serveControl(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "emulators" {
+		if r.Method != "GET" {
+			controlError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		statuses := []EmulatorStatus{}
+		for _, e := range s.list() {
+			statuses = append(statuses, e.Status())
+		}
+		writeJSON(w, statuses)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "emulators/"), "/")
+	if !strings.HasPrefix(path, "emulators/") || len(parts) > 2 || len(parts) == 2 && !contains(controlActions, parts[1]) {
+		controlError(w, http.StatusNotFound, "not found")
+		return
+	}
+	e := findEmulator(s.list(), parts[0])
+	if e == nil {
+		controlError(w, http.StatusNotFound, fmt.Sprintf("no %s emulator", parts[0]))
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != "GET" {
+			controlError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, e.Status())
+		return
+	}
+	if r.Method != "POST" {
+		controlError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if st := e.Status().Status; parts[1] == "start" && st != "stopped" && st != "crashed" {
+		controlError(w, http.StatusConflict, fmt.Sprintf("%s is %s", e.Name, st))
+		return
+	}
+	req := controlRequest{action: parts[1], name: e.Name, result: make(chan error, 1)}
+	select {
+	case s.control <- req:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case err := <-req.result:
+		if err != nil {
+			controlError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	case <-r.Context().Done():
+		return
+	}
+	writeJSON(w, e.Status())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func controlError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// handle carries out req, from Control.
+func (s *Session) handle(req controlRequest) {
+	// A reload may have removed the emulator since the request was made.
+	e := s.emulator(req.name)
+	if e == nil {
+		req.result <- fmt.Errorf("no %s emulator", req.name)
+		return
+	}
+	var err error
+	switch req.action {
+	case "start", "restart":
+		// Restarting a stopped emulator starts it.
+		if req.action == "start" {
+			slog.Info("Starting emulator", "emulator", req.name)
+		} else {
+			slog.Info("Restarting emulator", "emulator", req.name)
+		}
+		if err = s.Restart(context.Background(), req.name); err == nil {
+			emit(StreamEvent{Event: EventRestarted, Emulator: req.name, PID: e.cmd.Process.Pid})
+		}
+	case "stop":
+		if e.Status().Status == "stopped" {
+			break
+		}
+		slog.Info("Stopping emulator", "emulator", req.name)
+		if err = e.Stop(); err == nil {
+			if st := s.State.emulator(req.name); st != nil {
+				st.PID = 0
+				s.State.Write()
+			}
+		}
+	case "reset":
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = resetEmulator(ctx, s.State, req.name)
+		cancel()
+	default:
+		err = fmt.Errorf("unknown action %q", req.action)
+	}
+	req.result <- err
+}
+
+// closeControl stops serving the control socket and API, if started.
+func (s *Session) closeControl() {
+	if s.controlServer != nil {
+		s.controlServer.Close()
+		os.Remove(s.controlPath)
+	}
+	if s.apiServer != nil {
+		s.apiServer.Close()
+	}
+}
+
+// controlClient returns a client for the control socket of the session
+// with the given PID. URLs' hosts are ignored.
+func controlClient(pid int) *http.Client {
+	path := controlPath(pid)
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// controlPost posts to path on the control socket of the session with the
+// given PID, decoding the JSON response into v.
+func controlPost(ctx context.Context, pid int, path string, v interface{}) error {
+	req, err := http.NewRequest("POST", "http://with_emulators"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := controlClient(pid).Do(req.WithContext(ctx))
+	if err != nil {
+		if _, statErr := os.Stat(controlPath(pid)); os.IsNotExist(statErr) {
+			return fmt.Errorf("session %d doesn't accept control requests", pid)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// restartMain implements the restart subcommand, which restarts emulators
+// of a running session, on the same ports, e.g. when one wedges.
+func restartMain(args []string) int {
+	fs := flag.NewFlagSet("restart", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	timeout := fs.Duration("timeout", 2*time.Minute, "How long to wait for each emulator to be ready again")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: with_emulators restart [-session PID] EMULATOR...")
+		return 2
+	}
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restart: %v\n", err)
+		return 1
+	}
+	code := 0
+	for _, name := range fs.Args() {
+		if st.emulator(name) == nil {
+			fmt.Fprintf(os.Stderr, "restart: no %s emulator in session %d\n", name, st.PID)
+			code = 1
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		var status EmulatorStatus
+		err := controlPost(ctx, st.PID, "/emulators/"+name+"/restart", &status)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restart: %s: %v\n", name, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("Restarted %s on %s\n", name, status.Endpoint)
+	}
+	return code
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Emulator{
+		Name:          "pubsub",
+		Command:       []string{"sh", "-c", "echo Server started, listening >&2; sleep 10"},
+		ReadySentinel: "Server started, listening",
+		HostPort:      "localhost:8085",
+		StopTimeout:   time.Second,
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	pid := e.cmd.Process.Pid
+	s := &Session{Emulators: []*Emulator{e}, State: &State{}}
+	defer s.closeControl()
+	control := s.Control()
+	go func() {
+		for req := range control {
+			s.handle(req)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var status EmulatorStatus
+	if err := controlPost(ctx, os.Getpid(), "/emulators/pubsub/restart", &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "ready" || status.Endpoint != "localhost:8085" || status.PID == pid || status.Restarts != 1 {
+		t.Errorf("after restart: got %+v, want ready on localhost:8085 in a new process", status)
+	}
+	if err := controlPost(ctx, os.Getpid(), "/emulators/datastore/restart", &status); err == nil || !strings.Contains(err.Error(), "no datastore emulator") {
+		t.Errorf("restarting a missing emulator: got %v, want no datastore emulator", err)
+	}
+
+	// A reload removed the emulator after the request was made.
+	s2 := &Session{State: &State{}}
+	for _, action := range controlActions {
+		req := controlRequest{action: action, name: "pubsub", result: make(chan error, 1)}
+		s2.handle(req)
+		if err := <-req.result; err == nil || !strings.Contains(err.Error(), "no pubsub emulator") {
+			t.Errorf("%s of a removed emulator: got %v, want no pubsub emulator", action, err)
+		}
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+
+	e := &Emulator{
+		Name:          "pubsub",
+		Command:       []string{"sh", "-c", "echo Server started, listening >&2; sleep 10"},
+		ReadySentinel: "Server started, listening",
+		HostPort:      "localhost:8085",
+		StopTimeout:   time.Second,
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if err := e.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := &Session{Emulators: []*Emulator{e}, State: &State{}, control: make(chan controlRequest)}
+	go func() {
+		for req := range s.control {
+			s.handle(req)
+		}
+	}()
+	srv := httptest.NewServer(localOnly(http.HandlerFunc(s.serveControl)))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		method, path string
+		code         int
+		status       string // of pubsub, in the response
+	}{
+		{"GET", "/emulators", 200, "ready"},
+		{"POST", "/emulators/pubsub/start", 409, ""},
+		{"POST", "/emulators/pubsub/stop", 200, "stopped"},
+		{"GET", "/emulators/pubsub", 200, "stopped"},
+		{"POST", "/emulators/pubsub/start", 200, "ready"},
+		{"POST", "/emulators/datastore/stop", 404, ""},
+		{"GET", "/emulators/pubsub/stop", 405, ""},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("%s %s: got %s %s, want %d", c.method, c.path, resp.Status, b, c.code)
+			continue
+		}
+		if c.status != "" && !strings.Contains(string(b), `"status":"`+c.status+`"`) {
+			t.Errorf("%s %s: got %s, want pubsub %s", c.method, c.path, b, c.status)
+		}
+	}
+
+	// Web pages can't use the API, whether cross-origin or by DNS rebinding.
+	for _, c := range []struct {
+		header, value string
+		code          int
+	}{
+		{"Origin", "https://evil.example", 403},
+		{"Origin", "null", 403},
+		{"Host", "evil.example", 403},
+		{"Origin", srv.URL, 200},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/emulators/pubsub/restart", nil)
+		if c.header == "Host" {
+			req.Host = c.value
+		} else {
+			req.Header.Set(c.header, c.value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("POST with %s: %s: got %s %s, want %d", c.header, c.value, resp.Status, b, c.code)
+		}
+	}
+	if restarts := e.Status().Restarts; restarts != 2 {
+		t.Errorf("pubsub restarted %d times, want 2 (start after stop, and the same-origin POST)", restarts)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envDaemonLog is set in the environment of a daemon started by
+// startDaemon, and names the file its stderr is written to.
+const envDaemonLog = "WITH_EMULATORS_DAEMON_LOG"
+
+// readyMarker is printed by a daemon after the session's environment, to
+// tell startDaemon that startup succeeded.
+const readyMarker = "# with_emulators session "
+
+// runOnlyFlags are the flags that startDaemon does not pass on, because
+// they only affect run or the daemon's parent.
+var runOnlyFlags = []string{"daemon", "expect", "exec", "verify-usage", "tune", "events", "events-fd", "output-fd", "rpc-log", "record", "replay", "tls", "mtls", "unix", "dir", "env-clear", "env-whitelist"}
+
+// startDaemon runs "with_emulators start" in the background, with the same
+// flags, and waits for its emulators to be ready. It writes the session's
+// environment to w, like start does, and returns, leaving the session
+// running until "with_emulators stop".
+func startDaemon(w io.Writer) int {
+	if err := makeStateDir(); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	logPath := filepath.Join(stateDir(), "daemon-"+strconv.FormatInt(time.Now().UnixNano(), 36)+".log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer logFile.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	args := []string{"start"}
+	flag.Visit(func(f *flag.Flag) {
+		if contains(runOnlyFlags, f.Name) {
+			return
+		}
+		if values, ok := f.Value.(*stringsFlag); ok {
+			for _, v := range *values {
+				args = append(args, "-"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), envDaemonLog+"="+logPath)
+	cmd.Stderr = logFile
+	detach(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	// The daemon closes stdout once it's ready, or exits on failure.
+	ready := false
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, readyMarker) {
+			ready = true
+		}
+		fmt.Fprintln(w, line)
+	}
+	if ready {
+		cmd.Process.Release()
+		return 0
+	}
+
+	err = cmd.Wait()
+	b, _ := ioutil.ReadFile(logPath)
+	os.Remove(logPath)
+	slog.Error(fmt.Sprintf("Daemon %s, output:\n%s", exitStatus(err), b))
+	return 1
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// devcontainerMain implements "generate devcontainer", which writes the
+// devcontainer.json properties that start the emulators when a dev
+// container, such as a Codespace, starts.
+func devcontainerMain(args []string) int {
+	fs := flag.NewFlagSet("generate devcontainer", flag.ContinueOnError)
+	config := fs.String("config", *configPath, "Configuration file for with_emulators, relative to the workspace folder")
+	proj := fs.String("project", *project, "Project ID for the emulators (overrides the config)")
+	be := fs.String("backend", "docker", "How the emulators run in the dev container: docker, with the docker-in-docker feature, or local, with gcloud and Java from the image")
+	out := fs.String("o", "-", "File to write, or - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: with_emulators generate devcontainer [flags]\n\n")
+		fmt.Fprintf(os.Stderr, "Writes devcontainer.json properties that start the emulators with the dev container and export their environment.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if *be != "docker" && *be != "local" {
+		fmt.Fprintf(os.Stderr, "generate devcontainer: invalid -backend %q, want docker or local\n", *be)
+		return 2
+	}
+	cfg := &Config{}
+	if *config != "" {
+		var err error
+		if cfg, err = LoadConfig(*config); err != nil {
+			fmt.Fprintf(os.Stderr, "generate devcontainer: %v\n", err)
+			return 1
+		}
+	}
+	if *proj != "" {
+		cfg.Project = *proj
+	}
+	b, err := generateDevcontainer(cfg, *config, *be)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate devcontainer: %v\n", err)
+		return 1
+	}
+	if *out == "-" {
+		_, err = os.Stdout.Write(b)
+	} else {
+		err = ioutil.WriteFile(*out, b, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate devcontainer: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// devcontainer holds the devcontainer.json properties written by
+// "generate devcontainer".
+type devcontainer struct {
+	Features          map[string]struct{} `json:"features"`
+	PostCreateCommand string              `json:"postCreateCommand"`
+	PostStartCommand  string              `json:"postStartCommand"`
+	ForwardPorts      []int               `json:"forwardPorts"`
+	RemoteEnv         map[string]string   `json:"remoteEnv"`
+}
+
+// generateDevcontainer returns devcontainer.json properties that install
+// with_emulators, start the emulators configured by cfg, read from config,
+// on the emulators' default ports, and point the container's processes
+// at them.
+func generateDevcontainer(cfg *Config, config, backend string) ([]byte, error) {
+	dc := devcontainer{
+		Features: map[string]struct{}{
+			"ghcr.io/devcontainers/features/go:1": {},
+		},
+		PostCreateCommand: "go install github.com/broady/with_emulators@latest",
+		RemoteEnv:         make(map[string]string),
+	}
+	if backend == "docker" {
+		dc.Features["ghcr.io/devcontainers/features/docker-in-docker:2"] = struct{}{}
+	} else {
+		dc.Features["ghcr.io/devcontainers/features/java:1"] = struct{}{}
+	}
+	start := []string{"with_emulators", "start", "-daemon"}
+	if backend == "docker" {
+		start = append(start, "-backend=docker")
+	}
+	if config != "" {
+		start = append(start, "-config="+shellQuote(config))
+	}
+	if cfg.Project != "" {
+		start = append(start, "-project="+shellQuote(cfg.Project))
+	}
+	for _, kv := range projectEnv(cfg) {
+		k, v := splitEnv(kv)
+		dc.RemoteEnv[k] = v
+	}
+	// Fixed ports, so that remoteEnv can name them.
+	for _, e := range defaultEmulators() {
+		hostPort := "localhost:" + strconv.Itoa(e.DefaultPort)
+		start = append(start, "-"+e.Name+"-host-port="+hostPort)
+		dc.ForwardPorts = append(dc.ForwardPorts, e.DefaultPort)
+		env := []string{e.HostEnv + "=" + hostPort}
+		if e.Name == "datastore" && cfg.Project != "" {
+			env = append(env, "DATASTORE_PROJECT_ID="+cfg.Project)
+		}
+		for _, kv := range aliasEnv(env, cfg.EnvAliases) {
+			k, v := splitEnv(kv)
+			dc.RemoteEnv[k] = v
+		}
+	}
+	dc.PostStartCommand = strings.Join(start, " ")
+	b, err := json.MarshalIndent(dc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
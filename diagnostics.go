@@ -0,0 +1,134 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeDiagnostics collects what is needed to report an emulator failure
+// upstream into a new directory under dir (or the temp dir, if dir is empty),
+// and returns the directory's path.
+//
+// The bundle holds the failure, each emulator's output, a jstack dump of
+// every JVM still running in the emulators' process groups, the listening
+// sockets and the emulator-related environment variables. The bundle is
+// meant to be attached to bug reports and CI artifacts, so it leaves out
+// the rest of the environment, which may hold credentials.
+func writeDiagnostics(dir string, failure error, emulators []*Emulator, env []string) (string, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	out, err := ioutil.TempDir(dir, "with_emulators-diagnostics-"+time.Now().Format("20060102-150405")+"-")
+	if err != nil {
+		return "", err
+	}
+	write := func(name string, b []byte) {
+		if err := ioutil.WriteFile(filepath.Join(out, name), b, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "diagnostics: %v\n", err)
+		}
+	}
+
+	write("failure.txt", []byte(failure.Error()+"\n"))
+	for _, e := range emulators {
+		if e.cmd == nil || e.cmd.Process == nil {
+			continue
+		}
+		write(e.Name+".log", []byte(e.output.String()))
+		for _, pid := range e.group.pids() {
+			if !isJava(pid) {
+				continue
+			}
+			if b, err := exec.Command("jstack", strconv.Itoa(pid)).CombinedOutput(); err == nil || len(b) > 0 {
+				write(fmt.Sprintf("%s.jstack.%d.txt", e.Name, pid), b)
+			}
+		}
+	}
+	write("sockets.txt", sockets())
+	write("env.txt", []byte(strings.Join(diagnosticEnv(env, emulators), "\n")+"\n"))
+	return out, nil
+}
+
+// diagnosticEnv returns the variables of env that configure emulators, their
+// clients or with_emulators itself, including envAliases, which are known by
+// holding an emulator's address. Any whose name suggests a secret is masked.
+func diagnosticEnv(env []string, emulators []*Emulator) []string {
+	addrs := make(map[string]bool)
+	for _, e := range emulators {
+		if e.HostPort != "" {
+			addrs[e.HostPort] = true
+		}
+	}
+	var out []string
+	for _, kv := range env {
+		nv := strings.SplitN(kv, "=", 2)
+		name := nv[0]
+		if !diagnosticVar(name) && !(len(nv) == 2 && addrs[nv[1]]) {
+			continue
+		}
+		if secretVar(name) {
+			kv = name + "=REDACTED"
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+func diagnosticVar(name string) bool {
+	switch name {
+	case "PATH", "JAVA_HOME", "JAVA_TOOL_OPTIONS", "GOOGLE_CLOUD_PROJECT", "GCLOUD_PROJECT":
+		return true
+	}
+	if strings.HasSuffix(name, "_EMULATOR_HOST") {
+		return true
+	}
+	for _, prefix := range []string{"DATASTORE_", "PUBSUB_", "CLOUDSDK_", "WITH_EMULATORS_"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func secretVar(name string) bool {
+	name = strings.ToUpper(name)
+	for _, s := range []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "CREDENTIAL"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isJava(pid int) bool {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	return err == nil && strings.TrimSpace(string(comm)) == "java"
+}
+
+// sockets returns the listening TCP sockets, using whichever tool is installed.
+func sockets() []byte {
+	for _, args := range [][]string{
+		{"ss", "-tlnp"},
+		{"netstat", "-tlnp"},
+		{"lsof", "-nP", "-iTCP", "-sTCP:LISTEN"},
+	} {
+		if b, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err == nil {
+			return b
+		}
+	}
+	if b, err := ioutil.ReadFile("/proc/net/tcp"); err == nil {
+		return b
+	}
+	return []byte("no socket information available\n")
+}
@@ -0,0 +1,231 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// finding is the result of one of doctor's checks.
+type finding struct {
+	Check  string // what was checked, e.g. "gcloud"
+	Status string // "ok", "warn" or "FAIL"
+	Detail string // what was found
+	Fix    string // for problems, how to fix them
+}
+
+// doctorMain implements the doctor subcommand, which checks that the
+// emulators can be started with the -backend in use, and explains how to
+// fix what would stop them.
+func doctorMain(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	code := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, f := range doctorFindings() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Status, f.Check, f.Detail)
+		if f.Fix != "" {
+			fmt.Fprintf(w, "\t\tfix: %s\n", f.Fix)
+		}
+		if f.Status == "FAIL" {
+			code = 1
+		}
+	}
+	w.Flush()
+	return code
+}
+
+// doctorFindings runs doctor's checks.
+func doctorFindings() []finding {
+	var fs []finding
+	emulators := defaultEmulators()
+	switch *backend {
+	case "local":
+		if _, err := exec.LookPath("gcloud"); err == nil {
+			g := detectGcloud()
+			for _, e := range emulators {
+				g.apply(e)
+			}
+		}
+		fs = append(fs, checkGcloud(emulators)...)
+		fs = append(fs, checkJava())
+	case "docker", "podman":
+		fs = append(fs, checkContainerRuntime())
+	case "java":
+		fs = append(fs, checkJava())
+	}
+	if *backend != "remote" {
+		for _, e := range emulators {
+			fs = append(fs, checkPort(e))
+		}
+	}
+	dirs := []string{os.TempDir(), stateDir()}
+	if *artifacts != "" {
+		dirs = append(dirs, *artifacts)
+	}
+	if *logDir != "" {
+		dirs = append(dirs, *logDir)
+	}
+	if *backend == "java" {
+		if dir, err := componentCacheDir(); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		fs = append(fs, checkWritable(dir))
+	}
+	return fs
+}
+
+// checkGcloud checks that gcloud is installed, with the components that
+// emulators need.
+func checkGcloud(emulators []*Emulator) []finding {
+	path, err := exec.LookPath("gcloud")
+	if err != nil {
+		return []finding{{
+			Check:  "gcloud",
+			Status: "FAIL",
+			Detail: "not found on PATH",
+			Fix:    "install the Google Cloud CLI (https://cloud.google.com/sdk/docs/install), or use -backend=docker",
+		}}
+	}
+	fs := []finding{{Check: "gcloud", Status: "ok", Detail: path}}
+	versions := gcloudVersions()
+	if versions == nil {
+		return append(fs, finding{
+			Check:  "gcloud components",
+			Status: "FAIL",
+			Detail: "\"gcloud version\" failed",
+			Fix:    "run \"gcloud version\" to see why, and reinstall gcloud if it is broken",
+		})
+	}
+	var components []string
+	for _, e := range emulators {
+		if contains(e.Command, "beta") && !contains(components, "beta") {
+			components = append(components, "beta")
+		}
+		components = append(components, e.Component)
+	}
+	for _, c := range components {
+		f := finding{Check: "component " + c, Status: "ok", Detail: versions[c]}
+		if f.Detail == "" {
+			f.Status = "FAIL"
+			f.Detail = "not installed"
+			f.Fix = "gcloud components install " + c
+			if strings.HasSuffix(c, "-emulator") {
+				f.Fix += fmt.Sprintf(" (or, for gcloud installed by a package manager, install google-cloud-cli-%s)", strings.TrimPrefix(c, "cloud-"))
+			}
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+// checkJava checks that a Java runtime the emulators run on is installed.
+func checkJava() finding {
+	f := finding{Check: "java"}
+	version, major, err := javaVersion()
+	switch {
+	case err != nil:
+		f.Status = "FAIL"
+		f.Detail = err.Error()
+		f.Fix = fmt.Sprintf("install a Java runtime, %d or later, e.g. openjdk-17-jre-headless, and put java on PATH or set JAVA_HOME", minJava)
+	case major < minJava:
+		f.Status = "FAIL"
+		f.Detail = "version " + version
+		f.Fix = fmt.Sprintf("the emulators need Java %d or later; install it and put it first on PATH", minJava)
+	default:
+		f.Status = "ok"
+		f.Detail = "version " + version
+	}
+	return f
+}
+
+// checkContainerRuntime checks that the container runtime for -backend is
+// installed and can run containers.
+func checkContainerRuntime() finding {
+	f := finding{Check: "container runtime"}
+	runtime, err := containerRuntime(*backend)
+	if err != nil {
+		f.Status = "FAIL"
+		f.Detail = err.Error()
+		f.Fix = "install Docker or Podman, or use -backend=local with gcloud"
+		return f
+	}
+	if out, err := exec.Command(runtime, "info").CombinedOutput(); err != nil {
+		f.Status = "FAIL"
+		f.Detail = fmt.Sprintf("%s info failed: %s", runtime, firstLine(out))
+		f.Fix = fmt.Sprintf("start the %s daemon (or machine), and check that your user may use it", runtime)
+		return f
+	}
+	f.Status = "ok"
+	f.Detail = runtime
+	return f
+}
+
+// checkPort checks that the address e listens on is free: its -NAME-host-port
+// or, by default, its default port, which clients that don't use the
+// emulator environment variables connect to.
+func checkPort(e *Emulator) finding {
+	hostPort := e.HostPort
+	fixed := hostPort != ""
+	if !fixed {
+		hostPort = net.JoinHostPort(*bind, strconv.Itoa(e.DefaultPort))
+	}
+	f := finding{Check: e.Name + " port", Status: "ok", Detail: hostPort + " is free"}
+	l, err := net.Listen("tcp", hostPort)
+	if err == nil {
+		l.Close()
+		return f
+	}
+	f.Detail = fmt.Sprintf("%s is in use: %v", hostPort, err)
+	f.Fix = "stop what listens there, such as an emulator left running (see \"with_emulators status\")"
+	if fixed {
+		f.Status = "FAIL"
+	} else {
+		f.Status = "warn"
+		f.Fix += "; with_emulators uses a free port, but clients that ignore " + e.HostEnv + " will reach it instead"
+	}
+	return f
+}
+
+// checkWritable checks that files can be created in dir.
+func checkWritable(dir string) finding {
+	f := finding{Check: "writable " + dir}
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		var tmp *os.File
+		if tmp, err = ioutil.TempFile(dir, "doctor"); err == nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		f.Status = "FAIL"
+		f.Detail = err.Error()
+		f.Fix = "fix the directory's permissions, or point TMPDIR (or XDG_RUNTIME_DIR, for state) elsewhere"
+		return f
+	}
+	f.Status = "ok"
+	return f
+}
+
+func firstLine(b []byte) string {
+	s := strings.TrimSpace(string(b))
+	if i := strings.Index(s, "\n"); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
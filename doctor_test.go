@@ -0,0 +1,47 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckPort(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	e := &Emulator{Name: "pubsub", HostEnv: "PUBSUB_EMULATOR_HOST", DefaultPort: port}
+	if f := checkPort(e); f.Status != "warn" || f.Fix == "" {
+		t.Errorf("default port in use: got %+v, want a warning with a fix", f)
+	}
+	e.HostPort = "localhost:" + strconv.Itoa(port)
+	if f := checkPort(e); f.Status != "FAIL" {
+		t.Errorf("-pubsub-host-port in use: got %+v, want FAIL", f)
+	}
+	l.Close()
+	if f := checkPort(e); f.Status != "ok" {
+		t.Errorf("free port: got %+v, want ok", f)
+	}
+}
+
+func TestMissingComponents(t *testing.T) {
+	output := "ERROR: (gcloud.beta.emulators.pubsub.start) You do not currently have this command group installed.  " +
+		"Using it requires the installation of components: [beta, pubsub-emulator]\n" +
+		"You need the [pubsub-emulator] component to use the Google Cloud Pub/Sub emulator.\n"
+	got := strings.Join(missingComponents(output), ",")
+	if want := "beta,pubsub-emulator"; got != want {
+		t.Errorf("missingComponents = %s, want %s", got, want)
+	}
+	if got := missingComponents("Server started, listening on 8085"); got != nil {
+		t.Errorf("missingComponents of normal output = %v, want none", got)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dsMain implements the ds subcommand, which prints entities from a
+// running session's Datastore emulator as JSON, in the format of fixtures
+// files (see Fixture):
+//
+//	with_emulators ds get KEY...
+//	with_emulators ds list [-ancestor KEY] KIND
+//	with_emulators ds dump
+//
+// Keys are written as slash-separated paths of kinds and names or IDs,
+// e.g. Shelf/fiction/Book/1. A numeric name is taken as an ID.
+func dsMain(args []string) int {
+	fs := flag.NewFlagSet("ds", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	project := fs.String("project", "", "Project to read (default: the session's)")
+	namespace := fs.String("namespace", "", "Namespace to read")
+	ancestor := fs.String("ancestor", "", "With list, only list entities with this ancestor key")
+	limit := fs.Int("limit", 0, "With list and dump, the maximum number of entities to print (0 for all)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: with_emulators ds [flags] get KEY...\n       with_emulators ds [flags] list KIND\n       with_emulators ds [flags] dump")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ds: %v\n", err)
+		return 1
+	}
+	ds := st.emulator("datastore")
+	if ds == nil {
+		fmt.Fprintf(os.Stderr, "ds: session %d has no datastore emulator\n", st.PID)
+		return 1
+	}
+	if *project == "" {
+		*project = st.project()
+	}
+	c := &datastoreClient{host: ds.Endpoint, project: *project, namespace: *namespace}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var fixtures []Fixture
+	switch {
+	case args[0] == "get" && len(args) > 1:
+		var keys []interface{}
+		for _, s := range args[1:] {
+			key, err := c.parseKey(s)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ds: %v\n", err)
+				return 2
+			}
+			keys = append(keys, key)
+		}
+		fixtures, err = c.lookup(ctx, keys)
+	case args[0] == "list" && len(args) == 2:
+		query := map[string]interface{}{"kind": []map[string]string{{"name": args[1]}}}
+		if *ancestor != "" {
+			key, err := c.parseKey(*ancestor)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ds: %v\n", err)
+				return 2
+			}
+			query["filter"] = map[string]interface{}{"propertyFilter": map[string]interface{}{
+				"property": map[string]string{"name": "__key__"},
+				"op":       "HAS_ANCESTOR",
+				"value":    map[string]interface{}{"keyValue": key},
+			}}
+		}
+		fixtures, err = c.query(ctx, query, *limit)
+	case args[0] == "dump" && len(args) == 1:
+		fixtures, err = c.query(ctx, map[string]interface{}{}, *limit)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ds %s: %v\n", args[0], err)
+		return 1
+	}
+	if fixtures == nil {
+		fixtures = []Fixture{}
+	}
+	b, err := json.MarshalIndent(fixtures, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ds: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s\n", b)
+	return 0
+}
+
+// datastoreClient makes Datastore REST API calls to an emulator.
+type datastoreClient struct {
+	host, project, namespace string
+}
+
+// parseKey parses a slash-separated key path into its REST representation.
+func (c *datastoreClient) parseKey(s string) (map[string]interface{}, error) {
+	f := Fixture{Namespace: c.namespace}
+	for i, part := range strings.Split(s, "/") {
+		if _, err := strconv.ParseInt(part, 10, 64); i%2 == 1 && err == nil {
+			f.Key = append(f.Key, json.Number(part))
+			continue
+		}
+		f.Key = append(f.Key, part)
+	}
+	key, err := f.datastoreKey(c.project)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: want KIND/NAME_OR_ID[/KIND/NAME_OR_ID...]", s)
+	}
+	return key, nil
+}
+
+func (c *datastoreClient) lookup(ctx context.Context, keys []interface{}) ([]Fixture, error) {
+	var resp struct {
+		Found []struct {
+			Entity json.RawMessage `json:"entity"`
+		} `json:"found"`
+	}
+	if err := c.call(ctx, "lookup", map[string]interface{}{"keys": keys}, &resp); err != nil {
+		return nil, err
+	}
+	var fixtures []Fixture
+	for _, r := range resp.Found {
+		f, err := fixtureFromEntity(r.Entity)
+		if err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, f)
+	}
+	return fixtures, nil
+}
+
+// query runs query, following cursors until all results, or limit if it
+// is not 0, have been read.
+func (c *datastoreClient) query(ctx context.Context, query map[string]interface{}, limit int) ([]Fixture, error) {
+	var fixtures []Fixture
+	for {
+		if limit > 0 {
+			query["limit"] = limit - len(fixtures)
+		}
+		var resp struct {
+			Batch struct {
+				EntityResults []struct {
+					Entity json.RawMessage `json:"entity"`
+				} `json:"entityResults"`
+				EndCursor   string `json:"endCursor"`
+				MoreResults string `json:"moreResults"`
+			} `json:"batch"`
+		}
+		body := map[string]interface{}{
+			"partitionId": map[string]string{"projectId": c.project, "namespaceId": c.namespace},
+			"query":       query,
+		}
+		if err := c.call(ctx, "runQuery", body, &resp); err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Batch.EntityResults {
+			f, err := fixtureFromEntity(r.Entity)
+			if err != nil {
+				return nil, err
+			}
+			if kind := f.Key[len(f.Key)-2].(string); strings.HasPrefix(kind, "__") {
+				continue // statistics or metadata, in a kindless query
+			}
+			fixtures = append(fixtures, f)
+		}
+		if resp.Batch.MoreResults != "NOT_FINISHED" || len(resp.Batch.EntityResults) == 0 ||
+			(limit > 0 && len(fixtures) >= limit) {
+			return fixtures, nil
+		}
+		query["startCursor"] = resp.Batch.EndCursor
+	}
+}
+
+func (c *datastoreClient) call(ctx context.Context, method string, body, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("http://%s/v1/projects/%s:%s", c.host, url.PathEscape(c.project), method)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: unexpected status %s: %s", method, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// fixtureFromEntity converts an entity in its REST representation to a
+// Fixture. It is the inverse of the conversion done by SeedDatastore, for
+// the value types that fixtures can express; other values are kept in
+// their REST form.
+func fixtureFromEntity(raw json.RawMessage) (Fixture, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var e struct {
+		Key struct {
+			PartitionID struct {
+				NamespaceID string `json:"namespaceId"`
+			} `json:"partitionId"`
+			Path []struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+				ID   string `json:"id"`
+			} `json:"path"`
+		} `json:"key"`
+		Properties map[string]map[string]interface{} `json:"properties"`
+	}
+	if err := dec.Decode(&e); err != nil {
+		return Fixture{}, err
+	}
+	f := Fixture{Namespace: e.Key.PartitionID.NamespaceID, Properties: make(map[string]interface{})}
+	for _, p := range e.Key.Path {
+		f.Key = append(f.Key, p.Kind)
+		if p.ID != "" {
+			f.Key = append(f.Key, json.Number(p.ID))
+		} else {
+			f.Key = append(f.Key, p.Name)
+		}
+	}
+	for name, v := range e.Properties {
+		f.Properties[name] = fixtureValue(v)
+	}
+	return f, nil
+}
+
+func fixtureValue(v map[string]interface{}) interface{} {
+	for typ, x := range v {
+		switch typ {
+		case "nullValue":
+			return nil
+		case "booleanValue", "stringValue", "doubleValue":
+			return x
+		case "integerValue":
+			if s, ok := x.(string); ok {
+				return json.Number(s)
+			}
+			return x
+		case "arrayValue":
+			values, _ := x.(map[string]interface{})["values"].([]interface{})
+			a := []interface{}{}
+			for _, e := range values {
+				if m, ok := e.(map[string]interface{}); ok {
+					a = append(a, fixtureValue(m))
+				}
+			}
+			return a
+		case "entityValue":
+			props, _ := x.(map[string]interface{})["properties"].(map[string]interface{})
+			m := make(map[string]interface{})
+			for name, p := range props {
+				if pm, ok := p.(map[string]interface{}); ok {
+					m[name] = fixtureValue(pm)
+				}
+			}
+			return m
+		}
+	}
+	// Timestamps, keys, blobs and geo points have no fixture form.
+	delete(v, "excludeFromIndexes")
+	delete(v, "meaning")
+	return v
+}
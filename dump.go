@@ -0,0 +1,90 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dumpLines is how many lines of each emulator's output a dump shows.
+const dumpLines = 10
+
+// dumpOnSignal writes a dump of the emulators returned by emulators to
+// stderr whenever with_emulators receives dumpSignal (SIGUSR1), to debug a
+// run that seems hung without interrupting it, until the returned function
+// is called.
+func dumpOnSignal(emulators func() []*Emulator) (stop func()) {
+	if dumpSignal == nil {
+		return func() {}
+	}
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, dumpSignal)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigch:
+				writeDump(os.Stderr, emulators())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigch)
+		close(done)
+	}
+}
+
+// writeDump writes the state, PID, endpoint and uptime of each emulator,
+// followed by the last lines of its output.
+func writeDump(w io.Writer, emulators []*Emulator) {
+	fmt.Fprintf(w, "with_emulators (PID %d, up %v):\n", os.Getpid(), time.Since(startTime).Round(time.Millisecond))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMULATOR\tSTATUS\tPID\tENDPOINT\tUPTIME\tRESTARTS")
+	for _, e := range emulators {
+		st := e.Status()
+		pid := "-"
+		if st.PID != 0 {
+			pid = fmt.Sprint(st.PID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%d\n", st.Name, st.Status, pid, st.Endpoint, time.Duration(st.Uptime), st.Restarts)
+	}
+	tw.Flush()
+	for _, e := range emulators {
+		lines := e.lastOutput(dumpLines)
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nLast output of %s:\n", e.Name)
+		for _, l := range lines {
+			fmt.Fprintf(w, "  %s\n", l)
+		}
+	}
+}
+
+// lastOutput returns up to n of the last lines that the emulator printed.
+func (e *Emulator) lastOutput(n int) []string {
+	e.mu.Lock()
+	output := e.output
+	e.mu.Unlock()
+	if output == nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(output.Tail(), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
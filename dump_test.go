@@ -0,0 +1,49 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteDump(t *testing.T) {
+	e := &Emulator{
+		Name:          "pubsub",
+		Command:       []string{"sh", "-c", "for i in $(seq 20); do echo line $i >&2; done; echo Server started, listening >&2; sleep 10"},
+		ReadySentinel: "Server started, listening",
+		HostPort:      "localhost:8085",
+		StopTimeout:   time.Second,
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if err := e.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writeDump(&buf, []*Emulator{e, {Name: "datastore"}})
+	out := buf.String()
+	for _, want := range []string{
+		fmt.Sprintf("pubsub     ready    %d", e.cmd.Process.Pid),
+		"localhost:8085",
+		"datastore  stopped  -",
+		"Last output of pubsub:\n  line 12\n",
+		"  Server started, listening\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dump doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "line 11\n") || strings.Contains(out, "of datastore") {
+		t.Errorf("dump has more output than wanted:\n%s", out)
+	}
+}
@@ -0,0 +1,573 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Emulator struct {
+	cmd    *exec.Cmd
+	ready  chan struct{}
+	output *watchFor
+	stderr *os.File // read end of the emulator's stderr
+	group  procGroup
+	start  time.Time
+
+	exited  chan struct{} // closed once the process has exited
+	waitErr error         // result of cmd.Wait, valid after exited is closed
+	done    chan error    // see Done
+
+	mu       sync.Mutex
+	stopping bool            // set by Stop, so that the exit is expected
+	starts   int             // how many times the process was started
+	addr     string          // HostPort as of the last start
+	pid      int             // of the process as of the last start
+	prefixed []*prefixWriter // filtered output of the last start
+
+	Name          string // used in log and error messages
+	Component     string // gcloud component ID, used to report the version
+	HostEnv       string // variable in Env holding the emulator's host:port
+	Command       []string
+	ReadySentinel string
+	ReadyPattern  *regexp.Regexp // if set, matched instead of ReadySentinel
+
+	// HealthPath, if set, is an HTTP path that the emulator answers with
+	// 200 OK once it is ready. It is polled along with watching for
+	// ReadySentinel, unless Readiness is "sentinel".
+	HealthPath string
+	Readiness  string // "probe" (the default) or "sentinel"
+
+	// HostPort, if set, is the address the emulator listens on, passed to
+	// Command as --host-port.
+	HostPort string
+
+	// Project, if set, is the project ID passed to Command as --project.
+	Project string
+
+	// DataDir, if set, is the directory the emulator keeps its data and
+	// configuration in, passed to Command as --data-dir.
+	DataDir string
+
+	// NoDataDir is set for emulators that don't accept --data-dir.
+	NoDataDir bool
+
+	// Container, if set, runs Command in a container. HostPort and DataDir
+	// are published and mounted there.
+	Container *Container
+
+	// Standalone, if set, runs the emulator from its standalone
+	// distribution instead of Command.
+	Standalone *Standalone
+
+	// JVMOptions are passed to the emulator's JVM in JAVA_TOOL_OPTIONS,
+	// e.g. -Xmx256m to bound its heap.
+	JVMOptions []string
+
+	// Limits, if set, bounds the memory and CPU used by the emulator's
+	// processes, with a cgroup on Linux or the container's limits.
+	Limits *Limits
+
+	// MinJava, if set, is the oldest Java release the emulator runs on,
+	// which must be installed unless it runs in a Container.
+	MinJava int
+
+	// ProjectEnv, if set, is the variable that Env sets to Project.
+	ProjectEnv string
+
+	// Args are extra arguments appended to Command.
+	Args []string
+
+	// DefaultPort is the port the emulator listens on by default.
+	DefaultPort int
+
+	// LogPath, if set, is a file that the emulator's output is written to.
+	LogPath string
+
+	// LogFilter, if set, selects the lines of output copied to the
+	// terminal with -v, and to Output.
+	LogFilter *LogFilter
+
+	// Output, if set, receives the emulator's output, whether or not -v
+	// copies it to the terminal, e.g. to capture it in a test's log with
+	// Logf(t.Logf). Each Write holds whole lines, tagged with Name.
+	Output io.Writer
+
+	// LogDir, if set, is a directory that the emulator's output is also
+	// appended to, as NAME.log, rotated once it reaches LogMaxSize bytes.
+	LogDir     string
+	LogMaxSize int64
+
+	// ReadyTimeout bounds how long WaitReady waits for ReadySentinel.
+	// Zero means wait until the context passed to WaitReady is done.
+	ReadyTimeout time.Duration
+
+	// StopTimeout is how long Stop waits after asking the emulator to
+	// exit before killing it. Zero means wait indefinitely.
+	StopTimeout time.Duration
+}
+
+func (e *Emulator) Start() error {
+	if e.ready != nil {
+		return errors.New("already started")
+	}
+	e.ready = make(chan struct{})
+
+	hostPort, dataDir := e.HostPort, e.DataDir
+	if e.Container != nil {
+		hostPort, dataDir = e.Container.listen(hostPort, dataDir)
+	}
+	args := e.Command[:len(e.Command):len(e.Command)]
+	if hostPort != "" {
+		args = append(args, "--host-port="+hostPort)
+	}
+	if dataDir != "" {
+		args = append(args, "--data-dir="+dataDir)
+	}
+	if e.Project != "" {
+		args = append(args, "--project="+e.Project)
+	}
+	args = append(args, e.Args...)
+	if e.Standalone != nil {
+		var err error
+		if args, err = e.Standalone.command(hostPort, dataDir, e.Project, e.Args); err != nil {
+			return err
+		}
+	}
+	var env []string
+	if len(e.JVMOptions) > 0 {
+		inherited := ""
+		if e.Container == nil {
+			inherited = os.Getenv("JAVA_TOOL_OPTIONS")
+		}
+		env = append(env, javaToolOptions(inherited, e.JVMOptions))
+	}
+	if e.Container != nil {
+		e.Container.remove()
+		args = e.Container.command(e.HostPort, e.DataDir, env, e.Limits, args)
+	} else if e.Limits != nil {
+		var err error
+		if args, err = e.Limits.command(e.Name, args); err != nil {
+			return err
+		}
+	}
+	e.cmd = exec.Command(args[0], args[1:]...)
+	if env != nil && e.Container == nil {
+		e.cmd.Env = append(os.Environ(), env...)
+	}
+	e.group.prepare(e.cmd)
+	out := ioutil.Discard
+	var prefixed []*prefixWriter
+	if verbose.of(e.Name) {
+		stderr := newPrefixWriter(os.Stderr, e.Name, useColor(os.Stderr))
+		stderr.timestamps(*timestamps, startTime)
+		stderr.filter = e.LogFilter
+		prefixed = append(prefixed, stderr)
+		out = stderr
+	}
+	if e.Output != nil {
+		w := newPrefixWriter(e.Output, e.Name, false)
+		w.filter = e.LogFilter
+		prefixed = append(prefixed, w)
+		out = io.MultiWriter(out, w)
+	}
+	var logFile *os.File
+	if e.LogPath != "" {
+		f, err := os.Create(e.LogPath)
+		if err != nil {
+			return err
+		}
+		logFile = f
+		out = io.MultiWriter(out, f)
+	}
+	var rotating *rotatingFile
+	if e.LogDir != "" {
+		f, err := openRotatingFile(filepath.Join(e.LogDir, e.Name+".log"), e.LogMaxSize)
+		if err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			return err
+		}
+		rotating = f
+		out = io.MultiWriter(out, f)
+	}
+	closeLog := func() {
+		for _, p := range prefixed {
+			p.Flush()
+		}
+		if logFile != nil {
+			logFile.Close()
+		}
+		if rotating != nil {
+			rotating.Close()
+		}
+	}
+	output := &watchFor{
+		base:     out,
+		sentinel: e.readyPattern(),
+		c:        e.ready,
+	}
+	e.mu.Lock()
+	e.output = output
+	e.prefixed = prefixed
+	e.mu.Unlock()
+	// Use our own pipe rather than letting exec.Cmd copy to e.output,
+	// so that the read end can be handed off in -exec mode.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		closeLog()
+		return err
+	}
+	e.cmd.Stderr = pw
+	if verbose.of(e.Name) || e.LogDir != "" || e.Output != nil {
+		// gcloud writes little to stdout; keep it with the rest.
+		e.cmd.Stdout = pw
+	}
+	e.mu.Lock()
+	e.start = time.Now()
+	e.mu.Unlock()
+	err = e.cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		closeLog()
+		return err
+	}
+	if err := e.group.add(e.cmd); err != nil {
+		e.cmd.Process.Kill()
+		e.cmd.Wait()
+		pr.Close()
+		closeLog()
+		return err
+	}
+	e.stderr = pr
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(e.output, pr)
+		closeLog()
+		close(copied)
+	}()
+	done := make(chan error, 1)
+	e.mu.Lock()
+	e.stopping = false
+	e.starts++
+	e.addr = e.HostPort
+	e.pid = e.cmd.Process.Pid
+	e.exited = make(chan struct{})
+	e.done = done
+	e.mu.Unlock()
+	go func() {
+		e.waitErr = e.cmd.Wait()
+		<-copied
+		e.mu.Lock()
+		var err error
+		if !e.stopping {
+			err = e.ExitError()
+		}
+		e.mu.Unlock()
+		close(e.exited)
+		if err != nil {
+			done <- err
+		}
+		close(done)
+	}()
+	if e.HealthPath != "" && e.HostPort != "" && e.Readiness != "sentinel" {
+		go e.probeReady()
+	}
+	return nil
+}
+
+// SetLogFilter sets LogFilter, applying it to the output of the running
+// process too.
+func (e *Emulator) SetLogFilter(f *LogFilter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.LogFilter = f
+	for _, p := range e.prefixed {
+		p.setFilter(f)
+	}
+}
+
+// Restart stops the emulator, if it is running, and starts it again.
+func (e *Emulator) Restart() error {
+	if err := e.Stop(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.ready, e.exited, e.waitErr, e.done = nil, nil, nil, nil
+	e.mu.Unlock()
+	e.group = procGroup{}
+	return e.Start()
+}
+
+// WaitReady blocks until the emulator answers on its HealthPath or prints
+// its ReadySentinel.
+// It returns an error, including the emulator's output so far, if ctx is done
+// or ReadyTimeout elapses first.
+func (e *Emulator) WaitReady(ctx context.Context) error {
+	if e.ReadyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.ReadyTimeout)
+		defer cancel()
+	}
+	select {
+	case <-e.ready:
+		return nil
+	case <-e.exited:
+		return fmt.Errorf("%q %s before printing %q, last output:\n%s",
+			strings.Join(e.Command, " "), exitStatus(e.waitErr), e.readyPattern(), e.output.Tail())
+	case <-ctx.Done():
+		return fmt.Errorf("%q did not print %q: %v; output:\n%s",
+			strings.Join(e.Command, " "), e.readyPattern(), ctx.Err(), e.output.String())
+	}
+}
+
+// readyPattern returns the pattern matching the output that shows that the
+// emulator is ready.
+func (e *Emulator) readyPattern() *regexp.Regexp {
+	if e.ReadyPattern != nil {
+		return e.ReadyPattern
+	}
+	return regexp.MustCompile(regexp.QuoteMeta(e.ReadySentinel))
+}
+
+// exitStatus describes the result of exec.Cmd.Wait.
+func exitStatus(err error) string {
+	if err == nil {
+		return "exited with code 0"
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return fmt.Sprintf("was killed by %v", ws.Signal())
+		}
+		return fmt.Sprintf("exited with code %d", exitErr.ExitCode())
+	}
+	return fmt.Sprintf("failed: %v", err)
+}
+
+// StartupDuration returns how long the emulator took to become ready,
+// or zero if it is not ready.
+func (e *Emulator) StartupDuration() time.Duration {
+	if e.output == nil {
+		return 0 // not started
+	}
+	readyAt := e.output.ReadyAt()
+	if readyAt.IsZero() {
+		return 0
+	}
+	return readyAt.Sub(e.start)
+}
+
+// Exited returns a channel that is closed when the emulator process exits.
+func (e *Emulator) Exited() <-chan struct{} {
+	return e.exited
+}
+
+// EmulatorStatus is a snapshot of the state of an emulator.
+type EmulatorStatus struct {
+	Name     string   `json:"name"`
+	Status   string   `json:"status"` // "starting", "ready", "crashed" or "stopped"
+	Endpoint string   `json:"endpoint,omitempty"`
+	PID      int      `json:"pid,omitempty"`      // of the running process
+	Uptime   Duration `json:"uptime,omitempty"`   // since the process started, unless stopped or crashed
+	Restarts int      `json:"restarts,omitempty"` // starts after the first
+
+	// Startup is how long the emulator took to become ready, at its
+	// last start, or zero if it is not ready.
+	Startup Duration `json:"startup,omitempty"`
+}
+
+// Status returns the emulator's current state. It may be called while
+// the emulator starts, restarts and stops.
+func (e *Emulator) Status() EmulatorStatus {
+	e.mu.Lock()
+	exited, output, stopping, start := e.exited, e.output, e.stopping, e.start
+	st := EmulatorStatus{Name: e.Name, Endpoint: e.addr, PID: e.pid}
+	if e.starts > 1 {
+		st.Restarts = e.starts - 1
+	}
+	e.mu.Unlock()
+
+	switch {
+	case exited == nil:
+		if output == nil {
+			st.Status = "stopped" // not started
+			return st
+		}
+		st.Status = "starting"
+	case isClosed(exited) && stopping:
+		st.Status, st.PID = "stopped", 0
+		return st
+	case isClosed(exited):
+		st.Status, st.PID = "crashed", 0
+		return st
+	case output != nil && !output.ReadyAt().IsZero():
+		st.Status = "ready"
+		st.Startup = Duration(output.ReadyAt().Sub(start).Round(time.Millisecond))
+	default:
+		st.Status = "starting"
+	}
+	st.Uptime = Duration(time.Since(start).Round(time.Millisecond))
+	return st
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that receives an error, describing why, if the
+// emulator process exits without being stopped by Stop or Restart, and is
+// closed once the process has exited. So a nil receive means the emulator
+// was stopped. Restart replaces the channel; it is nil before Start.
+func (e *Emulator) Done() <-chan error {
+	return e.done
+}
+
+// ExitError describes why the emulator exited, including its last output.
+// It must only be called after Exited is closed.
+func (e *Emulator) ExitError() error {
+	return fmt.Errorf("%s emulator %s, last output:\n%s", e.Name, exitStatus(e.waitErr), e.output.Tail())
+}
+
+// Stop terminates the emulator and the processes it started, and waits
+// for it to exit. If it is still running after StopTimeout, it is killed.
+func (e *Emulator) Stop() error {
+	if e.exited == nil {
+		return nil // not started
+	}
+	e.mu.Lock()
+	e.stopping = true
+	e.mu.Unlock()
+	defer e.group.close()
+	if e.Container != nil {
+		// Signalling the CLI would leave the container running.
+		e.Container.stop(e.StopTimeout)
+	}
+	if err := e.group.terminate(); err != nil {
+		return err
+	}
+	if e.StopTimeout == 0 {
+		<-e.exited
+		return nil
+	}
+	timer := time.NewTimer(e.StopTimeout)
+	defer timer.Stop()
+	select {
+	case <-e.exited:
+		return nil
+	case <-timer.C:
+	}
+	if err := e.group.kill(); err != nil {
+		return err
+	}
+	<-e.exited
+	return fmt.Errorf("did not exit within %v, killed", e.StopTimeout)
+}
+
+// Env returns the environment variables that point clients at the emulator.
+// They are derived from the address it was started on rather than read with
+// gcloud's env-init, which reads a file shared by every emulator using the
+// same data directory, and so may report another instance's address.
+func (e *Emulator) Env() []string {
+	env := []string{e.HostEnv + "=" + e.HostPort}
+	if e.ProjectEnv != "" && e.Project != "" {
+		env = append(env, e.ProjectEnv+"="+e.Project)
+	}
+	return env
+}
+
+type watchFor struct {
+	base     io.Writer
+	sentinel *regexp.Regexp
+	c        chan struct{}
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	done    bool
+	readyAt time.Time
+}
+
+func (r *watchFor) Write(data []byte) (n int, err error) {
+	n, err = r.base.Write(data)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf.Write(data)
+	if !r.done && r.sentinel.Match(r.buf.Bytes()) {
+		r.setReady()
+	}
+	// Once ready, only keep enough output to explain a crash.
+	if r.done && r.buf.Len() > 2*tailSize {
+		b := r.buf.Bytes()
+		b = append([]byte(nil), b[len(b)-tailSize:]...)
+		r.buf.Reset()
+		r.buf.Write(b)
+	}
+	return
+}
+
+// markReady marks the emulator ready, as if the sentinel had been seen.
+func (r *watchFor) markReady() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.done {
+		r.setReady()
+	}
+}
+
+func (r *watchFor) setReady() {
+	close(r.c)
+	r.done = true
+	r.readyAt = time.Now()
+}
+
+// String returns the captured output. Once the sentinel has been seen,
+// only recent output is retained.
+func (r *watchFor) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.String()
+}
+
+// ReadyAt returns when the sentinel was seen, or the zero time if it wasn't.
+func (r *watchFor) ReadyAt() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readyAt
+}
+
+// tailSize is how much output Tail returns.
+const tailSize = 4096
+
+// Tail returns the end of the captured output.
+func (r *watchFor) Tail() string {
+	s := r.String()
+	if len(s) > tailSize {
+		s = "..." + s[len(s)-tailSize:]
+	}
+	return s
+}
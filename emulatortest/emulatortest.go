@@ -0,0 +1,415 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package emulatortest runs a package's tests under with_emulators.
+//
+// Use it from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		emulatortest.Main(m, emulatortest.Options{
+//			Unavailable: emulatortest.SkipIfUnavailable,
+//		})
+//	}
+//
+// "with_emulators generate testmain" writes such a TestMain.
+//
+// Tests can inspect the emulators they run against with ReadMetadata:
+//
+//	md, err := emulatortest.ReadMetadata()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	t.Logf("datastore %s started in %v", md.Emulator("datastore").Version, md.Emulator("datastore").StartupDuration)
+package emulatortest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// envMarker is set by with_emulators in the environment of the commands it runs.
+// It must match the constant of the same name in the with_emulators command.
+const envMarker = "WITH_EMULATORS"
+
+// Policy controls what Main does when a prerequisite, such as gcloud or
+// Java, is missing.
+type Policy int
+
+const (
+	// FailIfUnavailable fails the test binary. This is the default, and
+	// is usually what CI wants.
+	FailIfUnavailable Policy = iota
+
+	// SkipIfUnavailable exits successfully without running any tests,
+	// which suits developer machines without the emulators installed.
+	SkipIfUnavailable
+
+	// AutoInstall installs missing gcloud components and the
+	// with_emulators command before running the tests, and fails if
+	// anything is still missing afterwards.
+	AutoInstall
+)
+
+func (p Policy) String() string {
+	switch p {
+	case FailIfUnavailable:
+		return "fail"
+	case SkipIfUnavailable:
+		return "skip"
+	case AutoInstall:
+		return "install"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Options configures Main.
+type Options struct {
+	// Config is the path of the with_emulators configuration file,
+	// relative to the package directory. Optional.
+	Config string
+
+	// Unavailable is the policy applied when prerequisites are missing.
+	Unavailable Policy
+
+	// Backend is how with_emulators runs the emulators, as its -backend
+	// flag: "local" (the default), with gcloud; "docker" or "podman", in
+	// containers; "java", from their standalone distributions; or
+	// "remote", using emulators already running elsewhere. It decides
+	// which prerequisites must be installed.
+	Backend string
+
+	// Args are more with_emulators flags, e.g. "-datastore-emulator=firestore".
+	Args []string
+
+	// Command is the with_emulators binary. Defaults to "with_emulators",
+	// looked up in PATH.
+	Command string
+
+	// Logger receives Main's own messages, such as why tests are skipped.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// OnReady, if set, is called in the test binary run under
+	// with_emulators, before any test runs, e.g. to seed data or register
+	// metrics. If it returns an error, no tests run and the binary fails.
+	OnReady func(md *Metadata) error
+
+	// OnChildStart, if set, is called in the process that called Main
+	// with the PID of the test binary once with_emulators starts it.
+	// Not supported on Windows.
+	OnChildStart func(pid int)
+
+	// OnEmulatorExit, if set, is called in the process that called Main
+	// when an emulator exits while the tests run, with the emulator's
+	// name and why it exited. Not supported on Windows.
+	OnEmulatorExit func(name string, err error)
+
+	// Output, if set, receives the emulators' output in the process that
+	// called Main, whether or not -v copies it to stderr, each line
+	// tagged with the emulator's name, e.g. "[pubsub] Server started".
+	// Not supported on Windows.
+	Output io.Writer
+}
+
+// Main runs the tests under with_emulators and exits with their exit code.
+// If the test binary is already running under with_emulators, Main runs the
+// tests directly.
+func Main(m *testing.M, opts Options) {
+	if opts.Command == "" {
+		opts.Command = "with_emulators"
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	fail := func(err error) {
+		opts.Logger.Error("emulatortest: " + err.Error())
+		os.Exit(1)
+	}
+	if os.Getenv(envMarker) != "" {
+		if opts.OnReady != nil {
+			md, err := ReadMetadata()
+			if err == nil {
+				err = opts.OnReady(md)
+			}
+			if err != nil {
+				fail(fmt.Errorf("OnReady: %v", err))
+			}
+		}
+		os.Exit(m.Run())
+	}
+
+	if err := BackendAvailable(opts.Command, opts.Backend); err != nil {
+		switch opts.Unavailable {
+		case SkipIfUnavailable:
+			opts.Logger.Warn("emulatortest: skipping tests", "err", err)
+			os.Exit(0)
+		case AutoInstall:
+			if err := install(opts); err != nil {
+				fail(err)
+			}
+			if err := BackendAvailable(opts.Command, opts.Backend); err != nil {
+				fail(err)
+			}
+		default:
+			fail(err)
+		}
+	}
+
+	var args []string
+	if opts.Config != "" {
+		args = append(args, "-config", opts.Config)
+	}
+	if opts.Backend != "" {
+		args = append(args, "-backend", opts.Backend)
+	}
+	args = append(args, opts.Args...)
+	code, err := runTests(opts, append(args, os.Args...))
+	if err != nil {
+		fail(err)
+	}
+	os.Exit(code)
+}
+
+// runTests runs opts.Command with args, which end with the test binary's
+// command line, passing it pipes for opts' callbacks and Output. It returns
+// the command's exit code.
+func runTests(opts Options, args []string) (int, error) {
+	// The pipes' write ends are passed as cmd.ExtraFiles, so are file
+	// descriptors 3 and up in with_emulators.
+	var flags []string
+	var readers, writers []*os.File
+	var copiers []func(r *os.File)
+	pipe := func(flag string, copy func(r *os.File)) error {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		flags = append(flags, fmt.Sprintf("%s=%d", flag, 3+len(writers)))
+		readers, writers, copiers = append(readers, r), append(writers, w), append(copiers, copy)
+		return nil
+	}
+	closeAll := func(files []*os.File) {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	if runtime.GOOS == "windows" && (opts.OnChildStart != nil || opts.OnEmulatorExit != nil || opts.Output != nil) {
+		return 0, fmt.Errorf("OnChildStart, OnEmulatorExit and Output are not supported on Windows")
+	}
+	if opts.OnChildStart != nil || opts.OnEmulatorExit != nil {
+		flags = append(flags, "-events=json")
+		if err := pipe("-events-fd", func(r *os.File) { watchEvents(r, opts) }); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Output != nil {
+		err := pipe("-output-fd", func(r *os.File) {
+			defer r.Close()
+			io.Copy(opts.Output, r)
+		})
+		if err != nil {
+			closeAll(readers)
+			closeAll(writers)
+			return 0, err
+		}
+	}
+
+	cmd := exec.Command(opts.Command, append(flags, args...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = writers
+	err := cmd.Start()
+	closeAll(writers)
+	if err != nil {
+		closeAll(readers)
+		return 0, err
+	}
+	var wg sync.WaitGroup
+	for i, r := range readers {
+		wg.Add(1)
+		go func(copy func(*os.File), r *os.File) {
+			defer wg.Done()
+			copy(r)
+		}(copiers[i], r)
+	}
+	err = cmd.Wait()
+	wg.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// Lifecycle events of with_emulators' -events stream. They must match the
+// constants of the same names in the with_emulators command.
+const (
+	eventCommandStarted = "command-started"
+	eventCrashed        = "crashed"
+)
+
+// watchEvents reads with_emulators' -events stream from r, calling opts'
+// callbacks, until r is closed.
+func watchEvents(r io.ReadCloser, opts Options) {
+	defer r.Close()
+	dec := json.NewDecoder(r)
+	for {
+		var ev struct {
+			Event    string `json:"event"`
+			Emulator string `json:"emulator"`
+			PID      int    `json:"pid"`
+			Message  string `json:"message"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			return
+		}
+		switch {
+		case ev.Event == eventCommandStarted && opts.OnChildStart != nil:
+			opts.OnChildStart(ev.PID)
+		case ev.Event == eventCrashed && opts.OnEmulatorExit != nil:
+			opts.OnEmulatorExit(ev.Emulator, errors.New(ev.Message))
+		}
+	}
+}
+
+// Available reports whether with_emulators (named by command) and the
+// programs it needs to run the emulators with gcloud are installed.
+func Available(command string) error {
+	return BackendAvailable(command, "local")
+}
+
+// BackendAvailable reports whether with_emulators (named by command) and
+// the programs it needs to run the emulators with backend, as in
+// Options.Backend, are installed.
+func BackendAvailable(command, backend string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("%s not found: %v", command, err)
+	}
+	var need []string
+	switch backend {
+	case "", "local":
+		need = []string{"gcloud", "java"}
+	case "docker":
+		// with_emulators falls back to podman if only it is installed.
+		if _, err := exec.LookPath("podman"); err == nil {
+			return nil
+		}
+		need = []string{"docker"}
+	case "podman":
+		need = []string{"podman"}
+	case "java":
+		need = []string{"java"}
+	case "remote":
+	default:
+		return fmt.Errorf("unknown backend %q", backend)
+	}
+	for _, name := range need {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("%s not found: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// install installs the with_emulators command and, for the local backend,
+// the gcloud components of the emulators it runs. The other backends'
+// prerequisites, such as Docker or Java, are left to the user.
+func install(opts Options) error {
+	if _, err := exec.LookPath("with_emulators"); err != nil {
+		if err := run("go", "install", "github.com/broady/with_emulators@latest"); err != nil {
+			return err
+		}
+	}
+	if opts.Backend != "" && opts.Backend != "local" {
+		return nil
+	}
+	if _, err := exec.LookPath("gcloud"); err != nil {
+		return fmt.Errorf("gcloud not found, install the Google Cloud SDK: %v", err)
+	}
+	return run("gcloud", "-q", "components", "install", "pubsub-emulator", datastoreComponent(opts.Args))
+}
+
+// datastoreComponent returns the gcloud component of the Datastore
+// emulator that with_emulators runs given args.
+func datastoreComponent(args []string) string {
+	for i, arg := range args {
+		if arg == "-datastore-emulator=firestore" || arg == "--datastore-emulator=firestore" ||
+			(arg == "-datastore-emulator" || arg == "--datastore-emulator") && i+1 < len(args) && args[i+1] == "firestore" {
+			return "cloud-firestore-emulator"
+		}
+	}
+	return "cloud-datastore-emulator"
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// envMetadata must match the constant of the same name in the with_emulators command.
+const envMetadata = "WITH_EMULATORS_METADATA"
+
+// Metadata describes the emulators the tests are running against.
+type Metadata struct {
+	Emulators []EmulatorMetadata `json:"emulators"`
+
+	// Projects maps the logical project names from the configuration's
+	// "projects" field to project IDs.
+	Projects map[string]string `json:"projects"`
+}
+
+// EmulatorMetadata describes a single emulator.
+type EmulatorMetadata struct {
+	Name            string        `json:"name"`            // e.g. "datastore"
+	Component       string        `json:"component"`       // gcloud component ID
+	Version         string        `json:"version"`         // gcloud component version, if known
+	Endpoint        string        `json:"endpoint"`        // host:port
+	StartupDuration time.Duration `json:"startupDuration"` // time from start until ready
+}
+
+// Emulator returns the metadata for the named emulator, or nil.
+func (md *Metadata) Emulator(name string) *EmulatorMetadata {
+	for i := range md.Emulators {
+		if md.Emulators[i].Name == name {
+			return &md.Emulators[i]
+		}
+	}
+	return nil
+}
+
+// Project returns the ID of the named project from the configuration's
+// "projects" field, or "" if there is no such project.
+func (md *Metadata) Project(name string) string {
+	return md.Projects[name]
+}
+
+// ReadMetadata returns the metadata written by with_emulators.
+// It returns an error if the tests are not running under with_emulators.
+func ReadMetadata() (*Metadata, error) {
+	path := os.Getenv(envMetadata)
+	if path == "" {
+		return nil, fmt.Errorf("%s not set; not running under with_emulators", envMetadata)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	md := &Metadata{}
+	if err := json.Unmarshal(b, md); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return md, nil
+}
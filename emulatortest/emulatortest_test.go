@@ -0,0 +1,146 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package emulatortest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// fakeCommand writes a shell script standing in for with_emulators, which
+// runs script with $EVENTS and $OUTPUT set to its -events-fd and
+// -output-fd, and returns its path.
+func fakeCommand(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	dir, err := ioutil.TempDir("", "emulatortest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "with_emulators")
+	sh := `#!/bin/sh
+for a; do
+	case "$a" in
+	-events-fd=*) EVENTS=${a#-events-fd=} ;;
+	-output-fd=*) OUTPUT=${a#-output-fd=} ;;
+	esac
+done
+` + script
+	if err := ioutil.WriteFile(path, []byte(sh), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOutput(t *testing.T) {
+	cmd := fakeCommand(t, `
+eval "echo '[pubsub] Server started, listening on 8085' >&$OUTPUT"
+eval "echo '[datastore] Dev App Server is now running.' >&$OUTPUT"
+exit 3
+`)
+	var out bytes.Buffer
+	code, err := runTests(Options{Command: cmd, Output: &out}, []string{"pkg.test", "-test.v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Errorf("exit code %d, want 3", code)
+	}
+	want := "[pubsub] Server started, listening on 8085\n[datastore] Dev App Server is now running.\n"
+	if out.String() != want {
+		t.Errorf("Output got %q, want %q", out.String(), want)
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	cmd := fakeCommand(t, `
+eval "echo '{\"event\":\"starting\",\"emulator\":\"pubsub\",\"pid\":41}' >&$EVENTS"
+eval "echo '{\"event\":\"command-started\",\"pid\":42}' >&$EVENTS"
+eval "echo '{\"event\":\"crashed\",\"emulator\":\"pubsub\",\"message\":\"exit status 1\"}' >&$EVENTS"
+exit 1
+`)
+	var started []int
+	var exited []string
+	opts := Options{
+		Command:      cmd,
+		OnChildStart: func(pid int) { started = append(started, pid) },
+		OnEmulatorExit: func(name string, err error) {
+			exited = append(exited, name+": "+err.Error())
+		},
+	}
+	code, err := runTests(opts, []string{"pkg.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if len(started) != 1 || started[0] != 42 {
+		t.Errorf("OnChildStart got %v, want [42]", started)
+	}
+	if len(exited) != 1 || exited[0] != "pubsub: exit status 1" {
+		t.Errorf("OnEmulatorExit got %q, want [pubsub: exit status 1]", exited)
+	}
+}
+
+func TestBackendAvailable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs executable files without extensions")
+	}
+	dir, err := ioutil.TempDir("", "emulatortest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"with_emulators", "docker"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	for _, c := range []struct {
+		backend string
+		ok      bool
+	}{
+		{"", false}, // needs gcloud and java
+		{"local", false},
+		{"docker", true},
+		{"podman", false},
+		{"java", false},
+		{"remote", true},
+		{"kubernetes", false},
+	} {
+		if err := BackendAvailable("with_emulators", c.backend); (err == nil) != c.ok {
+			t.Errorf("BackendAvailable(%q) = %v, want ok %v", c.backend, err, c.ok)
+		}
+	}
+	if err := BackendAvailable("missing_with_emulators", "remote"); err == nil {
+		t.Errorf("BackendAvailable with no with_emulators succeeded")
+	}
+}
+
+func TestDatastoreComponent(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "cloud-datastore-emulator"},
+		{[]string{"-datastore-emulator=datastore"}, "cloud-datastore-emulator"},
+		{[]string{"-v", "-datastore-emulator=firestore"}, "cloud-firestore-emulator"},
+		{[]string{"--datastore-emulator", "firestore"}, "cloud-firestore-emulator"},
+	} {
+		if got := datastoreComponent(c.args); got != c.want {
+			t.Errorf("datastoreComponent(%q) = %s, want %s", c.args, got, c.want)
+		}
+	}
+}
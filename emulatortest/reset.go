@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package emulatortest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Reset deletes all data in the emulators without restarting them, for
+// hermetic tests: Datastore entities, and Pub/Sub messages. Pub/Sub topics
+// and subscriptions are deleted and recreated empty.
+//
+//	func TestFoo(t *testing.T) {
+//		if err := emulatortest.Reset(ctx); err != nil {
+//			t.Fatal(err)
+//		}
+//		...
+//	}
+//
+// Projects other than the default one are reset if they are listed in
+// the configuration's "projects" field.
+func Reset(ctx context.Context) error {
+	md, err := ReadMetadata()
+	if err != nil {
+		return err
+	}
+	var projects []string
+	for _, p := range []string{os.Getenv("GOOGLE_CLOUD_PROJECT"), os.Getenv("DATASTORE_PROJECT_ID")} {
+		if p != "" {
+			projects = append(projects, p)
+			break
+		}
+	}
+	for _, p := range md.Projects {
+		projects = append(projects, p)
+	}
+	if ds := md.Emulator("datastore"); ds != nil {
+		if err := resetDatastore(ctx, ds, projects); err != nil {
+			return fmt.Errorf("reset datastore: %v", err)
+		}
+	}
+	if ps := md.Emulator("pubsub"); ps != nil {
+		for _, p := range projects {
+			if err := resetPubsub(ctx, ps.Endpoint, p); err != nil {
+				return fmt.Errorf("reset pubsub: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func resetDatastore(ctx context.Context, ds *EmulatorMetadata, projects []string) error {
+	if ds.Component != "cloud-firestore-emulator" {
+		return call(ctx, "POST", "http://"+ds.Endpoint+"/reset", nil, nil)
+	}
+	for _, p := range projects {
+		if err := call(ctx, "DELETE", "http://"+ds.Endpoint+"/emulator/v1/projects/"+p+"/databases/(default)/documents", nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type subscription struct {
+	Name               string `json:"name"`
+	Topic              string `json:"topic"`
+	AckDeadlineSeconds int    `json:"ackDeadlineSeconds,omitempty"`
+}
+
+// resetPubsub deletes and recreates the topics and subscriptions of
+// project. Unlike with_emulators, it doesn't follow page tokens; test
+// projects are small.
+func resetPubsub(ctx context.Context, host, project string) error {
+	base := "http://" + host + "/v1/projects/" + project
+	var topics struct {
+		Topics []struct{ Name string } `json:"topics"`
+	}
+	if err := call(ctx, "GET", base+"/topics?pageSize=1000", nil, &topics); err != nil {
+		return err
+	}
+	var subs struct {
+		Subscriptions []subscription `json:"subscriptions"`
+	}
+	if err := call(ctx, "GET", base+"/subscriptions?pageSize=1000", nil, &subs); err != nil {
+		return err
+	}
+	for _, s := range subs.Subscriptions {
+		if err := call(ctx, "DELETE", "http://"+host+"/v1/"+s.Name, nil, nil); err != nil {
+			return err
+		}
+	}
+	for _, t := range topics.Topics {
+		if err := call(ctx, "DELETE", "http://"+host+"/v1/"+t.Name, nil, nil); err != nil {
+			return err
+		}
+	}
+	for _, t := range topics.Topics {
+		if err := call(ctx, "PUT", "http://"+host+"/v1/"+t.Name, struct{}{}, nil); err != nil {
+			return err
+		}
+	}
+	for _, s := range subs.Subscriptions {
+		if path.Base(s.Topic) == "_deleted-topic_" {
+			continue
+		}
+		if err := call(ctx, "PUT", "http://"+host+"/v1/"+s.Name, s, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call makes a JSON request to an emulator.
+func call(ctx context.Context, method, url string, body, result interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %s", method, url, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package tcemulator runs the emulators that with_emulators manages as
+// testcontainers-go containers, for test suites whose fixtures are built on
+// testcontainers:
+//
+//	c, err := tcemulator.Run(ctx, tcemulator.DefaultImage, tcemulator.PubSub, "my-project")
+//	testcontainers.CleanupContainer(t, c)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	c.Setenv(t) // sets PUBSUB_EMULATOR_HOST for the test
+//
+// Container embeds testcontainers.Container, so it works with the rest of
+// testcontainers, and Run accepts the usual customizers, such as
+// testcontainers.WithEnv.
+package tcemulator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// DefaultImage is the Cloud SDK image that includes the emulators, as
+// used by "with_emulators -backend=docker".
+const DefaultImage = "gcr.io/google.com/cloudsdktool/cloud-sdk:emulators"
+
+// StartupTimeout bounds how long Run waits for an emulator to be ready.
+const StartupTimeout = 2 * time.Minute
+
+// Emulator describes how to run an emulator in a container.
+type Emulator struct {
+	Name          string
+	Command       []string // run in the image, followed by --host-port and --project
+	Port          string   // port the emulator listens on in the container, e.g. "8085/tcp"
+	ReadySentinel string   // printed once the emulator is ready
+	HostEnv       string   // variable pointing clients at the emulator
+	ProjectEnv    string   // variable naming the project, if any
+}
+
+// The emulators that with_emulators starts.
+var (
+	Datastore = Emulator{
+		Name:          "datastore",
+		Command:       []string{"gcloud", "-q", "emulators", "datastore", "start"},
+		Port:          "8081/tcp",
+		ReadySentinel: "is now running",
+		HostEnv:       "DATASTORE_EMULATOR_HOST",
+		ProjectEnv:    "DATASTORE_PROJECT_ID",
+	}
+	PubSub = Emulator{
+		Name:          "pubsub",
+		Command:       []string{"gcloud", "-q", "emulators", "pubsub", "start"},
+		Port:          "8085/tcp",
+		ReadySentinel: "Server started, listening",
+		HostEnv:       "PUBSUB_EMULATOR_HOST",
+	}
+)
+
+// Container is a running emulator.
+type Container struct {
+	testcontainers.Container
+
+	Emulator Emulator
+	Project  string
+}
+
+// Run starts emulator e for project in a container of image, customized by
+// opts, and waits for it to be ready. Like testcontainers.GenericContainer,
+// it may return a container along with an error, which must still be
+// terminated.
+func Run(ctx context.Context, image string, e Emulator, project string, opts ...testcontainers.ContainerCustomizer) (*Container, error) {
+	port := strings.TrimSuffix(e.Port, "/tcp")
+	cmd := append(e.Command[:len(e.Command):len(e.Command)], "--host-port=0.0.0.0:"+port)
+	if project != "" {
+		cmd = append(cmd, "--project="+project)
+	}
+	req := testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        image,
+			Cmd:          cmd,
+			ExposedPorts: []string{e.Port},
+			WaitingFor:   wait.ForLog(e.ReadySentinel).WithStartupTimeout(StartupTimeout),
+		},
+		Started: true,
+	}
+	for _, opt := range opts {
+		if err := opt.Customize(&req); err != nil {
+			return nil, fmt.Errorf("tcemulator: %s: %v", e.Name, err)
+		}
+	}
+	tc, err := testcontainers.GenericContainer(ctx, req)
+	var c *Container
+	if tc != nil {
+		c = &Container{Container: tc, Emulator: e, Project: project}
+	}
+	if err != nil {
+		return c, fmt.Errorf("tcemulator: %s: %v", e.Name, err)
+	}
+	return c, nil
+}
+
+// HostPort returns the address that clients reach the emulator at.
+func (c *Container) HostPort(ctx context.Context) (string, error) {
+	host, err := c.Host(ctx)
+	if err != nil {
+		return "", err
+	}
+	port, err := c.MappedPort(ctx, nat.Port(c.Emulator.Port))
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port.Port()), nil
+}
+
+// Env returns the variables that point clients at the emulator, e.g.
+// "PUBSUB_EMULATOR_HOST=localhost:32768".
+func (c *Container) Env(ctx context.Context) ([]string, error) {
+	hostPort, err := c.HostPort(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{c.Emulator.HostEnv + "=" + hostPort}
+	if c.Emulator.ProjectEnv != "" && c.Project != "" {
+		env = append(env, c.Emulator.ProjectEnv+"="+c.Project)
+	}
+	return env, nil
+}
+
+// Setenv sets the variables returned by Env for the rest of the test.
+func (c *Container) Setenv(t testing.TB) {
+	t.Helper()
+	env, err := c.Env(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		t.Setenv(kv[:i], kv[i+1:])
+	}
+}
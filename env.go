@@ -0,0 +1,148 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envFormats are the formats accepted by writeEnv.
+var envFormats = []string{"shell", "dotenv", "json", "github"}
+
+// writeEnv writes env, a list of KEY=VALUE pairs, in the given format:
+// shell export statements, a dotenv file, a JSON object, or the format of
+// GitHub Actions' $GITHUB_ENV file.
+func writeEnv(w io.Writer, env []string, format string) error {
+	switch format {
+	case "shell":
+		for _, kv := range env {
+			k, v := splitEnv(kv)
+			fmt.Fprintf(w, "export %s=%s\n", k, shellQuote(v))
+		}
+	case "dotenv":
+		for _, kv := range env {
+			k, v := splitEnv(kv)
+			if strings.ContainsAny(v, " \t\n\"'#$\\") {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(w, "%s=%s\n", k, v)
+		}
+	case "json":
+		m := make(map[string]string)
+		for _, kv := range env {
+			k, v := splitEnv(kv)
+			m[k] = v
+		}
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", b)
+	case "github":
+		for _, kv := range env {
+			k, v := splitEnv(kv)
+			if strings.Contains(v, "\n") {
+				fmt.Fprintf(w, "%s<<%s\n%s\n%[2]s\n", k, githubEnvDelimiter, v)
+				continue
+			}
+			fmt.Fprintf(w, "%s=%s\n", k, v)
+		}
+	default:
+		return fmt.Errorf("invalid format %q, want %s", format, strings.Join(envFormats, ", "))
+	}
+	return nil
+}
+
+// writeEnvFile writes env to path in dotenv format.
+func writeEnvFile(path string, env []string) error {
+	var buf bytes.Buffer
+	writeEnv(&buf, env, "dotenv")
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// githubEnvDelimiter delimits multiline values in $GITHUB_ENV.
+const githubEnvDelimiter = "WITH_EMULATORS_EOF"
+
+// appendGitHubEnv appends env to the file named by $GITHUB_ENV, exporting it
+// to the later steps of a GitHub Actions job.
+func appendGitHubEnv(env []string) error {
+	path := os.Getenv("GITHUB_ENV")
+	if path == "" {
+		return fmt.Errorf("GITHUB_ENV not set; not running in GitHub Actions")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	writeEnv(f, env, "github")
+	return f.Close()
+}
+
+func splitEnv(kv string) (key, value string) {
+	if i := strings.Index(kv, "="); i >= 0 {
+		return kv[:i], kv[i+1:]
+	}
+	return kv, ""
+}
+
+// shellQuote quotes s for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.,:/@%+=") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// inheritedEnv returns the variables of with_emulators' environment that the
+// command inherits: all of them, or with -env-clear or -env-whitelist, only
+// those allowed by -env-whitelist.
+func inheritedEnv() []string {
+	env := os.Environ()
+	if !*envClear && *envWhitelist == "" {
+		return env
+	}
+	return allowEnv(env, strings.Split(*envWhitelist, ","))
+}
+
+// allowEnv returns the variables in env named in allowed, where a trailing *
+// matches any suffix, as in GO*.
+func allowEnv(env, allowed []string) []string {
+	var out []string
+	for _, kv := range env {
+		k, _ := splitEnv(kv)
+		for _, a := range allowed {
+			a = strings.TrimSpace(a)
+			if a == k || (strings.HasSuffix(a, "*") && strings.HasPrefix(k, a[:len(a)-1])) {
+				out = append(out, kv)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// aliasEnv returns env with each variable also exported under the names
+// that aliases maps its name to, each right after it.
+func aliasEnv(env []string, aliases map[string][]string) []string {
+	if len(aliases) == 0 {
+		return env
+	}
+	var out []string
+	for _, kv := range env {
+		out = append(out, kv)
+		k, v := splitEnv(kv)
+		for _, alias := range aliases[k] {
+			out = append(out, alias+"="+v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriteEnv(t *testing.T) {
+	env := []string{"DATASTORE_EMULATOR_HOST=localhost:8081", "MSG=it's here"}
+	for _, tt := range []struct {
+		format, want string
+	}{
+		{"shell", "export DATASTORE_EMULATOR_HOST=localhost:8081\nexport MSG='it'\\''s here'\n"},
+		{"dotenv", "DATASTORE_EMULATOR_HOST=localhost:8081\nMSG=\"it's here\"\n"},
+		{"github", "DATASTORE_EMULATOR_HOST=localhost:8081\nMSG=it's here\n"},
+		{"json", "{\n  \"DATASTORE_EMULATOR_HOST\": \"localhost:8081\",\n  \"MSG\": \"it's here\"\n}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := writeEnv(&buf, env, tt.format); err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.format, buf.String(), tt.want)
+		}
+	}
+	if err := writeEnv(&bytes.Buffer{}, env, "xml"); err == nil {
+		t.Error("xml: got nil error")
+	}
+}
+
+func TestAllowEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "HOME=/root", "GOPATH=/go", "GOFLAGS=-v", "GO=x", "AGOB=1", "SECRET=s"}
+	got := allowEnv(env, []string{"PATH", " GO*", "HOM"})
+	want := []string{"PATH=/bin", "GOPATH=/go", "GOFLAGS=-v", "GO=x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("allowEnv = %q, want %q", got, want)
+	}
+	if got := allowEnv(env, []string{""}); got != nil {
+		t.Errorf("allowEnv with nothing allowed = %q, want none", got)
+	}
+}
+
+func TestAliasEnv(t *testing.T) {
+	env := []string{"PUBSUB_EMULATOR_HOST=localhost:8085", "DATASTORE_EMULATOR_HOST=localhost:8081"}
+	aliases := map[string][]string{"PUBSUB_EMULATOR_HOST": {"MYAPP_PUBSUB_ADDR", "PUBSUB_ADDR"}}
+	want := []string{"PUBSUB_EMULATOR_HOST=localhost:8085", "MYAPP_PUBSUB_ADDR=localhost:8085", "PUBSUB_ADDR=localhost:8085", "DATASTORE_EMULATOR_HOST=localhost:8081"}
+	if got := aliasEnv(env, aliases); !reflect.DeepEqual(got, want) {
+		t.Errorf("aliasEnv = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lifecycle events written to the -events stream, in addition to those
+// sent to notification hooks. emulatortest.Main reads the stream for its
+// callbacks.
+const (
+	EventStarting       = "starting"        // an emulator process started
+	EventReady          = "ready"           // an emulator is ready
+	EventCommandStarted = "command-started" // the wrapped command started
+	EventCommandExited  = "command-exited"  // the wrapped command exited
+	EventRestarted      = "restarted"       // an emulator was restarted, by -supervise or "with_emulators restart"
+)
+
+// StreamEvent is a lifecycle event, written as a line of JSON to the
+// -events stream.
+type StreamEvent struct {
+	Event    string    `json:"event"`
+	Emulator string    `json:"emulator,omitempty"`
+	PID      int       `json:"pid,omitempty"`
+	Endpoint string    `json:"endpoint,omitempty"` // for ready
+	ExitCode *int      `json:"exitCode,omitempty"` // for command-exited
+	Message  string    `json:"message,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+var events struct {
+	sync.Mutex
+	w io.Writer // nil unless -events=json
+}
+
+// openEvents sets up the -events stream.
+func openEvents() error {
+	switch *eventsFormat {
+	case "off":
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("invalid -events %q, want off or json", *eventsFormat)
+	}
+	switch *eventsFD {
+	case 1:
+		events.w = os.Stdout
+	case 2:
+		events.w = os.Stderr
+	default:
+		f := os.NewFile(uintptr(*eventsFD), "events")
+		if f == nil {
+			return fmt.Errorf("invalid -events-fd %d", *eventsFD)
+		}
+		events.w = f
+	}
+	return nil
+}
+
+// emit writes ev to the -events stream, if any.
+func emit(ev StreamEvent) {
+	events.Lock()
+	defer events.Unlock()
+	if events.w == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	events.w.Write(append(b, '\n'))
+}
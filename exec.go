@@ -0,0 +1,197 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// execCommand replaces with_emulators with the command in args, leaving
+// behind a reaper process that stops the emulators once the command exits.
+// It only returns on error.
+//
+// The reaper notices the command exiting through a pipe: the command
+// inherits the write end, and the reaper sees EOF on the read end once
+// every copy of the write end has been closed.
+// The reaper also removes the files in rm.
+// If dir is set, the command runs there; like exec.Cmd.Dir, a relative
+// command path is evaluated relative to it.
+func execCommand(args, env []string, dir string, emulators []*Emulator, rm ...string) error {
+	name := args[0]
+	if dir != "" && strings.ContainsRune(name, filepath.Separator) && !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return err
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pw.Close()
+
+	reapArgs := []string{"reap", "-timeout", stopTimeout.String()}
+	for _, f := range rm {
+		reapArgs = append(reapArgs, "-rm", f)
+	}
+	if verbose.any() && *configPath != "" {
+		// For the config's logFilter.
+		reapArgs = append(reapArgs, "-config", *configPath)
+	}
+	if verbose.any() {
+		reapArgs = append(reapArgs, "-v="+verbose.String(), "-timestamps", *timestamps, "-since", strconv.FormatInt(startTime.UnixNano(), 10))
+	}
+	for _, e := range emulators {
+		reapArgs = append(reapArgs, "-name", e.Name)
+	}
+	if *logDir != "" {
+		reapArgs = append(reapArgs, "-log-dir", *logDir, "-log-max-size", strconv.FormatInt(*logMaxSize<<20, 10))
+	}
+	files := []*os.File{pr}
+	for _, e := range emulators {
+		reapArgs = append(reapArgs, strconv.Itoa(e.group.pgid))
+		files = append(files, e.stderr)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	reaper := exec.Command(self, reapArgs...)
+	reaper.ExtraFiles = files
+	reaper.Stderr = os.Stderr
+	// Detach from the terminal, so that Ctrl-C only reaches the command.
+	reaper.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = reaper.Start()
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("starting reaper: %v", err)
+	}
+	reaper.Process.Release()
+
+	// os.Pipe sets close-on-exec; dup the write end so the command keeps it.
+	if _, err := syscall.Dup(int(pw.Fd())); err != nil {
+		return err
+	}
+	if dir != "" {
+		// Only now, so that the reaper resolves relative paths as given.
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+	}
+	signal.Reset()
+	return syscall.Exec(path, args, env)
+}
+
+// reapMain implements the hidden reap subcommand started by execCommand.
+// Its arguments are the emulators' process group IDs. File descriptor 3 is
+// the pipe that is closed when the command exits, followed by one
+// descriptor per emulator carrying its output.
+func reapMain(args []string) int {
+	fs := flag.NewFlagSet("reap", flag.ContinueOnError)
+	var rm, names stringsFlag
+	fs.Var(&rm, "rm", "File to remove after stopping the emulators (repeatable)")
+	fs.Var(&names, "name", "Name of each emulator, in order, to tag its output with (repeatable)")
+	var v verboseFlag
+	fs.Var(&v, "v", "Copy emulator output to stderr, for all or the named emulators")
+	config := fs.String("config", "", "Configuration file to read logFilter from")
+	stamps := fs.String("timestamps", "off", "Timestamp format for copied output: off, rfc3339 or relative")
+	since := fs.Int64("since", 0, "Origin of relative timestamps, in Unix nanoseconds")
+	logDir := fs.String("log-dir", "", "Directory to append each emulator's output to, as NAME.log")
+	logMaxSize := fs.Int64("log-max-size", 0, "Size in bytes at which -log-dir files are rotated")
+	timeout := fs.Duration("timeout", 0, "How long to wait for the emulators to stop before killing them")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	signal.Ignore(syscall.SIGINT, syscall.SIGHUP)
+
+	var filters map[string]*LogFilter
+	if *config != "" {
+		cfg, err := LoadConfig(*config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reap: %v\n", err)
+		} else {
+			filters = cfg.LogFilter
+		}
+	}
+	// Keep draining emulator output, so that the emulators don't block
+	// or die writing to it.
+	var wg sync.WaitGroup
+	for i := range fs.Args() {
+		f := os.NewFile(uintptr(4+i), "emulator output")
+		var out io.Writer = ioutil.Discard
+		if i < len(names) && v.of(names[i]) {
+			p := newPrefixWriter(os.Stderr, names[i], useColor(os.Stderr))
+			p.timestamps(*stamps, time.Unix(0, *since))
+			p.filter = filters[names[i]]
+			defer p.Flush()
+			out = p
+		} else if i >= len(names) && v.all {
+			out = os.Stderr
+		}
+		if *logDir != "" && i < len(names) {
+			if r, err := openRotatingFile(filepath.Join(*logDir, names[i]+".log"), *logMaxSize); err == nil {
+				defer r.Close()
+				out = io.MultiWriter(out, r)
+			} else {
+				fmt.Fprintf(os.Stderr, "reap: %v\n", err)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(out, f)
+		}()
+	}
+
+	session := os.NewFile(3, "session")
+	io.Copy(ioutil.Discard, session)
+
+	var groups []*procGroup
+	for _, arg := range fs.Args() {
+		pgid, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reap: invalid process group %q\n", arg)
+			continue
+		}
+		g := &procGroup{pgid: pgid}
+		if err := g.terminate(); err != nil {
+			fmt.Fprintf(os.Stderr, "reap: stopping process group %d: %v\n", pgid, err)
+		}
+		groups = append(groups, g)
+	}
+	// The emulators aren't our children, so poll for their groups to go away.
+	deadline := time.Now().Add(*timeout)
+	for _, g := range groups {
+		for syscall.Kill(-g.pgid, 0) == nil {
+			if *timeout > 0 && time.Now().After(deadline) {
+				fmt.Fprintf(os.Stderr, "reap: process group %d did not exit within %v, killing\n", g.pgid, *timeout)
+				g.kill()
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	for _, f := range rm {
+		os.RemoveAll(f)
+	}
+	return 0
+}
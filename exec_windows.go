@@ -0,0 +1,21 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// execCommand is not supported on Windows, which has no exec(2).
+func execCommand(args, env []string, dir string, emulators []*Emulator, rm ...string) error {
+	return errors.New("-exec is not supported on Windows")
+}
+
+func reapMain(args []string) int {
+	fmt.Fprintln(os.Stderr, "reap is not supported on Windows")
+	return 2
+}
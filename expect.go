@@ -0,0 +1,99 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expectation asserts how many calls the command makes to an emulator
+// method, e.g. "datastore:Commit>=1" or "pubsub:Publish==0".
+// The method "*" counts all calls to the emulator.
+// Method names are as reported by the proxy; see callName.
+type Expectation struct {
+	Emulator string
+	Method   string
+	Op       string // one of ==, !=, >=, <=, >, <
+	N        int
+}
+
+func (x Expectation) String() string {
+	return fmt.Sprintf("%s:%s%s%d", x.Emulator, x.Method, x.Op, x.N)
+}
+
+// ParseExpectation parses an expectation of the form EMULATOR:METHOD OP N.
+func ParseExpectation(s string) (Expectation, error) {
+	var x Expectation
+	i := strings.Index(s, ":")
+	j := strings.IndexAny(s, "=!<>")
+	if i <= 0 || j < i+2 {
+		return x, fmt.Errorf("invalid expectation %q, want EMULATOR:METHOD>=N", s)
+	}
+	x.Emulator = s[:i]
+	x.Method = strings.TrimSpace(s[i+1 : j])
+	rest := s[j:]
+	for _, op := range []string{"==", "!=", ">=", "<=", "=", ">", "<"} {
+		if strings.HasPrefix(rest, op) {
+			x.Op = op
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if x.Op == "" {
+		return x, fmt.Errorf("invalid expectation %q: unknown operator", s)
+	}
+	if x.Op == "=" {
+		x.Op = "=="
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(rest))
+	if err != nil || n < 0 {
+		return x, fmt.Errorf("invalid expectation %q: count must be a non-negative integer", s)
+	}
+	x.N = n
+	return x, nil
+}
+
+// Check returns an error if calls, the proxy's call counts for
+// x.Emulator, do not meet the expectation.
+func (x Expectation) Check(calls map[string]int) error {
+	got := calls[x.Method]
+	if x.Method == "*" {
+		got = 0
+		for _, n := range calls {
+			got += n
+		}
+	}
+	var ok bool
+	switch x.Op {
+	case "==":
+		ok = got == x.N
+	case "!=":
+		ok = got != x.N
+	case ">=":
+		ok = got >= x.N
+	case "<=":
+		ok = got <= x.N
+	case ">":
+		ok = got > x.N
+	case "<":
+		ok = got < x.N
+	}
+	if !ok {
+		return fmt.Errorf("expected %v, got %d", x, got)
+	}
+	return nil
+}
+
+// stringsFlag is a flag.Value that collects repeated string flags.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ", ") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestExpectation(t *testing.T) {
+	calls := map[string]int{"Commit": 2, "Lookup": 1}
+	for _, tt := range []struct {
+		in     string
+		parses bool
+		passes bool
+	}{
+		{"datastore:Commit>=1", true, true},
+		{"datastore:Commit>2", true, false},
+		{"datastore:Commit=2", true, true},
+		{"datastore:Commit == 2", true, true},
+		{"pubsub:Publish==0", true, true},
+		{"pubsub:Publish!=0", true, false},
+		{"datastore:*<=3", true, true},
+		{"datastore:*<3", true, false},
+		{"datastore:Commit", false, false},
+		{"datastore:>=1", false, false},
+		{"Commit>=1", false, false},
+		{"datastore:Commit>=-1", false, false},
+		{"datastore:Commit~1", false, false},
+	} {
+		x, err := ParseExpectation(tt.in)
+		if (err == nil) != tt.parses {
+			t.Errorf("ParseExpectation(%q): err = %v, want parses = %v", tt.in, err, tt.parses)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if err := x.Check(calls); (err == nil) != tt.passes {
+			t.Errorf("%v.Check: err = %v, want passes = %v", x, err, tt.passes)
+		}
+	}
+}
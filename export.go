@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The Datastore emulator can export its entities to, and import them from,
+// a directory on the machine it runs on, in the format of Cloud Datastore
+// managed exports.
+
+// DatastoreExport exports the entities of project in the Datastore emulator
+// at host to dir, which must be an absolute path. It returns the path of
+// the export's overall_export_metadata file.
+func DatastoreExport(ctx context.Context, host, project, dir string) (string, error) {
+	var result struct {
+		Response struct {
+			OutputURL string `json:"outputUrl"`
+		} `json:"response"`
+	}
+	err := datastoreEmulatorCall(ctx, host, project, "export", map[string]string{"export_directory": dir}, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.Response.OutputURL != "" {
+		return result.Response.OutputURL, nil
+	}
+	return findExportMetadata(dir)
+}
+
+// DatastoreImport imports the export described by the overall_export_metadata
+// file at path into project in the Datastore emulator at host.
+func DatastoreImport(ctx context.Context, host, project, path string) error {
+	return datastoreEmulatorCall(ctx, host, project, "import", map[string]string{"input_url": path}, nil)
+}
+
+// importDatastore imports the -datastore-import export, if any, into the
+// Datastore emulator.
+func importDatastore(ctx context.Context, cfg *Config, env []string) error {
+	if *datastoreImport == "" {
+		return nil
+	}
+	path, err := filepath.Abs(*datastoreImport)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err != nil {
+		return err
+	} else if fi.IsDir() {
+		if path, err = findExportMetadata(path); err != nil {
+			return err
+		}
+	}
+	return DatastoreImport(ctx, lookupEnv(env, "DATASTORE_EMULATOR_HOST"), sessionProject(cfg, env), path)
+}
+
+// exportDatastore exports the Datastore emulator's entities to the
+// -datastore-export directory, if set.
+func exportDatastore(cfg *Config, env []string) error {
+	if *datastoreExport == "" {
+		return nil
+	}
+	dir, err := filepath.Abs(*datastoreExport)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	path, err := DatastoreExport(ctx, lookupEnv(env, "DATASTORE_EMULATOR_HOST"), sessionProject(cfg, env), dir)
+	if err != nil {
+		return err
+	}
+	slog.Info("Datastore exported", "path", path)
+	return nil
+}
+
+// findExportMetadata returns the overall_export_metadata file of the export
+// in dir.
+func findExportMetadata(dir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.overall_export_metadata"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("%s: want one .overall_export_metadata file, found %d", dir, len(matches))
+	}
+	return matches[0], nil
+}
+
+// datastoreEmulatorCall calls one of the emulator-only Datastore methods.
+func datastoreEmulatorCall(ctx context.Context, host, project, method string, body, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("http://%s/emulator/v1/projects/%s:%s", host, url.PathEscape(project), method)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: unexpected status %s: %s", method, resp.Status, bytes.TrimSpace(msg))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+// Fault is a failure injected by the proxy in front of an emulator,
+// configured in Config.Faults:
+//
+//	{"emulator": "datastore", "method": "Commit", "error": "UNAVAILABLE", "percent": 50}
+type Fault struct {
+	// Emulator is the emulator whose calls fail.
+	Emulator string `json:"emulator"`
+
+	// Method, if set, limits the fault to calls of this method, named as
+	// in expectations, e.g. "Commit" or "Publish".
+	Method string `json:"method"`
+
+	// Error is the gRPC status code name the calls fail with, e.g.
+	// "UNAVAILABLE" or "DEADLINE_EXCEEDED". REST calls fail with the
+	// corresponding HTTP status.
+	Error string `json:"error"`
+
+	// Drop, instead of failing calls with Error, drops their connections.
+	Drop bool `json:"drop"`
+
+	// Percent is the percentage of matching calls that fail. Defaults to
+	// 100.
+	Percent float64 `json:"percent"`
+
+	// Times, if set, limits the fault to the first Times matching calls,
+	// e.g. to check that a single retry succeeds.
+	Times int `json:"times"`
+
+	matched int // matching calls so far, guarded by the Proxy's mu
+}
+
+// grpcCodes maps gRPC status code names to their codes and the HTTP
+// statuses that Google REST APIs use for them.
+var grpcCodes = map[string]struct{ code, http int }{
+	"CANCELLED":           {1, 499},
+	"UNKNOWN":             {2, 500},
+	"INVALID_ARGUMENT":    {3, 400},
+	"DEADLINE_EXCEEDED":   {4, 504},
+	"NOT_FOUND":           {5, 404},
+	"ALREADY_EXISTS":      {6, 409},
+	"PERMISSION_DENIED":   {7, 403},
+	"RESOURCE_EXHAUSTED":  {8, 429},
+	"FAILED_PRECONDITION": {9, 400},
+	"ABORTED":             {10, 409},
+	"OUT_OF_RANGE":        {11, 400},
+	"UNIMPLEMENTED":       {12, 501},
+	"INTERNAL":            {13, 500},
+	"UNAVAILABLE":         {14, 503},
+	"DATA_LOSS":           {15, 500},
+	"UNAUTHENTICATED":     {16, 401},
+}
+
+func (f *Fault) validate() error {
+	if !contains(emulatorNames(), f.Emulator) {
+		return fmt.Errorf("unknown emulator %q", f.Emulator)
+	}
+	if _, ok := grpcCodes[f.Error]; !ok && !f.Drop {
+		return fmt.Errorf("%s: unknown error %q, want a gRPC status code name such as UNAVAILABLE", f.Emulator, f.Error)
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("%s: percent %v out of range", f.Emulator, f.Percent)
+	}
+	return nil
+}
+
+// applies reports whether the fault applies to call, counting it as a
+// match.
+func (f *Fault) applies(call string) bool {
+	if f.Method != "" && f.Method != call {
+		return false
+	}
+	if f.Times > 0 && f.matched >= f.Times {
+		return false
+	}
+	f.matched++
+	return f.Percent == 0 || rand.Float64()*100 < f.Percent
+}
+
+// inject fails the call r.
+func (f *Fault) inject(w http.ResponseWriter, r *http.Request) {
+	if f.Drop {
+		// Closes the connection, or resets the HTTP/2 stream.
+		panic(http.ErrAbortHandler)
+	}
+	c := grpcCodes[f.Error]
+	msg := "injected by with_emulators"
+	if isGRPC(r) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(c.code))
+		w.Header().Set("Grpc-Message", msg)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(c.http)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": c.http, "message": msg, "status": f.Error},
+	})
+}
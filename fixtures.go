@@ -0,0 +1,217 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Fixture is an entity loaded into the Datastore emulator before the
+// command runs. A fixtures file is a JSON array of them:
+//
+//	[
+//	  {"key": ["Shelf", "fiction", "Book", 1], "properties": {"title": "Dune", "pages": 412}},
+//	  {"namespace": "test", "key": ["Book", "b2"], "properties": {"tags": ["a", "b"]}}
+//	]
+//
+// Key is the entity's key path: alternating kinds and names (strings) or
+// IDs (integers). Property values are mapped to Datastore values by their
+// JSON type; objects become embedded entities.
+type Fixture struct {
+	Namespace  string                 `json:"namespace"`
+	Key        []interface{}          `json:"key"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// LoadFixtures reads a fixtures file.
+func LoadFixtures(path string) ([]Fixture, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber() // keep integer IDs and values exact
+	var fixtures []Fixture
+	if err := dec.Decode(&fixtures); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, f := range fixtures {
+		if _, err := f.datastoreKey(""); err != nil {
+			return nil, fmt.Errorf("%s: fixture %d: %v", path, i, err)
+		}
+	}
+	return fixtures, nil
+}
+
+// datastoreKey returns the Datastore REST representation of f's key.
+func (f Fixture) datastoreKey(project string) (map[string]interface{}, error) {
+	if len(f.Key) == 0 || len(f.Key)%2 != 0 {
+		return nil, fmt.Errorf("key %v: want pairs of kind and name or ID", f.Key)
+	}
+	var path []map[string]interface{}
+	for i := 0; i < len(f.Key); i += 2 {
+		kind, ok := f.Key[i].(string)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("key %v: kind %v is not a string", f.Key, f.Key[i])
+		}
+		elem := map[string]interface{}{"kind": kind}
+		switch v := f.Key[i+1].(type) {
+		case string:
+			elem["name"] = v
+		case json.Number:
+			if _, err := v.Int64(); err != nil {
+				return nil, fmt.Errorf("key %v: ID %v is not an integer", f.Key, v)
+			}
+			elem["id"] = v.String()
+		default:
+			return nil, fmt.Errorf("key %v: %v is not a name or ID", f.Key, v)
+		}
+		path = append(path, elem)
+	}
+	return map[string]interface{}{
+		"partitionId": map[string]string{"projectId": project, "namespaceId": f.Namespace},
+		"path":        path,
+	}, nil
+}
+
+// datastoreValue returns the Datastore REST representation of a property
+// value decoded from JSON.
+func datastoreValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case nil:
+		return map[string]interface{}{"nullValue": "NULL_VALUE"}
+	case bool:
+		return map[string]interface{}{"booleanValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return map[string]interface{}{"integerValue": v.String()}
+		}
+		f, _ := v.Float64()
+		return map[string]interface{}{"doubleValue": f}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case []interface{}:
+		values := []map[string]interface{}{}
+		for _, e := range v {
+			values = append(values, datastoreValue(e))
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case map[string]interface{}:
+		return map[string]interface{}{"entityValue": map[string]interface{}{"properties": datastoreProperties(v)}}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func datastoreProperties(props map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(props))
+	for name, v := range props {
+		m[name] = datastoreValue(v)
+	}
+	return m
+}
+
+// maxMutations is the most mutations Datastore accepts in one commit.
+const maxMutations = 500
+
+// SeedDatastore upserts fixtures into the Datastore emulator at host.
+func SeedDatastore(ctx context.Context, host, project string, fixtures []Fixture) error {
+	var mutations []map[string]interface{}
+	for _, f := range fixtures {
+		key, err := f.datastoreKey(project)
+		if err != nil {
+			return err
+		}
+		mutations = append(mutations, map[string]interface{}{
+			"upsert": map[string]interface{}{
+				"key":        key,
+				"properties": datastoreProperties(f.Properties),
+			},
+		})
+	}
+	for len(mutations) > 0 {
+		n := len(mutations)
+		if n > maxMutations {
+			n = maxMutations
+		}
+		if err := datastoreCommit(ctx, host, project, mutations[:n]); err != nil {
+			return err
+		}
+		mutations = mutations[n:]
+	}
+	return nil
+}
+
+func datastoreCommit(ctx context.Context, host, project string, mutations []map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"mode":      "NON_TRANSACTIONAL",
+		"mutations": mutations,
+	})
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("http://%s/v1/projects/%s:commit", host, url.PathEscape(project))
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("commit: unexpected status %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// seedFixtures loads the fixtures files listed in cfg.Fixtures and the
+// -fixtures flags into the Datastore emulator.
+func seedFixtures(ctx context.Context, cfg *Config, env []string) error {
+	paths := append(cfg.Fixtures[:len(cfg.Fixtures):len(cfg.Fixtures)], fixtureFlags...)
+	if len(paths) == 0 {
+		return nil
+	}
+	host := lookupEnv(env, "DATASTORE_EMULATOR_HOST")
+	if host == "" {
+		return fmt.Errorf("DATASTORE_EMULATOR_HOST not set")
+	}
+	project := sessionProject(cfg, env)
+	var kinds []string
+	n := 0
+	for _, path := range paths {
+		fixtures, err := LoadFixtures(path)
+		if err != nil {
+			return err
+		}
+		if err := SeedDatastore(ctx, host, project, fixtures); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, f := range fixtures {
+			if kind := f.Key[len(f.Key)-2].(string); !contains(kinds, kind) {
+				kinds = append(kinds, kind)
+			}
+		}
+		n += len(fixtures)
+	}
+	if verbose.any() {
+		sort.Strings(kinds)
+		slog.Info("Loaded fixture entities", "count", n, "kinds", strings.Join(kinds, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSeedDatastore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "books.json")
+	err = ioutil.WriteFile(path, []byte(`[
+		{"key": ["Shelf", "fiction", "Book", 12345678901234], "properties": {
+			"title": "Dune", "pages": 412, "rating": 4.5, "tags": ["sf"], "author": {"name": "Herbert"}, "sequel": null
+		}}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures, err := LoadFixtures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/p:commit" {
+			t.Errorf("request to %s", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+	if err := SeedDatastore(context.Background(), strings.TrimPrefix(srv.URL, "http://"), "p", fixtures); err != nil {
+		t.Fatal(err)
+	}
+
+	var want interface{}
+	json.Unmarshal([]byte(`{
+		"mode": "NON_TRANSACTIONAL",
+		"mutations": [{"upsert": {
+			"key": {
+				"partitionId": {"projectId": "p", "namespaceId": ""},
+				"path": [{"kind": "Shelf", "name": "fiction"}, {"kind": "Book", "id": "12345678901234"}]
+			},
+			"properties": {
+				"title": {"stringValue": "Dune"},
+				"pages": {"integerValue": "412"},
+				"rating": {"doubleValue": 4.5},
+				"tags": {"arrayValue": {"values": [{"stringValue": "sf"}]}},
+				"author": {"entityValue": {"properties": {"name": {"stringValue": "Herbert"}}}},
+				"sequel": {"nullValue": "NULL_VALUE"}
+			}
+		}}]
+	}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		g, _ := json.MarshalIndent(got, "", "  ")
+		t.Errorf("commit request:\n%s", g)
+	}
+}
+
+func TestLoadFixturesInvalidKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, key := range []string{`[]`, `["Book"]`, `[1, "b"]`, `["Book", 1.5]`, `["Book", true]`} {
+		path := filepath.Join(dir, "f.json")
+		if err := ioutil.WriteFile(path, []byte(`[{"key": `+key+`}]`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFixtures(path); err == nil {
+			t.Errorf("LoadFixtures with key %s: no error", key)
+		}
+	}
+}
+
+func TestFixtureFromEntity(t *testing.T) {
+	f := Fixture{
+		Namespace: "ns",
+		Key:       []interface{}{"Shelf", "fiction", "Book", json.Number("12345678901234")},
+		Properties: map[string]interface{}{
+			"title":  "Dune",
+			"pages":  json.Number("412"),
+			"rating": json.Number("4.5"),
+			"tags":   []interface{}{"sf"},
+			"author": map[string]interface{}{"name": "Herbert"},
+			"sequel": nil,
+		},
+	}
+	key, err := f.datastoreKey("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(map[string]interface{}{"key": key, "properties": datastoreProperties(f.Properties)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fixtureFromEntity(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Errorf("fixtureFromEntity(%s) = %#v, want %#v", b, got, f)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcloudCLI describes the emulator commands of the installed gcloud, which
+// have changed across releases.
+type gcloudCLI struct {
+	// beta is set for releases that only have "gcloud beta emulators",
+	// not the GA "gcloud emulators".
+	beta bool
+
+	// noLegacy is set for releases whose "emulators datastore start"
+	// defaults to the legacy Datastore emulator, unless passed
+	// --no-legacy.
+	noLegacy bool
+}
+
+var (
+	detectOnce sync.Once
+	detected   gcloudCLI
+)
+
+// defaultProject is the project the Datastore emulator is started for when
+// none is configured, with -project or by gcloud.
+const defaultProject = "with-emulators"
+
+var legacyFlagRE = regexp.MustCompile(`--(\[no-\])?legacy\b`)
+
+// detectGcloud probes the installed gcloud's emulator commands. It assumes
+// the GA commands if gcloud can't tell.
+func detectGcloud() gcloudCLI {
+	detectOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		help, err := exec.CommandContext(ctx, "gcloud", "-q", "emulators", "datastore", "start", "--help").Output()
+		if err != nil {
+			beta, err := exec.CommandContext(ctx, "gcloud", "-q", "beta", "emulators", "datastore", "start", "--help").Output()
+			if err != nil {
+				return
+			}
+			detected.beta = true
+			help = beta
+		}
+		detected.noLegacy = legacyFlagRE.Match(help)
+	})
+	return detected
+}
+
+// apply adapts e's gcloud commands, written in the GA form, to g.
+func (g gcloudCLI) apply(e *Emulator) {
+	e.Command = g.command(e.Command)
+	if g.noLegacy && e.Component == "cloud-datastore-emulator" {
+		e.Command = append(e.Command[:len(e.Command):len(e.Command)], "--no-legacy")
+	}
+}
+
+// command returns cmd, a "gcloud -q emulators ..." command, in g's form.
+func (g gcloudCLI) command(cmd []string) []string {
+	if !g.beta || len(cmd) < 3 || cmd[0] != "gcloud" || cmd[2] != "emulators" {
+		return cmd
+	}
+	return append([]string{"gcloud", "-q", "beta"}, cmd[2:]...)
+}
+
+// gcloudProject returns the project configured in gcloud, which its emulators
+// are started for unless passed --project, or "" if there is none.
+func gcloudProject() string {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "gcloud", "-q", "config", "get-value", "project").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
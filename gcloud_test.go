@@ -0,0 +1,39 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGcloudCLIApply(t *testing.T) {
+	for _, tt := range []struct {
+		g        gcloudCLI
+		want     string
+		wantFire string
+	}{
+		{gcloudCLI{}, "gcloud -q emulators datastore start", "gcloud -q emulators firestore start"},
+		{gcloudCLI{noLegacy: true}, "gcloud -q emulators datastore start --no-legacy", "gcloud -q emulators firestore start"},
+		{gcloudCLI{beta: true, noLegacy: true}, "gcloud -q beta emulators datastore start --no-legacy", "gcloud -q beta emulators firestore start"},
+	} {
+		ds := &Emulator{
+			Component: "cloud-datastore-emulator",
+			Command:   []string{"gcloud", "-q", "emulators", "datastore", "start"},
+		}
+		fs := &Emulator{
+			Component: "cloud-firestore-emulator",
+			Command:   []string{"gcloud", "-q", "emulators", "firestore", "start"},
+		}
+		tt.g.apply(ds)
+		tt.g.apply(fs)
+		if got := strings.Join(ds.Command, " "); got != tt.want {
+			t.Errorf("%+v: Command = %q, want %q", tt.g, got, tt.want)
+		}
+		if got := strings.Join(fs.Command, " "); got != tt.wantFire {
+			t.Errorf("%+v: firestore Command = %q, want %q", tt.g, got, tt.wantFire)
+		}
+	}
+}
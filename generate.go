@@ -0,0 +1,162 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// envMarker is set in the environment of commands run by with_emulators,
+// so that emulatortest.Main can tell whether it needs to re-exec.
+const envMarker = "WITH_EMULATORS"
+
+// generateMain implements the generate subcommand.
+func generateMain(args []string) int {
+	if len(args) > 0 && args[0] == "devcontainer" {
+		return devcontainerMain(args[1:])
+	}
+	if len(args) == 0 || args[0] != "testmain" {
+		fmt.Fprintf(os.Stderr, "usage: with_emulators generate testmain [flags] [DIR]\n")
+		fmt.Fprintf(os.Stderr, "       with_emulators generate devcontainer [flags]\n")
+		return 2
+	}
+	fs := flag.NewFlagSet("generate testmain", flag.ContinueOnError)
+	config := fs.String("config", *configPath, "Configuration file to pass to with_emulators")
+	out := fs.String("o", "emulators_test.go", "Output file name, relative to DIR")
+	unavailable := fs.String("unavailable", "fail", "What to do when the backend's prerequisites, such as gcloud and Java, are missing: fail, skip or install")
+	testBackend := fs.String("backend", "", "Backend to run the emulators with, as with_emulators' -backend (default: local)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: with_emulators generate testmain [flags] [DIR]\n\n")
+		fmt.Fprintf(os.Stderr, "Writes a TestMain to DIR (default \".\") that re-runs the package's tests under with_emulators.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	dir := "."
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		dir = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	policy, ok := unavailablePolicies[*unavailable]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "generate testmain: invalid -unavailable %q\n", *unavailable)
+		return 2
+	}
+
+	src, err := generateTestMain(dir, *config, policy, *testBackend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate testmain: %v\n", err)
+		return 1
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, *out), src, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "generate testmain: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// generateTestMain returns the source of a TestMain for the package in dir.
+// config is the path of the configuration file, if any, relative to the
+// current directory. policy names an emulatortest.Policy, and backend is
+// the -backend to run the emulators with, or "" for the default.
+func generateTestMain(dir, config, policy, backend string) ([]byte, error) {
+	pkg, err := packageName(dir)
+	if err != nil {
+		return nil, err
+	}
+	if config != "" {
+		// Tests run in the package directory, so make the path relative to it.
+		abs, err := filepath.Abs(config)
+		if err != nil {
+			return nil, err
+		}
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(absDir, abs)
+		if err != nil {
+			return nil, err
+		}
+		config = filepath.ToSlash(rel)
+	}
+
+	var buf bytes.Buffer
+	if err := testMainTmpl.Execute(&buf, struct {
+		Package     string
+		Config      string
+		Unavailable string
+		Backend     string
+	}{pkg, config, policy, backend}); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// packageName returns the name of the package in dir, ignoring external
+// test packages.
+func packageName(dir string) (string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for name := range pkgs {
+		if !strings.HasSuffix(name, "_test") {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("%s: want exactly one package, found %v", dir, names)
+	}
+	return names[0], nil
+}
+
+var testMainTmpl = template.Must(template.New("testmain").Parse(`// Code generated by "with_emulators generate testmain"; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"testing"
+
+	"github.com/broady/with_emulators/emulatortest"
+)
+
+func TestMain(m *testing.M) {
+	emulatortest.Main(m, emulatortest.Options{
+		{{- if .Config}}
+		Config: {{printf "%q" .Config}},
+		{{- end}}
+		Unavailable: emulatortest.{{.Unavailable}},
+		{{- if .Backend}}
+		Backend: {{printf "%q" .Backend}},
+		{{- end}}
+	})
+}
+`))
+
+// unavailablePolicies maps -unavailable values to emulatortest.Policy names.
+var unavailablePolicies = map[string]string{
+	"fail":    "FailIfUnavailable",
+	"skip":    "SkipIfUnavailable",
+	"install": "AutoInstall",
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTestMain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pkgDir := filepath.Join(dir, "mypkg")
+	if err := os.Mkdir(pkgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range map[string]string{
+		"mypkg.go":      "package mypkg\n",
+		"x_test.go":     "package mypkg_test\n",
+		"mypkg_test.go": "package mypkg\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(pkgDir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, err := generateTestMain(pkgDir, filepath.Join(dir, "emulators.json"), unavailablePolicies["skip"], "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted, err := format.Source(src); err != nil || !bytes.Equal(formatted, src) {
+		t.Errorf("generated TestMain is not gofmt-clean (%v):\n%s", err, src)
+	}
+	for _, want := range []string{"package mypkg\n", `Config:      "../emulators.json"`, "emulatortest.SkipIfUnavailable", `Backend:     "docker"`} {
+		if !bytes.Contains(src, []byte(want)) {
+			t.Errorf("generated TestMain doesn't contain %q:\n%s", want, src)
+		}
+	}
+
+	// The generated code must compile against the emulatortest package.
+	fset := token.NewFileSet()
+	std := importer.Default()
+	pkgs, err := parser.ParseDir(fset, "emulatortest", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*ast.File
+	for _, f := range pkgs["emulatortest"].Files {
+		files = append(files, f)
+	}
+	lib, err := (&types.Config{Importer: std}).Check("github.com/broady/with_emulators/emulatortest", fset, files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parser.ParseFile(fset, "emulators_test.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+		if path == lib.Path() {
+			return lib, nil
+		}
+		return std.Import(path)
+	})}
+	if _, err := conf.Check("mypkg", fset, []*ast.File{f}, nil); err != nil {
+		t.Errorf("generated TestMain doesn't compile: %v\n%s", err, src)
+	}
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
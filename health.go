@@ -0,0 +1,61 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// Health is the body of the /healthz endpoint served with -health.
+type Health struct {
+	// Status is "ok" once every emulator is ready, "starting" until
+	// then, or "unhealthy" if any crashed or stopped.
+	Status    string           `json:"status"`
+	Emulators []EmulatorStatus `json:"emulators"`
+}
+
+// health returns the health of emulators.
+func health(emulators []*Emulator) Health {
+	h := Health{Status: "ok", Emulators: []EmulatorStatus{}}
+	for _, e := range emulators {
+		st := e.Status()
+		switch st.Status {
+		case "starting":
+			if h.Status == "ok" {
+				h.Status = "starting"
+			}
+		case "crashed", "stopped":
+			h.Status = "unhealthy"
+		}
+		h.Emulators = append(h.Emulators, st)
+	}
+	return h
+}
+
+// startHealth serves /healthz on addr, reporting the health of the
+// emulators returned by emulators, with 200 OK when all of them are ready
+// and 503 Service Unavailable otherwise, for liveness checks.
+func startHealth(addr string, emulators func() []*Emulator) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := health(emulators())
+		w.Header().Set("Content-Type", "application/json")
+		if h.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	slog.Info("Health endpoint running", "url", "http://"+l.Addr().String()+"/healthz")
+	return srv, nil
+}
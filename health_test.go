@@ -0,0 +1,49 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	ready := &Emulator{
+		Name:          "pubsub",
+		Command:       []string{"sh", "-c", "echo Server started, listening >&2; sleep 10"},
+		ReadySentinel: "Server started, listening",
+		HostPort:      "localhost:8085",
+		StopTimeout:   time.Second,
+	}
+	idle := &Emulator{Name: "datastore"}
+	if h := health([]*Emulator{ready, idle}); h.Status != "unhealthy" || h.Emulators[0].Status != "stopped" {
+		t.Errorf("before start: got %+v, want unhealthy, stopped", h)
+	}
+
+	if err := ready.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ready.Stop()
+	if err := ready.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h := health([]*Emulator{ready})
+	if h.Status != "ok" {
+		t.Errorf("ready: got %+v, want ok", h)
+	}
+	if st := h.Emulators[0]; st.Status != "ready" || st.Endpoint != "localhost:8085" || st.Uptime <= 0 {
+		t.Errorf("ready: got %+v, want ready on localhost:8085, with an uptime", st)
+	}
+
+	crashy := &Emulator{Name: "datastore", Command: []string{"sh", "-c", "exit 3"}}
+	if err := crashy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-crashy.Done()
+	if h := health([]*Emulator{ready, crashy}); h.Status != "unhealthy" || h.Emulators[1].Status != "crashed" {
+		t.Errorf("crashed: got %+v, want unhealthy, crashed", h)
+	}
+}
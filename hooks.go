@@ -0,0 +1,68 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Hooks are shell commands run at points in a session's life, configured in
+// Config.Hooks, with the emulators' environment. They run in order, up to
+// the first that fails.
+type Hooks struct {
+	// PreStart runs once the emulators' ports are chosen, before they
+	// start. If it fails, the session does not start.
+	PreStart []string `json:"preStart"`
+
+	// PostReady runs once the emulators and ReadyWhen resources are
+	// ready, e.g. to seed data. If it fails, the session does not start.
+	PostReady []string `json:"postReady"`
+
+	// PreStop runs before the emulators are stopped, e.g. to export data.
+	PreStop []string `json:"preStop"`
+
+	// PostStop runs after the emulators are stopped.
+	PostStop []string `json:"postStop"`
+}
+
+func (h Hooks) validate() error {
+	for name, cmds := range map[string][]string{"preStart": h.PreStart, "postReady": h.PostReady, "preStop": h.PreStop, "postStop": h.PostStop} {
+		for _, c := range cmds {
+			if c == "" {
+				return fmt.Errorf("%s: empty command", name)
+			}
+		}
+	}
+	return nil
+}
+
+// runHook runs the commands of the named hook with env, stopping at the
+// first that fails. Their output goes to stderr, keeping stdout for the
+// command, or the environment printed by start.
+func runHook(ctx context.Context, name string, cmds []string, env []string) error {
+	for _, c := range cmds {
+		slog.Info("Running hook", "hook", name, "command", c)
+		cmd := shellCommand(ctx, c)
+		cmd.Env = env
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q: %v", name, c, err)
+		}
+	}
+	return nil
+}
+
+// shellCommand returns the command running c in the system's shell.
+func shellCommand(ctx context.Context, c string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", c)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", c)
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	env := []string{"PUBSUB_EMULATOR_HOST=localhost:8085"}
+	cmds := []string{"echo $PUBSUB_EMULATOR_HOST > " + out, "exit 3", "echo not reached >> " + out}
+	err = runHook(context.Background(), "postReady", cmds, env)
+	if err == nil || !strings.Contains(err.Error(), `postReady hook "exit 3"`) {
+		t.Errorf("runHook = %v, want exit 3 failure", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != "localhost:8085\n" {
+		t.Errorf("hook output = %q, want the emulator's address only", got)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// installIndex copies the index.yaml at path into the Datastore emulator's
+// data directory, where the emulator reads composite index definitions
+// from when it starts.
+func installIndex(e *Emulator, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(b, []byte("indexes:")) {
+		return fmt.Errorf("%s: no indexes: section; not an index.yaml file?", path)
+	}
+	dir := filepath.Join(e.DataDir, "WEB-INF")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.yaml"), b, 0600)
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// minJava is the oldest Java release that current emulators run on.
+const minJava = 11
+
+// requireJava returns an error naming the first of emulators that needs a
+// newer Java runtime than the one installed, if any, rather than leaving it
+// to fail to start, which gcloud doesn't always report.
+func requireJava(emulators []*Emulator) error {
+	var version string
+	var major int
+	var err error
+	checked := false
+	for _, e := range emulators {
+		if e.MinJava == 0 || e.Container != nil {
+			continue
+		}
+		if !checked {
+			version, major, err = javaVersion()
+			checked = true
+		}
+		if _, ok := err.(*exec.Error); ok {
+			return fmt.Errorf("%s emulator requires Java %d+, found none; install it, or use -backend=docker", e.Name, e.MinJava)
+		}
+		if err != nil {
+			return fmt.Errorf("%s emulator requires Java %d+: %v", e.Name, e.MinJava, err)
+		}
+		if major < e.MinJava {
+			return fmt.Errorf("%s emulator requires Java %d+, found %s; install a newer one and put it first on PATH, or set JAVA_HOME", e.Name, e.MinJava, version)
+		}
+	}
+	return nil
+}
+
+var javaVersionRE = regexp.MustCompile(`version "([^"]+)"`)
+
+// javaVersion returns the version of the Java runtime on PATH, or in
+// JAVA_HOME, as reported by java -version, along with its major release,
+// e.g. "1.8.0_292" and 8, or "17.0.2" and 17.
+func javaVersion() (string, int, error) {
+	java := "java"
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		java = filepath.Join(home, "bin", "java")
+	}
+	out, err := exec.Command(java, "-version").CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return "", 0, err
+		}
+		return "", 0, fmt.Errorf("java -version failed: %s", strings.TrimSpace(string(out)))
+	}
+	m := javaVersionRE.FindSubmatch(out)
+	if m == nil {
+		return "", 0, fmt.Errorf("unrecognized java -version output: %q", out)
+	}
+	version := string(m[1])
+	return version, javaMajor(version), nil
+}
+
+// javaMajor returns the major release of a Java version string, which is
+// the second number for releases before 9, e.g. 8 for "1.8.0_292".
+func javaMajor(version string) int {
+	version = strings.TrimPrefix(version, "1.")
+	if i := strings.IndexAny(version, ".-_+"); i >= 0 {
+		version = version[:i]
+	}
+	major, _ := strconv.Atoi(version)
+	return major
+}
+
+// javaToolOptions returns the JAVA_TOOL_OPTIONS variable that passes opts to
+// a JVM, after the inherited value of the variable, if any.
+func javaToolOptions(inherited string, opts []string) string {
+	if inherited != "" {
+		opts = append([]string{inherited}, opts...)
+	}
+	return "JAVA_TOOL_OPTIONS=" + strings.Join(opts, " ")
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJavaMajor(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		want    int
+	}{
+		{"1.8.0_292", 8},
+		{"11.0.20", 11},
+		{"17", 17},
+		{"21-ea", 21},
+		{"17.0.2+8", 17},
+	} {
+		if got := javaMajor(tt.version); got != tt.want {
+			t.Errorf("javaMajor(%q) = %d, want %d", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestRequireJava(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-java")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	defer os.Setenv("JAVA_HOME", os.Getenv("JAVA_HOME"))
+	os.Unsetenv("JAVA_HOME")
+	os.Setenv("PATH", dir)
+
+	emulators := []*Emulator{{Name: "sh"}, {Name: "pubsub", MinJava: 11}}
+	if err := requireJava(emulators); err == nil || !strings.Contains(err.Error(), "pubsub emulator requires Java 11+, found none") {
+		t.Errorf("without java: got %v, want found none", err)
+	}
+	emulators[1].Container = &Container{}
+	if err := requireJava(emulators); err != nil {
+		t.Errorf("in a container: got %v, want nil", err)
+	}
+	emulators[1].Container = nil
+
+	java := filepath.Join(dir, "java")
+	for _, tt := range []struct {
+		version string
+		ok      bool
+	}{
+		{"1.8.0_292", false},
+		{"11.0.20", true},
+		{"21", true},
+	} {
+		script := "#!/bin/sh\necho 'openjdk version \"" + tt.version + "\" 2023-07-18' >&2\n"
+		if err := ioutil.WriteFile(java, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := requireJava(emulators)
+		if tt.ok && err != nil {
+			t.Errorf("Java %s: got %v, want nil", tt.version, err)
+		} else if !tt.ok && (err == nil || !strings.Contains(err.Error(), "found "+tt.version)) {
+			t.Errorf("Java %s: got %v, want found %s", tt.version, err, tt.version)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits bounds the resources an emulator's processes may use.
+type Limits struct {
+	Memory int64   // bytes; 0 is unlimited
+	CPU    float64 // CPUs; 0 is unlimited
+}
+
+// parseLimits returns the limits set by -limit-memory and -limit-cpu, or nil
+// if neither is set.
+func parseLimits(memory string, cpu float64) (*Limits, error) {
+	if memory == "" && cpu == 0 {
+		return nil, nil
+	}
+	l := &Limits{CPU: cpu}
+	if cpu < 0 {
+		return nil, fmt.Errorf("invalid -limit-cpu %v, want a positive number of CPUs", cpu)
+	}
+	if memory != "" {
+		n, err := parseSize(memory)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid -limit-memory %q, want a size such as 512M or 2G", memory)
+		}
+		l.Memory = n
+	}
+	return l, nil
+}
+
+// parseSize parses a size in bytes, with an optional K, M or G suffix for
+// binary multiples, as in 512M.
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n << shift, nil
+}
+
+// containerArgs returns the container runtime's arguments applying l.
+func (l *Limits) containerArgs() []string {
+	var args []string
+	if l.Memory > 0 {
+		args = append(args, "--memory="+strconv.FormatInt(l.Memory, 10))
+	}
+	if l.CPU > 0 {
+		args = append(args, "--cpus="+strconv.FormatFloat(l.CPU, 'f', -1, 64))
+	}
+	return args
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// command returns the command line that runs args, the emulator name's
+// command, in a cgroup of its own, limited to l. The cgroup is a transient
+// systemd scope, which needs no privileges, and is removed once the
+// emulator exits. systemd-run execs args, so its process group is kept.
+func (l *Limits) command(name string, args []string) ([]string, error) {
+	if _, err := exec.LookPath("systemd-run"); err != nil {
+		return nil, fmt.Errorf("-limit-memory and -limit-cpu need systemd-run, to create cgroups: %v", err)
+	}
+	cmd := []string{"systemd-run", "--scope", "--quiet", "--collect",
+		"--unit=with_emulators-" + strconv.Itoa(os.Getpid()) + "-" + name}
+	if os.Geteuid() != 0 {
+		cmd = append(cmd, "--user")
+	}
+	if l.Memory > 0 {
+		cmd = append(cmd, "-p", "MemoryMax="+strconv.FormatInt(l.Memory, 10), "-p", "MemorySwapMax=0")
+	}
+	if l.CPU > 0 {
+		cmd = append(cmd, "-p", "CPUQuota="+strconv.FormatFloat(l.CPU*100, 'f', 0, 64)+"%")
+	}
+	cmd = append(cmd, "--")
+	return append(cmd, args...), nil
+}
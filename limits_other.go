@@ -0,0 +1,15 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+// command returns the command line that runs args, the emulator name's
+// command, limited to l. Only Linux has cgroups to do so.
+func (l *Limits) command(name string, args []string) ([]string, error) {
+	return nil, errors.New("-limit-memory and -limit-cpu are only supported on Linux, or with -backend=docker or podman")
+}
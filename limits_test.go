@@ -0,0 +1,49 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	for _, tt := range []struct {
+		memory string
+		cpu    float64
+		want   *Limits
+		err    bool
+	}{
+		{"", 0, nil, false},
+		{"512M", 0, &Limits{Memory: 512 << 20}, false},
+		{"2g", 1.5, &Limits{Memory: 2 << 30, CPU: 1.5}, false},
+		{"1048576", 0, &Limits{Memory: 1 << 20}, false},
+		{"", 2, &Limits{CPU: 2}, false},
+		{"512MB", 0, nil, true},
+		{"M", 0, nil, true},
+		{"-1G", 0, nil, true},
+		{"", -1, nil, true},
+	} {
+		got, err := parseLimits(tt.memory, tt.cpu)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseLimits(%q, %v) succeeded, want an error", tt.memory, tt.cpu)
+			}
+			continue
+		}
+		if err != nil || (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("parseLimits(%q, %v) = %+v, %v, want %+v", tt.memory, tt.cpu, got, err, tt.want)
+		}
+	}
+}
+
+func TestContainerLimits(t *testing.T) {
+	c := &Container{Runtime: "docker", Image: "img", Name: "n"}
+	cmd := c.command("localhost:8085", "", nil, &Limits{Memory: 512 << 20, CPU: 0.5}, []string{"gcloud"})
+	got := strings.Join(cmd, " ")
+	if !strings.Contains(got, " --memory=536870912 --cpus=0.5 img gcloud") {
+		t.Errorf("command = %q, want --memory and --cpus before the image", got)
+	}
+}
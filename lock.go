@@ -0,0 +1,44 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it if
+// needed, waiting until ctx is done for another process to release it.
+// The lock is the operating system's (flock, or LockFileEx on Windows), so
+// it is released when its holder exits, however it exits, and there is no
+// stale lock to break. The file is left in place: removing it would let a
+// process waiting on the old file and one creating a new file both hold
+// "the" lock.
+func lockFile(ctx context.Context, path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ok, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"time"
+)
+
+// envMetadata names the environment variable holding the path of the
+// metadata file written for the wrapped command.
+// emulatortest.ReadMetadata reads it.
+const envMetadata = "WITH_EMULATORS_METADATA"
+
+// Metadata describes the running emulators to the wrapped command.
+// Its encoding must match emulatortest.Metadata.
+type Metadata struct {
+	Emulators []EmulatorMetadata `json:"emulators"`
+	Projects  map[string]string  `json:"projects,omitempty"`
+}
+
+// EmulatorMetadata describes a single emulator.
+type EmulatorMetadata struct {
+	Name            string        `json:"name"`
+	Component       string        `json:"component"`
+	Version         string        `json:"version,omitempty"`
+	Endpoint        string        `json:"endpoint,omitempty"`
+	StartupDuration time.Duration `json:"startupDuration"`
+}
+
+// newMetadata describes the emulators of the session st. env is the
+// environment passed to the wrapped command.
+func newMetadata(st *State, env []string) *Metadata {
+	md := &Metadata{Projects: st.Projects}
+	for _, e := range st.Emulators {
+		md.Emulators = append(md.Emulators, EmulatorMetadata{
+			Name:            e.Name,
+			Component:       e.Component,
+			Version:         e.Version,
+			Endpoint:        lookupEnv(env, e.HostEnv),
+			StartupDuration: e.StartupDuration,
+		})
+	}
+	return md
+}
+
+// writeMetadata writes md to a temporary file and returns its path.
+func writeMetadata(md *Metadata) (string, error) {
+	b, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "with_emulators-metadata-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// gcloudVersions returns the installed version of each gcloud component,
+// keyed by component ID. It returns nil if gcloud can't report them.
+func gcloudVersions() map[string]string {
+	out, err := exec.Command("gcloud", "version", "--format=json").Output()
+	if err != nil {
+		return nil
+	}
+	var versions map[string]string
+	if err := json.Unmarshal(out, &versions); err != nil {
+		return nil
+	}
+	return versions
+}
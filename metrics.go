@@ -0,0 +1,93 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// metrics serves Prometheus metrics about a session's emulators, and the
+// command it runs, with -metrics.
+type metrics struct {
+	emulators func() []*Emulator
+	srv       *http.Server
+
+	mu       sync.Mutex
+	exitCode *int // the command's, once it exited
+}
+
+// startMetrics serves the metrics of the emulators returned by emulators
+// on addr, at /metrics.
+func startMetrics(addr string, emulators func() []*Emulator) (*metrics, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &metrics{emulators: emulators}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	m.srv = &http.Server{Handler: mux}
+	go m.srv.Serve(l)
+	slog.Info("Metrics endpoint running", "url", "http://"+l.Addr().String()+"/metrics")
+	return m, nil
+}
+
+// Close stops serving metrics.
+func (m *metrics) Close() {
+	if m != nil {
+		m.srv.Close()
+	}
+}
+
+// commandExited records the exit code of the command. m may be nil.
+func (m *metrics) commandExited(code int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exitCode = &code
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	var statuses []EmulatorStatus
+	for _, e := range m.emulators() {
+		statuses = append(statuses, e.Status())
+	}
+	family := func(name, typ, help string, value func(EmulatorStatus) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, st := range statuses {
+			fmt.Fprintf(w, "%s{emulator=%q} %g\n", name, st.Name, value(st))
+		}
+	}
+	family("with_emulators_emulator_up", "gauge", "Whether the emulator is ready.", func(st EmulatorStatus) float64 {
+		if st.Status == "ready" {
+			return 1
+		}
+		return 0
+	})
+	family("with_emulators_emulator_restarts_total", "counter", "How many times the emulator was restarted.", func(st EmulatorStatus) float64 {
+		return float64(st.Restarts)
+	})
+	family("with_emulators_emulator_startup_seconds", "gauge", "How long the emulator took to become ready, at its last start.", func(st EmulatorStatus) float64 {
+		return time.Duration(st.Startup).Seconds()
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.exitCode != nil {
+		fmt.Fprintf(w, "# HELP with_emulators_command_exit_code The exit code of the command, once it exited.\n# TYPE with_emulators_command_exit_code gauge\nwith_emulators_command_exit_code %d\n", *m.exitCode)
+	}
+}
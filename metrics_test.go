@@ -0,0 +1,35 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	emulators := []*Emulator{{Name: "datastore"}, {Name: "pubsub"}}
+	m := &metrics{emulators: func() []*Emulator { return emulators }}
+	var buf bytes.Buffer
+	m.write(&buf)
+	if strings.Contains(buf.String(), "with_emulators_command_exit_code") {
+		t.Errorf("exit code reported before the command exited:\n%s", buf.String())
+	}
+	m.commandExited(3)
+	buf.Reset()
+	m.write(&buf)
+	for _, want := range []string{
+		"# TYPE with_emulators_emulator_up gauge\n",
+		`with_emulators_emulator_up{emulator="datastore"} 0` + "\n",
+		`with_emulators_emulator_restarts_total{emulator="pubsub"} 0` + "\n",
+		`with_emulators_emulator_startup_seconds{emulator="pubsub"} 0` + "\n",
+		"with_emulators_command_exit_code 3\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Lifecycle events that can be sent to notification hooks.
+const (
+	// EventStartupFailed is sent when the emulators or ReadyWhen
+	// resources do not become ready.
+	EventStartupFailed = "startup-failed"
+
+	// EventCrashed is sent when an emulator dies while the command runs.
+	EventCrashed = "crashed"
+
+	// EventIdleShutdown is sent when a -shared session stops its emulators
+	// after having no clients for -shared-idle.
+	EventIdleShutdown = "idle-shutdown"
+)
+
+// Hook is a notification hook, configured in Config.Notify.
+type Hook struct {
+	// URL receives an HTTP POST for each event.
+	URL string `json:"url"`
+
+	// Format is the request body format: "json" (the default) posts an
+	// Event, and "slack" posts a message for a Slack incoming webhook.
+	Format string `json:"format"`
+
+	// Events lists the events to send. Empty means all of them.
+	Events []string `json:"events"`
+}
+
+func (h Hook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h Hook) validate() error {
+	if h.URL == "" {
+		return fmt.Errorf("hook has no url")
+	}
+	switch h.Format {
+	case "", "json", "slack":
+	default:
+		return fmt.Errorf("hook %s: unknown format %q", h.URL, h.Format)
+	}
+	for _, e := range h.Events {
+		switch e {
+		case EventStartupFailed, EventCrashed, EventIdleShutdown:
+		default:
+			return fmt.Errorf("hook %s: unknown event %q", h.URL, e)
+		}
+	}
+	return nil
+}
+
+// Event is a lifecycle event, as posted to "json" hooks.
+type Event struct {
+	Event    string    `json:"event"`
+	Emulator string    `json:"emulator,omitempty"`
+	Message  string    `json:"message"`
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+}
+
+// notifyTimeout bounds how long sending an event to all hooks may take.
+const notifyTimeout = 10 * time.Second
+
+// notify sends an event to the hooks that want it, and to the -events
+// stream. Failures are logged.
+func notify(hooks []Hook, event, emulator string, msg error) {
+	emit(StreamEvent{Event: event, Emulator: emulator, Message: msg.Error()})
+	ev := Event{
+		Event:    event,
+		Emulator: emulator,
+		Message:  msg.Error(),
+		Time:     time.Now(),
+	}
+	ev.Host, _ = os.Hostname()
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	for _, h := range hooks {
+		if !h.wants(event) {
+			continue
+		}
+		if err := h.send(ctx, ev); err != nil {
+			slog.Error("Could not notify hook", "url", h.URL, "err", err)
+		}
+	}
+}
+
+func (h Hook) send(ctx context.Context, ev Event) error {
+	var body interface{} = ev
+	if h.Format == "slack" {
+		text := fmt.Sprintf("with_emulators on %s: %s", ev.Host, ev.Event)
+		if ev.Emulator != "" {
+			text += " (" + ev.Emulator + ")"
+		}
+		text += "\n```" + ev.Message + "```"
+		body = map[string]string{"text": text}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
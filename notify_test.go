@@ -0,0 +1,44 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	got := make(chan Event, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		got <- ev
+	}))
+	defer srv.Close()
+
+	hook := Hook{URL: srv.URL, Events: []string{EventIdleShutdown}}
+	if err := hook.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Hook{URL: srv.URL, Events: []string{"idle"}}).validate(); err == nil {
+		t.Error("validate accepted an unknown event")
+	}
+
+	notify([]Hook{hook}, EventCrashed, "pubsub", errors.New("exit status 1"))
+	notify([]Hook{hook}, EventIdleShutdown, "", errors.New("no clients"))
+	close(got)
+	var events []string
+	for ev := range got {
+		events = append(events, ev.Event)
+	}
+	if len(events) != 1 || events[0] != EventIdleShutdown {
+		t.Errorf("hook received %q, want only %s", events, EventIdleShutdown)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startTime is when with_emulators started, the origin of relative
+// timestamps.
+var startTime = time.Now()
+
+// timestampFormats are the values accepted by -timestamps.
+var timestampFormats = []string{"off", "rfc3339", "relative"}
+
+// verboseFlag is the -v flag: -v copies every emulator's output to the
+// terminal, and -v=NAME[,NAME...] only the named emulators' output.
+type verboseFlag struct {
+	all   bool
+	names []string
+}
+
+func (f *verboseFlag) IsBoolFlag() bool { return true }
+
+func (f *verboseFlag) String() string {
+	if f == nil || len(f.names) == 0 {
+		return strconv.FormatBool(f != nil && f.all)
+	}
+	return strings.Join(f.names, ",")
+}
+
+func (f *verboseFlag) Set(s string) error {
+	if b, err := strconv.ParseBool(s); err == nil {
+		f.all, f.names = b, nil
+		return nil
+	}
+	f.all, f.names = false, nil
+	for _, name := range strings.Split(s, ",") {
+		if !contains(emulatorNames(), name) {
+			return fmt.Errorf("unknown emulator %q, want one of %s", name, strings.Join(emulatorNames(), ", "))
+		}
+		f.names = append(f.names, name)
+	}
+	return nil
+}
+
+// any reports whether any emulator's output is copied.
+func (f *verboseFlag) any() bool { return f.all || len(f.names) > 0 }
+
+// of reports whether the named emulator's output is copied.
+func (f *verboseFlag) of(name string) bool { return f.all || contains(f.names, name) }
+
+// verboseList is the -verbose flag, the same as -v but taking a value.
+type verboseList struct{ v *verboseFlag }
+
+func (f verboseList) String() string     { return f.v.String() }
+func (f verboseList) Set(s string) error { return f.v.Set(s) }
+
+// tagColors are the ANSI colors used for emulator tags, by emulator.
+var tagColors = map[string]string{
+	"datastore": "36", // cyan
+	"pubsub":    "35", // magenta
+}
+
+// useColor reports whether output written to f should be colored.
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// prefixWriter writes each line written to it to w, tagged with the name
+// of the emulator that wrote it. Partial lines are held until completed
+// or flushed.
+type prefixWriter struct {
+	w   io.Writer
+	tag []byte
+	raw []byte // the tag gcloud puts on emulator output, removed
+
+	// stamp, if set, returns the timestamp to put after the tag.
+	stamp func() string
+
+	// filter, if set, selects the lines written.
+	filter *LogFilter
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// newPrefixWriter returns a prefixWriter tagging lines with [name],
+// colored if color is set.
+func newPrefixWriter(w io.Writer, name string, color bool) *prefixWriter {
+	tag := "[" + name + "] "
+	raw := []byte(tag)
+	if c, ok := tagColors[name]; ok && color {
+		tag = "\x1b[" + c + "m[" + name + "]\x1b[0m "
+	}
+	return &prefixWriter{w: w, tag: []byte(tag), raw: raw}
+}
+
+// timestamps makes p timestamp each line in format, one of
+// timestampFormats. Relative timestamps count from since.
+func (p *prefixWriter) timestamps(format string, since time.Time) {
+	switch format {
+	case "rfc3339":
+		p.stamp = func() string { return time.Now().Format("2006-01-02T15:04:05.000Z07:00") + " " }
+	case "relative":
+		p.stamp = func() string {
+			d := time.Since(since)
+			return fmt.Sprintf("+%d.%03ds ", d/time.Second, d%time.Second/time.Millisecond)
+		}
+	}
+}
+
+// setFilter replaces p's filter.
+func (p *prefixWriter) setFilter(f *LogFilter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filter = f
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, data...)
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(data), nil
+	}
+	if err := p.write(p.buf[:i+1]); err != nil {
+		return 0, err
+	}
+	p.buf = append(p.buf[:0], p.buf[i+1:]...)
+	return len(data), nil
+}
+
+// Flush writes any partial line.
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.write(append(p.buf, '\n'))
+	p.buf = p.buf[:0]
+	return err
+}
+
+// write writes complete lines, as a single Write so that lines from
+// different emulators don't interleave.
+func (p *prefixWriter) write(lines []byte) error {
+	var out []byte
+	var stamp string
+	if p.stamp != nil {
+		stamp = p.stamp()
+	}
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		line := bytes.TrimPrefix(lines[:i+1], p.raw)
+		lines = lines[i+1:]
+		if !p.filter.Keep(line[:len(line)-1]) {
+			continue
+		}
+		out = append(append(append(out, p.tag...), stamp...), line...)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := p.w.Write(out)
+	return err
+}
+
+// fdOutput is every emulator's Output with -output-fd, or nil.
+var fdOutput io.Writer
+
+// openOutput sets up -output-fd.
+func openOutput() error {
+	if *outputFD == 0 {
+		return nil
+	}
+	f := os.NewFile(uintptr(*outputFD), "output")
+	if f == nil {
+		return fmt.Errorf("invalid -output-fd %d", *outputFD)
+	}
+	fdOutput = &syncWriter{w: f}
+	return nil
+}
+
+// syncWriter serializes writes to w, so that the lines of emulators
+// sharing it aren't interleaved.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// Logf adapts a printf-style function, such as testing.T.Logf, to an
+// io.Writer for Emulator.Output, logging each line written separately.
+type Logf func(format string, args ...interface{})
+
+func (f Logf) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		f("%s", line)
+	}
+	return len(p), nil
+}
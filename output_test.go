@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	p := newPrefixWriter(&buf, "pubsub", false)
+	for _, s := range []string{"[pubsub] Server sta", "rted\nsecond\npar", "tial"} {
+		p.Write([]byte(s))
+	}
+	if want := "[pubsub] Server started\n[pubsub] second\n"; buf.String() != want {
+		t.Errorf("before Flush: got %q, want %q", buf.String(), want)
+	}
+	p.Flush()
+	if want := "[pubsub] Server started\n[pubsub] second\n[pubsub] partial\n"; buf.String() != want {
+		t.Errorf("after Flush: got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	newPrefixWriter(&buf, "datastore", true).Write([]byte("ready\n"))
+	if want := "\x1b[36m[datastore]\x1b[0m ready\n"; buf.String() != want {
+		t.Errorf("colored: got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrefixWriterFilter(t *testing.T) {
+	var f LogFilter
+	if err := json.Unmarshal([]byte(`{"exclude": ["INFO:", "^\\s"], "include": ["WARNING"]}`), &f); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	p := newPrefixWriter(&buf, "pubsub", false)
+	p.filter = &f
+	p.Write([]byte("INFO: started\n  at Main.java\nINFO: WARNING: slow\nready\n"))
+	if want := "[pubsub] INFO: WARNING: slow\n[pubsub] ready\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestEmulatorOutput(t *testing.T) {
+	var lines []string
+	e := &Emulator{
+		Name:    "pubsub",
+		Command: []string{"sh", "-c", "echo '[pubsub] one'; echo two >&2; printf three"},
+		Output: Logf(func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}),
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-e.Done()
+	if want := []string{"[pubsub] one", "[pubsub] two", "[pubsub] three"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("Output got %q, want %q", lines, want)
+	}
+}
+
+func TestEmulatorSetLogFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gate := filepath.Join(dir, "gate")
+
+	var mu sync.Mutex
+	var lines []string
+	e := &Emulator{
+		Name:    "pubsub",
+		Command: []string{"sh", "-c", "echo INFO one; until [ -e " + gate + " ]; do sleep 0.01; done; echo INFO two; echo three"},
+		Output: Logf(func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}),
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(lines)
+		mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	e.SetLogFilter(&LogFilter{Exclude: []Regexp{{regexp.MustCompile("^INFO")}}})
+	if err := ioutil.WriteFile(gate, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	<-e.Done()
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"[pubsub] INFO one", "[pubsub] three"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("Output got %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// freeHostPort returns host:port for a TCP port on host that is currently
+// free. Another process may take it before it is used, but that is unlikely.
+func freeHostPort(host string) (string, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// dialAddr returns the address to reach a server listening on hostPort,
+// which may be a wildcard address such as 0.0.0.0:8085.
+func dialAddr(hostPort string) string {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort
+	}
+	switch {
+	case host == "::":
+		host = "::1"
+	case isWildcard(host):
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func isWildcard(host string) bool {
+	switch host {
+	case "", "0.0.0.0", "::":
+		return true
+	}
+	return false
+}
+
+// loopbackHost returns the host for local listeners, such as proxies:
+// the IPv6 loopback address if the emulators are bound to an IPv6 address,
+// for IPv6-only machines, and localhost otherwise.
+func loopbackHost() string {
+	if ip := net.ParseIP(*bind); ip != nil && ip.To4() == nil {
+		return "::1"
+	}
+	return "localhost"
+}
+
+// isLoopback reports whether host only accepts connections from this
+// machine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// shardEnv lists variables that CI systems set to the index of a parallel
+// job, used as the shard index when -shard is not set.
+var shardEnv = []string{"CI_NODE_INDEX", "CIRCLE_NODE_INDEX", "BUILDKITE_PARALLEL_JOB"}
+
+// shardPortStride separates the ports of consecutive shards.
+const shardPortStride = 10
+
+// shardIndex returns the -shard flag, or the index of the CI job from the
+// environment, or -1 if neither is set.
+func shardIndex() (int, error) {
+	if *shard >= 0 {
+		return *shard, nil
+	}
+	for _, name := range shardEnv {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid shard index %s=%q", name, v)
+		}
+		return n, nil
+	}
+	return -1, nil
+}
+
+// setShard gives e the port and data directory of the given shard, unless
+// they are already set.
+func (e *Emulator) setShard(shard int) {
+	if e.HostPort == "" && e.DefaultPort != 0 {
+		e.HostPort = net.JoinHostPort(*bind, strconv.Itoa(e.DefaultPort+shard*shardPortStride))
+	}
+	if e.DataDir == "" && !e.NoDataDir {
+		e.DataDir = filepath.Join(stateDir(), "shard-"+strconv.Itoa(shard), e.Name)
+	}
+}
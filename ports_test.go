@@ -0,0 +1,39 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDialAddr(t *testing.T) {
+	for _, tt := range []struct{ hostPort, want string }{
+		{"localhost:8085", "localhost:8085"},
+		{"0.0.0.0:8085", "localhost:8085"},
+		{"192.168.1.2:8085", "192.168.1.2:8085"},
+		{":8085", "localhost:8085"},
+		{"[::]:8085", "[::1]:8085"},
+		{"[::1]:8085", "[::1]:8085"},
+	} {
+		if got := dialAddr(tt.hostPort); got != tt.want {
+			t.Errorf("dialAddr(%q) = %q, want %q", tt.hostPort, got, tt.want)
+		}
+	}
+}
+
+func TestEmulatorEnv(t *testing.T) {
+	for _, tt := range []struct {
+		e    *Emulator
+		want []string
+	}{
+		{&Emulator{HostEnv: "PUBSUB_EMULATOR_HOST", HostPort: "[::1]:8085", Project: "p"}, []string{"PUBSUB_EMULATOR_HOST=[::1]:8085"}},
+		{&Emulator{HostEnv: "DATASTORE_EMULATOR_HOST", HostPort: "localhost:8081", ProjectEnv: "DATASTORE_PROJECT_ID", Project: "p"}, []string{"DATASTORE_EMULATOR_HOST=localhost:8081", "DATASTORE_PROJECT_ID=p"}},
+	} {
+		if got := tt.e.Env(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Env() = %q, want %q", got, tt.want)
+		}
+	}
+}
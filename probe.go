@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// probeInterval is how often an emulator's health endpoint is polled while
+// waiting for it to be ready.
+const probeInterval = 100 * time.Millisecond
+
+// probe reports whether the HTTP server at hostPort answers GET path with
+// 200 OK.
+func probe(ctx context.Context, hostPort, path string) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", "http://"+dialAddr(hostPort)+path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// probeReady polls e's health endpoint until it answers, marking e ready,
+// or e exits or becomes ready by printing its sentinel.
+func (e *Emulator) probeReady() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-e.exited:
+		case <-e.ready:
+		}
+		cancel()
+	}()
+	for ctx.Err() == nil {
+		if probe(ctx, e.HostPort, e.HealthPath) {
+			e.output.markReady()
+			return
+		}
+		sleep(ctx, probeInterval)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// procGroup tracks an emulator process and its descendants, such as the
+// JVM that gcloud starts, so that they can be stopped together.
+// On Unix it is a process group.
+type procGroup struct {
+	pgid int
+}
+
+// prepare configures cmd, before it is started, to run in a new group.
+// Being in its own group also keeps the emulator from receiving the
+// terminal's Ctrl-C, which is left for with_emulators to handle.
+func (g *procGroup) prepare(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// add records cmd, after it has started, as the group's leader.
+func (g *procGroup) add(cmd *exec.Cmd) error {
+	g.pgid = cmd.Process.Pid
+	return nil
+}
+
+// terminate asks every process in the group to exit.
+func (g *procGroup) terminate() error {
+	return g.signal(syscall.SIGTERM)
+}
+
+// kill forcibly stops every process in the group.
+func (g *procGroup) kill() error {
+	return g.signal(syscall.SIGKILL)
+}
+
+func (g *procGroup) signal(sig syscall.Signal) error {
+	if g.pgid <= 0 {
+		return nil // never started; don't signal our own group
+	}
+	if err := syscall.Kill(-g.pgid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// close releases the resources held by the group.
+func (g *procGroup) close() {}
+
+// pids returns the processes in the group, using /proc.
+// It returns nil where /proc is not available.
+func (g *procGroup) pids() []int {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	pgid := strconv.Itoa(g.pgid)
+	var pids []int
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", d.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name is parenthesized and may contain spaces, so
+		// split after it. The fields after it are state, ppid and pgrp.
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		f := strings.Fields(string(stat[i+1:]))
+		if len(f) > 2 && f[2] == pgid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// processAlive reports whether the process pid exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false // e.g. a remote emulator; 0 would be our own group
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// terminateProcess asks process pid to exit.
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// stopProcessTree stops a process group started by another with_emulators
+// process, identified by its leader's pid. If force is set, it is killed.
+func stopProcessTree(pid int, force bool) error {
+	g := &procGroup{pgid: pid}
+	if force {
+		return g.kill()
+	}
+	return g.terminate()
+}
+
+// detach configures cmd to run in the background, in a new session
+// without a controlling terminal.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+)
+
+const (
+	jobObjectExtendedLimitInformationClass = 9
+	jobObjectLimitKillOnJobClose           = 0x2000
+)
+
+type jobObjectBasicLimitInformation struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+}
+
+type ioCounters struct {
+	ReadOperationCount, WriteOperationCount, OtherOperationCount uint64
+	ReadTransferCount, WriteTransferCount, OtherTransferCount    uint64
+}
+
+type jobObjectExtendedLimitInformation struct {
+	BasicLimitInformation jobObjectBasicLimitInformation
+	IoInfo                ioCounters
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// procGroup tracks an emulator process and its descendants, such as the
+// JVM that gcloud starts, so that they can be stopped together.
+// On Windows it is a Job Object, which is also closed, killing the
+// emulator, if with_emulators itself dies.
+//
+// Processes started by the emulator before it is assigned to the job are
+// not tracked; gcloud takes long enough to start the JVM for this not to
+// matter in practice.
+type procGroup struct {
+	job syscall.Handle
+}
+
+// prepare configures cmd before it is started. Nothing is needed on Windows.
+func (g *procGroup) prepare(cmd *exec.Cmd) {}
+
+// add assigns cmd, after it has started, to a new job.
+func (g *procGroup) add(cmd *exec.Cmd) error {
+	h, _, err := procCreateJobObjectW.Call(0, 0)
+	if h == 0 {
+		return fmt.Errorf("CreateJobObject: %v", err)
+	}
+	g.job = syscall.Handle(h)
+
+	info := jobObjectExtendedLimitInformation{}
+	info.BasicLimitInformation.LimitFlags = jobObjectLimitKillOnJobClose
+	if r, _, err := procSetInformationJobObject.Call(uintptr(g.job), jobObjectExtendedLimitInformationClass,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); r == 0 {
+		return fmt.Errorf("SetInformationJobObject: %v", err)
+	}
+
+	const access = syscall.PROCESS_TERMINATE | 0x0100 // PROCESS_SET_QUOTA
+	p, err := syscall.OpenProcess(access, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		return fmt.Errorf("OpenProcess: %v", err)
+	}
+	defer syscall.CloseHandle(p)
+	if r, _, err := procAssignProcessToJobObject.Call(uintptr(g.job), uintptr(p)); r == 0 {
+		return fmt.Errorf("AssignProcessToJobObject: %v", err)
+	}
+	return nil
+}
+
+// terminate stops every process in the job. Windows has no equivalent of
+// SIGTERM for console programs, so this is the same as kill.
+func (g *procGroup) terminate() error {
+	return g.kill()
+}
+
+// kill forcibly stops every process in the job.
+func (g *procGroup) kill() error {
+	if g.job == 0 {
+		return nil
+	}
+	if r, _, err := procTerminateJobObject.Call(uintptr(g.job), 1); r == 0 {
+		return fmt.Errorf("TerminateJobObject: %v", err)
+	}
+	return nil
+}
+
+// close releases the job handle.
+func (g *procGroup) close() {
+	if g.job != 0 {
+		syscall.CloseHandle(g.job)
+		g.job = 0
+	}
+}
+
+// pids is not implemented on Windows.
+func (g *procGroup) pids() []int {
+	return nil
+}
+
+// processAlive reports whether the process pid exists.
+func processAlive(pid int) bool {
+	const processQueryLimitedInformation = 0x1000
+	const stillActive = 259
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
+
+// terminateProcess stops process pid. Windows can't ask another process to
+// exit, so it is killed; killing with_emulators closes its jobs, which
+// stops its emulators.
+func terminateProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// stopProcessTree stops process pid and its descendants.
+// Windows can only do this forcibly, so force is ignored.
+func stopProcessTree(pid int, force bool) error {
+	out, err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("taskkill: %v: %s", err, out)
+	}
+	return nil
+}
+
+// detach configures cmd to run in the background, without a console.
+func detach(cmd *exec.Cmd) {
+	const createNewProcessGroup, detachedProcess = 0x200, 0x8
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: createNewProcessGroup | detachedProcess}
+}
@@ -0,0 +1,313 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy is an HTTP reverse proxy in front of an emulator, which counts the
+// calls made through it, and can fail some of them. It forwards both gRPC
+// (unencrypted HTTP/2) and REST (HTTP/1) traffic.
+type Proxy struct {
+	// Target is the emulator's host:port.
+	Target string
+
+	// Host is the host the proxy listens on. Defaults to localhost.
+	Host string
+
+	// Socket, if set, is the path of a Unix domain socket that the proxy
+	// also listens on.
+	Socket string
+
+	// Faults are injected into the calls made through the proxy.
+	Faults []*Fault
+
+	// Throttle, if set, slows down the calls made through the proxy.
+	Throttle *Throttle
+
+	// TLS, if set, makes the proxy serve TLS, including gRPC over HTTP/2,
+	// instead of unencrypted traffic.
+	TLS *tls.Config
+
+	// Name names the emulator in Log.
+	Name string
+
+	// Log, if set, logs every call made through the proxy.
+	Log *rpcLog
+
+	// Record, if set, records every call made through the proxy, with
+	// its response.
+	Record *recorder
+
+	listener net.Listener
+	socket   net.Listener
+	server   *http.Server
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+// Start listens on a free local port and starts serving.
+func (p *Proxy) Start() error {
+	host := p.Host
+	if host == "" {
+		host = "localhost"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return err
+	}
+	p.listener = l
+	if p.Socket != "" {
+		if p.socket, err = net.Listen("unix", p.Socket); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	p.calls = make(map[string]int)
+	var bw *bandwidth
+	if p.Throttle != nil && p.Throttle.BytesPerSecond > 0 {
+		bw = &bandwidth{rate: p.Throttle.BytesPerSecond}
+	}
+
+	var h1, h2c http.Protocols
+	h1.SetHTTP1(true)
+	h2c.SetUnencryptedHTTP2(true)
+	h1Transport := &http.Transport{Protocols: &h1}
+	h2cTransport := &http.Transport{Protocols: &h2c}
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = p.Target
+		},
+		// Don't buffer streaming gRPC responses.
+		FlushInterval: -1,
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.ProtoMajor == 2 {
+				return h2cTransport.RoundTrip(r)
+			}
+			return h1Transport.RoundTrip(r)
+		}),
+	}
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	if p.TLS != nil {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	p.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p.Log != nil {
+				sw := &statusWriter{ResponseWriter: w}
+				w = sw
+				defer p.logCall(r, sw, time.Now())
+			}
+			if p.Record != nil {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				rw := &recordWriter{ResponseWriter: w}
+				w = rw
+				defer p.record(p.Record.reserve(), r, body, rw)
+			}
+			if p.Throttle != nil {
+				time.Sleep(p.Throttle.delay())
+			}
+			if bw != nil {
+				r.Body = &throttleReader{r.Body, bw}
+				w = &throttleWriter{w, bw}
+			}
+			if f := p.count(r); f != nil {
+				f.inject(w, r)
+				return
+			}
+			rp.ServeHTTP(w, r)
+		}),
+		Protocols: &protocols,
+		TLSConfig: p.TLS,
+	}
+	for _, l := range []net.Listener{p.listener, p.socket} {
+		if l == nil {
+			continue
+		}
+		if p.TLS != nil {
+			go p.server.ServeTLS(l, "", "")
+		} else {
+			go p.server.Serve(l)
+		}
+	}
+	return nil
+}
+
+// Addr returns the host:port the proxy listens on.
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Close stops the proxy.
+func (p *Proxy) Close() error {
+	return p.server.Close()
+}
+
+// logCall logs the call r, started at start, whose response was written
+// to w.
+func (p *Proxy) logCall(r *http.Request, w *statusWriter, start time.Time) {
+	status := grpcStatus(w.Header())
+	if status == "" && w.status == 0 {
+		status = "200" // nothing written
+	} else if status == "" {
+		status = strconv.Itoa(w.status)
+	}
+	err := recover()
+	if err != nil {
+		status = "dropped"
+	}
+	p.Log.log(start, p.Name, callName(r), callResource(r), time.Since(start), status)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// record records the call r, with request body req, whose response was
+// written to w, in the recorder's place i. Dropped calls are not recorded.
+func (p *Proxy) record(i int, r *http.Request, req []byte, w *recordWriter) {
+	if err := recover(); err != nil {
+		panic(err)
+	}
+	p.Record.set(i, w.exchange(p.Name, r, req))
+}
+
+// count counts the call r, and returns the fault to inject into it, if any.
+func (p *Proxy) count(r *http.Request) *Fault {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	call := callName(r)
+	p.calls[call]++
+	for _, f := range p.Faults {
+		if f.applies(call) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Calls returns the number of calls made through the proxy, by method name.
+func (p *Proxy) Calls() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	calls := make(map[string]int, len(p.calls))
+	for k, v := range p.calls {
+		calls[k] = v
+	}
+	return calls
+}
+
+// Total returns the number of calls made through the proxy.
+func (p *Proxy) Total() int {
+	n := 0
+	for _, v := range p.Calls() {
+		n += v
+	}
+	return n
+}
+
+// callName names the API method called by r, e.g. "Commit" for both
+// "/google.datastore.v1.Datastore/Commit" (gRPC) and
+// "/v1/projects/p:commit" (REST). REST calls without a custom verb are
+// named by HTTP method and collection, e.g. "GET topics".
+func callName(r *http.Request) string {
+	path := r.URL.Path
+	if isGRPC(r) {
+		return path[strings.LastIndex(path, "/")+1:]
+	}
+	if i := strings.LastIndex(path, ":"); i >= 0 && i < len(path)-1 {
+		verb := path[i+1:]
+		return strings.ToUpper(verb[:1]) + verb[1:]
+	}
+	// After the version, paths alternate between collections and IDs, as
+	// in v1/projects/p/topics/t, so the collection is at the last odd index.
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	i := len(parts) - 1
+	if i%2 == 0 {
+		i--
+	}
+	if i > 0 {
+		return r.Method + " " + parts[i]
+	}
+	return r.Method + " " + path
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// socketEnv returns the variable holding the path of the Unix socket in
+// front of the emulator whose address is in hostEnv, e.g.
+// PUBSUB_EMULATOR_SOCKET for PUBSUB_EMULATOR_HOST.
+func socketEnv(hostEnv string) string {
+	return strings.TrimSuffix(hostEnv, "_HOST") + "_SOCKET"
+}
+
+// replaceEnv returns env with every occurrence of old in its values replaced
+// by new. It is used to point clients at a proxy instead of an emulator.
+func replaceEnv(env []string, old, new string) []string {
+	out := make([]string, len(env))
+	for i, kv := range env {
+		if j := strings.Index(kv, "="); j >= 0 {
+			kv = kv[:j+1] + strings.Replace(kv[j+1:], old, new, -1)
+		}
+		out[i] = kv
+	}
+	return out
+}
+
+// replaceEmulatorEnv is like replaceEnv, but only replaces old in the
+// variables that emulatorEnv sets, an emulator's variables and their
+// aliases, leaving the rest of the environment as it was.
+func replaceEmulatorEnv(env, emulatorEnv []string, old, new string) []string {
+	names := make(map[string]bool)
+	for _, kv := range emulatorEnv {
+		k, _ := splitEnv(kv)
+		names[k] = true
+	}
+	out := make([]string, len(env))
+	for i, kv := range env {
+		if k, v := splitEnv(kv); names[k] {
+			kv = k + "=" + strings.Replace(v, old, new, -1)
+		}
+		out[i] = kv
+	}
+	return out
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// formatCalls formats call counts for logging, e.g. "Commit=2 Lookup=1".
+func formatCalls(calls map[string]int) string {
+	var s []string
+	for k, v := range calls {
+		s = append(s, k+"="+strconv.Itoa(v))
+	}
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,344 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyCounts(t *testing.T) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	backend.Config.Protocols = &protocols
+	backend.Start()
+	defer backend.Close()
+
+	p := &Proxy{Target: strings.TrimPrefix(backend.URL, "http://")}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	for _, tt := range []struct {
+		client      *http.Client
+		path        string
+		contentType string
+		wantProto   string
+	}{
+		{http.DefaultClient, "/v1/projects/p:commit", "application/json", "HTTP/1.1"},
+		{http.DefaultClient, "/v1/projects/p/topics/t", "application/json", "HTTP/1.1"},
+		{&http.Client{Transport: &http.Transport{Protocols: &h2c}}, "/google.datastore.v1.Datastore/Lookup", "application/grpc", "HTTP/2.0"},
+	} {
+		resp, err := tt.client.Post("http://"+p.Addr()+tt.path, tt.contentType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Proto"); got != tt.wantProto {
+			t.Errorf("%s: backend saw %s, want %s", tt.path, got, tt.wantProto)
+		}
+	}
+
+	want := map[string]int{"Commit": 1, "POST topics": 1, "Lookup": 1}
+	if got := p.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Calls() = %v, want %v", got, want)
+	}
+}
+
+func TestProxyFaults(t *testing.T) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.Protocols = &protocols
+	backend.Start()
+	defer backend.Close()
+
+	p := &Proxy{
+		Target: strings.TrimPrefix(backend.URL, "http://"),
+		Faults: []*Fault{
+			{Method: "Commit", Error: "UNAVAILABLE", Times: 1},
+			{Method: "Lookup", Error: "DEADLINE_EXCEEDED"},
+			{Method: "RunQuery", Drop: true},
+		},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	grpc := &http.Client{Transport: &http.Transport{Protocols: &h2c}}
+	for _, tt := range []struct {
+		client      *http.Client
+		path        string
+		contentType string
+		wantStatus  int
+		wantGRPC    string // Grpc-Status trailer
+		wantErr     bool
+	}{
+		{http.DefaultClient, "/v1/projects/p:commit", "application/json", 503, "", false},
+		{http.DefaultClient, "/v1/projects/p:commit", "application/json", 200, "", false}, // Times exhausted
+		{grpc, "/google.datastore.v1.Datastore/Lookup", "application/grpc", 200, "4", false},
+		{http.DefaultClient, "/v1/projects/p:runQuery", "application/json", 0, "", true},
+	} {
+		resp, err := tt.client.Post("http://"+p.Addr()+tt.path, tt.contentType, nil)
+		if tt.wantErr {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: got %s, want dropped connection", tt.path, resp.Status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+		}
+		got := resp.Trailer.Get("Grpc-Status")
+		if got == "" {
+			got = resp.Header.Get("Grpc-Status")
+		}
+		if got != tt.wantGRPC {
+			t.Errorf("%s: Grpc-Status %q, want %q", tt.path, got, tt.wantGRPC)
+		}
+	}
+}
+
+func TestProxyLog(t *testing.T) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPC(r) {
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write([]byte{0, 0, 0, 0, 0})
+			w.Header().Set("Grpc-Status", "5")
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+	}))
+	backend.Config.Protocols = &protocols
+	backend.Start()
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	l := &rpcLog{w: &buf}
+	p := &Proxy{Target: strings.TrimPrefix(backend.URL, "http://"), Name: "pubsub", Log: l}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	resp, err := http.Post("http://"+p.Addr()+"/v1/projects/p/topics/t:publish", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	req, _ := http.NewRequest("POST", "http://"+p.Addr()+"/google.pubsub.v1.Subscriber/Pull", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("X-Goog-Request-Params", "subscription=projects%2Fp%2Fsubscriptions%2Fs")
+	resp, err = (&http.Client{Transport: &http.Transport{Protocols: &h2c}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Calls are logged once their handlers return, which may be after the
+	// client has read the response.
+	want := []string{
+		"pubsub Publish projects/p/topics/t 409",
+		"pubsub Pull projects/p/subscriptions/s NOT_FOUND",
+	}
+	var lines []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+		l.mu.Unlock()
+		if len(lines) == len(want) {
+			break
+		}
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %q, want %d lines", lines, len(want))
+	}
+	var got []string
+	for _, line := range lines {
+		// Drop the time and latency.
+		f := strings.Fields(line)
+		got = append(got, strings.Join(append(f[1:len(f)-2], f[len(f)-1]), " "))
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestProxyThrottle(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 20000))
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		throttle Throttle
+		min      time.Duration
+	}{
+		{Throttle{Latency: Duration(50 * time.Millisecond), Jitter: Duration(10 * time.Millisecond)}, 40 * time.Millisecond},
+		{Throttle{BytesPerSecond: 100000}, 150 * time.Millisecond}, // 20kB at 100kB/s
+	} {
+		throttle := tt.throttle
+		p := &Proxy{Target: strings.TrimPrefix(backend.URL, "http://"), Throttle: &throttle}
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		resp, err := http.Get("http://" + p.Addr() + "/v1/projects/p/topics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		elapsed := time.Since(start)
+		p.Close()
+		if len(b) != 20000 {
+			t.Errorf("%+v: got %d bytes, want 20000", tt.throttle, len(b))
+		}
+		if elapsed < tt.min {
+			t.Errorf("%+v: call took %v, want at least %v", tt.throttle, elapsed, tt.min)
+		}
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	backend.Config.Protocols = &protocols
+	backend.Start()
+	defer backend.Close()
+
+	ca, err := newLocalCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.serverCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{
+		Target: strings.TrimPrefix(backend.URL, "http://"),
+		TLS:    &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, h2 := range []bool{false, true} {
+		var client http.Protocols
+		client.SetHTTP1(!h2)
+		client.SetHTTP2(h2)
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.Pool()},
+			Protocols:       &client,
+		}}
+		resp, err := c.Get("https://" + p.Addr() + "/v1/projects/p/topics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		want := "HTTP/1.1"
+		if h2 {
+			want = "HTTP/2.0"
+		}
+		if resp.Proto != want || resp.Header.Get("X-Proto") != want {
+			t.Errorf("got %s, backend saw %s, want %s", resp.Proto, resp.Header.Get("X-Proto"), want)
+		}
+	}
+}
+
+func TestProxySocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := &Proxy{
+		Target: strings.TrimPrefix(backend.URL, "http://"),
+		Socket: filepath.Join(t.TempDir(), "pubsub.sock"),
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", p.Socket)
+		},
+	}}
+	resp, err := c.Get("http://unix/v1/projects/p/topics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "ok" {
+		t.Errorf("got %q, want ok", b)
+	}
+	if got := p.Calls()["GET topics"]; got != 1 {
+		t.Errorf("counted %d calls, want 1", got)
+	}
+}
+
+func TestReplaceEmulatorEnv(t *testing.T) {
+	env := []string{
+		"PUBSUB_EMULATOR_HOST=localhost:8085",
+		"MYAPP_PUBSUB_ADDR=localhost:8085",
+		"MYAPP_UPSTREAM=http://localhost:8085/v1",
+		"DATASTORE_EMULATOR_HOST=localhost:8081",
+	}
+	emulatorEnv := []string{"PUBSUB_EMULATOR_HOST=localhost:8085", "MYAPP_PUBSUB_ADDR=localhost:8085"}
+	want := []string{
+		"PUBSUB_EMULATOR_HOST=127.0.0.1:40000",
+		"MYAPP_PUBSUB_ADDR=127.0.0.1:40000",
+		"MYAPP_UPSTREAM=http://localhost:8085/v1",
+		"DATASTORE_EMULATOR_HOST=localhost:8081",
+	}
+	if got := replaceEmulatorEnv(env, emulatorEnv, "localhost:8085", "127.0.0.1:40000"); !reflect.DeepEqual(got, want) {
+		t.Errorf("replaceEmulatorEnv = %q, want %q", got, want)
+	}
+}
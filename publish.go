@@ -0,0 +1,95 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// publishMain implements the publish subcommand, which publishes a message
+// to a topic of a running session, and prints its ID.
+func publishMain(args []string) int {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	project := fs.String("project", "", "Project of the topic (default: the session's)")
+	topic := fs.String("topic", "", "Topic to publish to")
+	data := fs.String("data", "", "Message data, or - to read it from stdin")
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the emulator")
+	var attrs stringsFlag
+	fs.Var(&attrs, "attr", "Message attribute, as KEY=VALUE (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *topic == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: with_emulators publish -topic TOPIC -data DATA|- [-attr KEY=VALUE...]")
+		return 2
+	}
+	attributes := make(map[string]string)
+	for _, a := range attrs {
+		i := strings.Index(a, "=")
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "publish: invalid -attr %q, want KEY=VALUE\n", a)
+			return 2
+		}
+		attributes[a[:i]] = a[i+1:]
+	}
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		return 1
+	}
+	ps := st.emulator("pubsub")
+	if ps == nil {
+		fmt.Fprintf(os.Stderr, "publish: session %d has no pubsub emulator\n", st.PID)
+		return 1
+	}
+	if *project == "" {
+		*project = st.project()
+	}
+	msg := []byte(*data)
+	if *data == "-" {
+		if msg, err = ioutil.ReadAll(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+			return 1
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	id, err := Publish(ctx, ps.Endpoint, *project, *topic, msg, attributes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		return 1
+	}
+	fmt.Println(id)
+	return 0
+}
+
+// Publish publishes a message to topic in project on the Pub/Sub emulator
+// at host, and returns its ID.
+func Publish(ctx context.Context, host, project, topic string, data []byte, attrs map[string]string) (string, error) {
+	msg := map[string]interface{}{"data": base64.StdEncoding.EncodeToString(data)}
+	if len(attrs) > 0 {
+		msg["attributes"] = attrs
+	}
+	var resp struct {
+		MessageIDs []string `json:"messageIds"`
+	}
+	body := map[string]interface{}{"messages": []interface{}{msg}}
+	if err := pubsubCall(ctx, "POST", host, "projects/"+project+"/topics/"+topic+":publish", body, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.MessageIDs) != 1 {
+		return "", fmt.Errorf("publish returned %d message IDs", len(resp.MessageIDs))
+	}
+	return resp.MessageIDs[0], nil
+}
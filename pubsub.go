@@ -0,0 +1,208 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Topic is a Pub/Sub topic created before the command runs, along with
+// its subscriptions.
+type Topic struct {
+	Name          string         `json:"name"`
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// Subscription is a Pub/Sub subscription to a Topic.
+type Subscription struct {
+	Name string `json:"name"`
+
+	// AckDeadline is how long the emulator waits for an ack before
+	// redelivering a message. Defaults to the emulator's, 10s.
+	AckDeadline Duration `json:"ackDeadline"`
+
+	// PushEndpoint, if set, is a URL that messages are delivered to as
+	// push requests, as with a push subscription in production. See
+	// pushBridge.
+	PushEndpoint string `json:"pushEndpoint"`
+}
+
+func (t Topic) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("topic without a name")
+	}
+	for _, s := range t.Subscriptions {
+		if s.Name == "" {
+			return fmt.Errorf("topic %s: subscription without a name", t.Name)
+		}
+		d := time.Duration(s.AckDeadline)
+		if d != 0 && (d < 10*time.Second || d > 600*time.Second) {
+			return fmt.Errorf("subscription %s: ackDeadline %v not between 10s and 600s", s.Name, d)
+		}
+		if s.PushEndpoint != "" {
+			u, err := url.Parse(s.PushEndpoint)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("subscription %s: pushEndpoint %q is not an http or https URL", s.Name, s.PushEndpoint)
+			}
+		}
+	}
+	return nil
+}
+
+// CreateTopics creates topics and their subscriptions on the Pub/Sub
+// emulator at host. Topics and subscriptions that already exist are left
+// as they are.
+func CreateTopics(ctx context.Context, host, project string, topics []Topic) error {
+	for _, t := range topics {
+		topic := "projects/" + project + "/topics/" + t.Name
+		if err := pubsubPut(ctx, host, topic, nil); err != nil {
+			return fmt.Errorf("topic %s: %v", t.Name, err)
+		}
+		for _, s := range t.Subscriptions {
+			body := map[string]interface{}{"topic": topic}
+			if s.AckDeadline != 0 {
+				body["ackDeadlineSeconds"] = int(time.Duration(s.AckDeadline) / time.Second)
+			}
+			if err := pubsubPut(ctx, host, "projects/"+project+"/subscriptions/"+s.Name, body); err != nil {
+				return fmt.Errorf("subscription %s: %v", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ListTopics returns the topics of project on the Pub/Sub emulator at host,
+// with their subscriptions.
+func ListTopics(ctx context.Context, host, project string) ([]Topic, error) {
+	var topics []Topic
+	index := make(map[string]int) // full topic name to index in topics
+	token := ""
+	for {
+		var resp struct {
+			Topics []struct {
+				Name string `json:"name"`
+			} `json:"topics"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := pubsubCall(ctx, "GET", host, "projects/"+project+"/topics?pageToken="+url.QueryEscape(token), nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, t := range resp.Topics {
+			index[t.Name] = len(topics)
+			topics = append(topics, Topic{Name: path.Base(t.Name)})
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for {
+		var resp struct {
+			Subscriptions []struct {
+				Name               string `json:"name"`
+				Topic              string `json:"topic"`
+				AckDeadlineSeconds int    `json:"ackDeadlineSeconds"`
+			} `json:"subscriptions"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := pubsubCall(ctx, "GET", host, "projects/"+project+"/subscriptions?pageToken="+url.QueryEscape(token), nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, s := range resp.Subscriptions {
+			i, ok := index[s.Topic]
+			if !ok {
+				continue // the topic was deleted, or is in another project
+			}
+			topics[i].Subscriptions = append(topics[i].Subscriptions, Subscription{
+				Name:        path.Base(s.Name),
+				AckDeadline: Duration(time.Duration(s.AckDeadlineSeconds) * time.Second),
+			})
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	return topics, nil
+}
+
+// pubsubPut creates the Pub/Sub resource with the given name.
+func pubsubPut(ctx context.Context, host, name string, body interface{}) error {
+	if body == nil {
+		body = struct{}{}
+	}
+	err := pubsubCall(ctx, "PUT", host, name, body, nil)
+	if err, ok := err.(*statusError); ok && err.code == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// statusError is returned by pubsubCall for an unexpected HTTP status.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s: %s", e.code, http.StatusText(e.code), e.msg)
+}
+
+// pubsubCall calls the Pub/Sub REST API method on the emulator at host,
+// e.g. "projects/p/subscriptions/s:pull", decoding the response into
+// result if it is not nil. A nil body sends no request body.
+func pubsubCall(ctx context.Context, httpMethod, host, method string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	query := ""
+	if i := strings.Index(method, "?"); i >= 0 {
+		method, query = method[:i], method[i:]
+	}
+	u := "http://" + host + "/v1/" + (&url.URL{Path: method}).EscapedPath() + query
+	req, err := http.NewRequest(httpMethod, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{resp.StatusCode, string(bytes.TrimSpace(msg))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// createTopics creates the topics listed in cfg.Topics.
+func createTopics(ctx context.Context, cfg *Config, env []string) error {
+	if len(cfg.Topics) == 0 {
+		return nil
+	}
+	host := lookupEnv(env, "PUBSUB_EMULATOR_HOST")
+	if host == "" {
+		return fmt.Errorf("PUBSUB_EMULATOR_HOST not set")
+	}
+	return CreateTopics(ctx, host, sessionProject(cfg, env), cfg.Topics)
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateTopics(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = append(got, r.Method+" "+r.URL.Path+" "+string(b))
+		if strings.HasSuffix(r.URL.Path, "/existing") {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer srv.Close()
+
+	topics := []Topic{{
+		Name: "orders",
+		Subscriptions: []Subscription{
+			{Name: "worker", AckDeadline: Duration(30 * time.Second)},
+			{Name: "existing"},
+		},
+	}}
+	if err := CreateTopics(context.Background(), strings.TrimPrefix(srv.URL, "http://"), "p", topics); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`PUT /v1/projects/p/topics/orders {}`,
+		`PUT /v1/projects/p/subscriptions/worker {"ackDeadlineSeconds":30,"topic":"projects/p/topics/orders"}`,
+		`PUT /v1/projects/p/subscriptions/existing {"topic":"projects/p/topics/orders"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestTopicValidate(t *testing.T) {
+	for _, tt := range []struct {
+		topic Topic
+		ok    bool
+	}{
+		{Topic{Name: "t"}, true},
+		{Topic{}, false},
+		{Topic{Name: "t", Subscriptions: []Subscription{{}}}, false},
+		{Topic{Name: "t", Subscriptions: []Subscription{{Name: "s", AckDeadline: Duration(time.Second)}}}, false},
+		{Topic{Name: "t", Subscriptions: []Subscription{{Name: "s", AckDeadline: Duration(time.Minute)}}}, true},
+	} {
+		if err := tt.topic.validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v.validate() = %v, want ok = %v", tt.topic, err, tt.ok)
+		}
+	}
+}
+
+func TestPushBridge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var acked, nacked []string
+	pulled := false
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var body struct{ AckIDs []string }
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/projects/p/subscriptions/s:pull":
+			if pulled {
+				<-r.Context().Done() // no more messages; block like a long poll
+				return
+			}
+			pulled = true
+			io.WriteString(w, `{"receivedMessages": [
+				{"ackId": "1", "message": {"data": "aGk=", "messageId": "m1"}},
+				{"ackId": "2", "message": {"data": "ZmFpbA==", "messageId": "m2"}}
+			]}`)
+		case "/v1/projects/p/subscriptions/s:acknowledge":
+			acked = append(acked, body.AckIDs...)
+		case "/v1/projects/p/subscriptions/s:modifyAckDeadline":
+			nacked = append(nacked, body.AckIDs...)
+			cancel()
+		}
+	}))
+	defer emulator.Close()
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req pushRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Subscription != "projects/p/subscriptions/s" {
+			t.Errorf("push for subscription %q", req.Subscription)
+		}
+		if req.Message.MessageID == "m2" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}
+	}))
+	defer endpoint.Close()
+
+	b := &pushBridge{
+		Host:         strings.TrimPrefix(emulator.URL, "http://"),
+		Subscription: "projects/p/subscriptions/s",
+		Endpoint:     endpoint.URL,
+		Client:       http.DefaultClient,
+	}
+	b.Run(ctx)
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(acked, []string{"1"}) || !reflect.DeepEqual(nacked, []string{"2"}) {
+		t.Errorf("acked %v, nacked %v; want [1], [2]", acked, nacked)
+	}
+}
+
+func TestListTopics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/v1/projects/p/topics?pageToken=":
+			io.WriteString(w, `{"topics": [{"name": "projects/p/topics/a"}], "nextPageToken": "x"}`)
+		case "/v1/projects/p/topics?pageToken=x":
+			io.WriteString(w, `{"topics": [{"name": "projects/p/topics/b"}]}`)
+		case "/v1/projects/p/subscriptions?pageToken=":
+			io.WriteString(w, `{"subscriptions": [
+				{"name": "projects/p/subscriptions/s", "topic": "projects/p/topics/b", "ackDeadlineSeconds": 30},
+				{"name": "projects/p/subscriptions/orphan", "topic": "_deleted-topic_"}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	got, err := ListTopics(context.Background(), strings.TrimPrefix(srv.URL, "http://"), "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Topic{
+		{Name: "a"},
+		{Name: "b", Subscriptions: []Subscription{{Name: "s", AckDeadline: Duration(30 * time.Second)}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTopics = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pushBridge delivers the messages of a Pub/Sub emulator subscription to
+// an HTTP endpoint, in the format of production push subscriptions, so
+// that services built around push delivery can be tested unchanged.
+// It pulls messages and acks those the endpoint accepts; the others are
+// nacked, to be redelivered.
+type pushBridge struct {
+	Host         string // the Pub/Sub emulator
+	Subscription string // e.g. "projects/p/subscriptions/s"
+	Endpoint     string
+	Client       *http.Client
+}
+
+// pushRequest is the body of a push request.
+type pushRequest struct {
+	Message      pushMessage `json:"message"`
+	Subscription string      `json:"subscription"`
+}
+
+type pushMessage struct {
+	Data        string            `json:"data,omitempty"` // base64
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	MessageID   string            `json:"messageId"`
+	PublishTime string            `json:"publishTime"`
+}
+
+// pushRetryDelay is how long the bridge waits after a failure before
+// pulling again, so that a down endpoint isn't hammered.
+const pushRetryDelay = time.Second
+
+// Run delivers messages until ctx is done.
+func (b *pushBridge) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		var resp struct {
+			ReceivedMessages []struct {
+				AckID   string      `json:"ackId"`
+				Message pushMessage `json:"message"`
+			} `json:"receivedMessages"`
+		}
+		err := pubsubCall(ctx, "POST", b.Host, b.Subscription+":pull", map[string]interface{}{"maxMessages": 10}, &resp)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Push bridge could not pull", "subscription", b.Subscription, "err", err)
+				sleep(ctx, pushRetryDelay)
+			}
+			continue
+		}
+		var acks, nacks []string
+		for _, m := range resp.ReceivedMessages {
+			if err := b.deliver(ctx, m.Message); err != nil {
+				if verbose.any() {
+					slog.Warn("Push bridge could not deliver message", "subscription", b.Subscription, "message", m.Message.MessageID, "err", err)
+				}
+				nacks = append(nacks, m.AckID)
+				continue
+			}
+			acks = append(acks, m.AckID)
+		}
+		if len(acks) > 0 {
+			pubsubCall(ctx, "POST", b.Host, b.Subscription+":acknowledge", map[string]interface{}{"ackIds": acks}, nil)
+		}
+		if len(nacks) > 0 {
+			pubsubCall(ctx, "POST", b.Host, b.Subscription+":modifyAckDeadline",
+				map[string]interface{}{"ackIds": nacks, "ackDeadlineSeconds": 0}, nil)
+			sleep(ctx, pushRetryDelay)
+		}
+	}
+}
+
+// deliver posts m to the endpoint. As in production, a 102, 200, 201, 202
+// or 204 response acknowledges the message.
+func (b *pushBridge) deliver(ctx context.Context, m pushMessage) error {
+	body, err := json.Marshal(pushRequest{m, b.Subscription})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", b.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusProcessing, http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
+		return nil
+	}
+	return fmt.Errorf("%s: %s", b.Endpoint, resp.Status)
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// startPushBridges starts a pushBridge for each subscription in cfg.Topics
+// with a PushEndpoint. The returned function stops them.
+func startPushBridges(cfg *Config, env []string) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	host := lookupEnv(env, "PUBSUB_EMULATOR_HOST")
+	project := sessionProject(cfg, env)
+	client := &http.Client{Timeout: time.Minute}
+	for _, t := range cfg.Topics {
+		for _, s := range t.Subscriptions {
+			if s.PushEndpoint == "" {
+				continue
+			}
+			b := &pushBridge{
+				Host:         host,
+				Subscription: "projects/" + project + "/subscriptions/" + s.Name,
+				Endpoint:     s.PushEndpoint,
+				Client:       client,
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.Run(ctx)
+			}()
+		}
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// hasPushEndpoints reports whether cfg needs push bridges.
+func hasPushEndpoints(cfg *Config) bool {
+	for _, t := range cfg.Topics {
+		for _, s := range t.Subscriptions {
+			if s.PushEndpoint != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReadyFile is written to the -ready-file path once a session's emulators
+// and configured resources are ready, for build systems and orchestrators
+// to synchronize on.
+type ReadyFile struct {
+	PID       int               `json:"pid"`       // the with_emulators process
+	Emulators map[string]string `json:"emulators"` // emulator name to host:port
+	Env       map[string]string `json:"env"`       // as printed by "with_emulators env"
+}
+
+// newReadyFile returns the ready file for st.
+func newReadyFile(st *State) *ReadyFile {
+	rf := &ReadyFile{PID: st.PID, Emulators: make(map[string]string), Env: make(map[string]string)}
+	for _, e := range st.Emulators {
+		rf.Emulators[e.Name] = e.Endpoint
+	}
+	for _, kv := range st.env() {
+		k, v := splitEnv(kv)
+		rf.Env[k] = v
+	}
+	return rf
+}
+
+// Write writes the ready file to path. It is renamed into place, so
+// readers never see it partially written.
+func (rf *ReadyFile) Write(path string) error {
+	b, err := json.MarshalIndent(rf, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readyFilePollInterval is how often waitReadyFile checks for the file.
+const readyFilePollInterval = 100 * time.Millisecond
+
+// waitReadyFile waits until the ready file at path exists, and returns it.
+func waitReadyFile(ctx context.Context, path string) (*ReadyFile, error) {
+	for {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			rf := &ReadyFile{}
+			if err := json.Unmarshal(b, rf); err != nil {
+				return nil, err
+			}
+			return rf, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		sleep(ctx, readyFilePollInterval)
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+}
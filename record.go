@@ -0,0 +1,286 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording is the traffic between a command and the emulators, written
+// by -record and served by -replay without starting the emulators.
+type Recording struct {
+	Env       []string          `json:"env,omitempty"` // variables not specific to an emulator
+	Projects  map[string]string `json:"projects,omitempty"`
+	Emulators []EmulatorState   `json:"emulators"`
+	Exchanges []*Exchange       `json:"exchanges"`
+}
+
+// Exchange is a recorded call and its response.
+type Exchange struct {
+	Emulator string      `json:"emulator"`
+	Method   string      `json:"method"` // HTTP method
+	URI      string      `json:"uri"`
+	Request  []byte      `json:"request,omitempty"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     []byte      `json:"body,omitempty"`
+	Trailer  http.Header `json:"trailer,omitempty"`
+}
+
+// key identifies the calls that e answers.
+func (e *Exchange) key() string {
+	return exchangeKey(e.Method, e.URI, e.Request)
+}
+
+func exchangeKey(method, uri string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + " " + uri + " " + hex.EncodeToString(sum[:8])
+}
+
+// recorder collects the exchanges made through proxies for -record.
+type recorder struct {
+	mu  sync.Mutex
+	rec Recording
+}
+
+func newRecorder(st *State) *recorder {
+	return &recorder{rec: Recording{Env: st.Env, Projects: st.Projects, Emulators: st.Emulators}}
+}
+
+// reserve reserves a place for the exchange of a call that just started,
+// so that exchanges are recorded in the order the calls were made.
+func (r *recorder) reserve() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rec.Exchanges = append(r.rec.Exchanges, nil)
+	return len(r.rec.Exchanges) - 1
+}
+
+// set records e in the place reserved for it.
+func (r *recorder) set(i int, e *Exchange) {
+	r.mu.Lock()
+	r.rec.Exchanges[i] = e
+	r.mu.Unlock()
+}
+
+// Save writes the recording to path.
+func (r *recorder) Save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := r.rec
+	rec.Exchanges = nil
+	for _, e := range r.rec.Exchanges {
+		if e != nil { // dropped, or still in progress
+			rec.Exchanges = append(rec.Exchanges, e)
+		}
+	}
+	b, err := json.MarshalIndent(&rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// recordWriter captures a response for a recorder.
+type recordWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (w *recordWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// exchange returns the recorded exchange, once the response is complete.
+func (w *recordWriter) exchange(emulator string, r *http.Request, req []byte) *Exchange {
+	e := &Exchange{
+		Emulator: emulator,
+		Method:   r.Method,
+		URI:      r.URL.RequestURI(),
+		Request:  req,
+		Status:   w.status,
+		Header:   make(http.Header),
+		Body:     w.body.Bytes(),
+	}
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	announced := make(map[string]bool)
+	for _, v := range w.Header()["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			announced[http.CanonicalHeaderKey(strings.TrimSpace(k))] = true
+		}
+	}
+	for k, v := range w.Header() {
+		switch {
+		case k == "Trailer" || k == "Content-Length":
+		case strings.HasPrefix(k, http.TrailerPrefix):
+			e.addTrailer(strings.TrimPrefix(k, http.TrailerPrefix), v)
+		case announced[k]:
+			e.addTrailer(k, v)
+		default:
+			e.Header[k] = v
+		}
+	}
+	return e
+}
+
+func (e *Exchange) addTrailer(k string, v []string) {
+	if e.Trailer == nil {
+		e.Trailer = make(http.Header)
+	}
+	e.Trailer[http.CanonicalHeaderKey(k)] = v
+}
+
+// replayer serves the recorded responses of an emulator. Calls are matched
+// by method, URI and request body; repeated calls get the recorded
+// responses in order, then the last one again.
+type replayer struct {
+	name     string
+	listener net.Listener
+	server   *http.Server
+
+	mu      sync.Mutex
+	answers map[string][]*Exchange
+}
+
+func startReplayer(name string, exchanges []*Exchange) (*replayer, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	rp := &replayer{name: name, listener: l, answers: make(map[string][]*Exchange)}
+	for _, e := range exchanges {
+		rp.answers[e.key()] = append(rp.answers[e.key()], e)
+	}
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	rp.server = &http.Server{Handler: rp, Protocols: &protocols}
+	go rp.server.Serve(l)
+	return rp, nil
+}
+
+func (rp *replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	e := rp.next(exchangeKey(r.Method, r.URL.RequestURI(), body))
+	if e == nil {
+		slog.Warn("No recorded response", "emulator", rp.name, "call", callName(r), "uri", r.URL.RequestURI())
+		msg := "with_emulators: no recorded response for this call"
+		if isGRPC(r) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", strconv.Itoa(grpcCodes["UNIMPLEMENTED"].code))
+			w.Header().Set("Grpc-Message", msg)
+			return
+		}
+		http.Error(w, msg, http.StatusNotImplemented)
+		return
+	}
+	for k, v := range e.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+	for k, v := range e.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+}
+
+func (rp *replayer) next(key string) *Exchange {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	answers := rp.answers[key]
+	if len(answers) == 0 {
+		return nil
+	}
+	if len(answers) > 1 {
+		rp.answers[key] = answers[1:]
+	}
+	return answers[0]
+}
+
+func (rp *replayer) Addr() string {
+	return rp.listener.Addr().String()
+}
+
+func (rp *replayer) Close() error {
+	return rp.server.Close()
+}
+
+// replaySession returns a session whose emulators are replayers serving
+// the -replay recording at path. args is the command the session is for.
+func replaySession(path string, args []string) (*Session, error) {
+	s := &Session{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return s, fmt.Errorf("%s: %v", path, err)
+	}
+	s.State = &State{
+		PID:      os.Getpid(),
+		Started:  time.Now(),
+		Command:  args,
+		Env:      rec.Env,
+		Projects: rec.Projects,
+	}
+	s.ProjectEnv = rec.Env
+	s.Env = append(inheritedEnv(), rec.Env...)
+	for _, st := range rec.Emulators {
+		var exchanges []*Exchange
+		for _, e := range rec.Exchanges {
+			if e.Emulator == st.Name {
+				exchanges = append(exchanges, e)
+			}
+		}
+		rp, err := startReplayer(st.Name, exchanges)
+		if err != nil {
+			return s, err
+		}
+		s.replayers = append(s.replayers, rp)
+		st.Env = replaceEnv(st.Env, st.Endpoint, rp.Addr())
+		st.Endpoint = rp.Addr()
+		st.PID = 0
+		s.State.Emulators = append(s.State.Emulators, st)
+		s.EmulatorEnv = append(s.EmulatorEnv, st.Env)
+		s.Env = append(s.Env, st.Env...)
+	}
+	return s, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	n := 0
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		body, _ := ioutil.ReadAll(r.Body)
+		if isGRPC(r) {
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write(body)
+			w.Header().Set("Grpc-Status", "0")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"n":` + string(rune('0'+n)) + `}`))
+	}))
+	backend.Config.Protocols = &protocols
+	backend.Start()
+	defer backend.Close()
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	grpc := &http.Client{Transport: &http.Transport{Protocols: &h2c}}
+	type result struct{ body, grpcStatus string }
+	calls := func(addr string) []result {
+		var results []result
+		for _, c := range []struct {
+			client      *http.Client
+			path, body  string
+			contentType string
+		}{
+			{http.DefaultClient, "/v1/projects/p:lookup", `{"keys":[1]}`, "application/json"},
+			{http.DefaultClient, "/v1/projects/p:lookup", `{"keys":[1]}`, "application/json"},
+			{http.DefaultClient, "/v1/projects/p:lookup", `{"keys":[2]}`, "application/json"},
+			{grpc, "/google.datastore.v1.Datastore/Lookup", "\x00\x00\x00\x00\x01x", "application/grpc"},
+		} {
+			resp, err := c.client.Post("http://"+addr+c.path, c.contentType, strings.NewReader(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			results = append(results, result{string(b), resp.Trailer.Get("Grpc-Status")})
+		}
+		return results
+	}
+
+	rec := newRecorder(&State{})
+	p := &Proxy{Target: strings.TrimPrefix(backend.URL, "http://"), Name: "datastore", Record: rec}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	want := calls(p.Addr())
+
+	// Exchanges are recorded once their handlers return, which may be
+	// after the client has read the response.
+	var exchanges []*Exchange
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		exchanges = nil
+		rec.mu.Lock()
+		for _, e := range rec.rec.Exchanges {
+			if e != nil {
+				exchanges = append(exchanges, e)
+			}
+		}
+		rec.mu.Unlock()
+		if len(exchanges) == len(want) {
+			break
+		}
+	}
+	if len(exchanges) != len(want) {
+		t.Fatalf("recorded %d exchanges, want %d", len(exchanges), len(want))
+	}
+
+	rp, err := startReplayer("datastore", exchanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+	got := calls(rp.Addr())
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("call %d: replayed %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// A call that was not recorded fails.
+	resp, err := http.Post("http://"+rp.Addr()+"/v1/projects/p:commit", "application/json", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("unrecorded call: status %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The registry records the ports and data directories claimed by the user's
+// running sessions, so that concurrent sessions never pick the same ones: a
+// port that freeHostPort finds free may be taken by another session's
+// emulator before it starts listening, and emulators sharing gcloud's
+// default data directory overwrite each other's data.
+type registry struct {
+	path   string
+	unlock func()
+
+	// Claims maps the PIDs of sessions to what they claimed.
+	Claims map[string]*claim `json:"claims"`
+}
+
+type claim struct {
+	Ports    []string `json:"ports"`
+	DataDirs []string `json:"dataDirs"`
+}
+
+func registryPath() string {
+	return filepath.Join(stateDir(), "registry.json")
+}
+
+// openRegistry locks and reads the registry, dropping the claims of
+// sessions that no longer exist. The caller must close it.
+func openRegistry(ctx context.Context) (*registry, error) {
+	if err := makeStateDir(); err != nil {
+		return nil, err
+	}
+	r := &registry{path: registryPath()}
+	var err error
+	if r.unlock, err = lockFile(ctx, r.path+".lock"); err != nil {
+		return nil, fmt.Errorf("could not lock port registry: %v", err)
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		r.unlock()
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, r); err != nil {
+			// Start over rather than fail every session.
+			r.Claims = nil
+		}
+	}
+	if r.Claims == nil {
+		r.Claims = make(map[string]*claim)
+	}
+	for pid := range r.Claims {
+		if n, err := strconv.Atoi(pid); err != nil || !processAlive(n) {
+			delete(r.Claims, pid)
+		}
+	}
+	return r, nil
+}
+
+// Close writes the registry and unlocks it.
+func (r *registry) Close() error {
+	defer r.unlock()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// owner returns the PID of another session that claimed the port of
+// hostPort, or with port false, the data directory dir; or 0 if none did.
+func (r *registry) owner(v string, port bool) int {
+	if port {
+		if _, p, err := net.SplitHostPort(v); err == nil {
+			v = p
+		}
+	}
+	self := strconv.Itoa(os.Getpid())
+	for pid, c := range r.Claims {
+		if pid == self {
+			continue
+		}
+		list := c.DataDirs
+		if port {
+			list = c.Ports
+		}
+		if contains(list, v) {
+			n, _ := strconv.Atoi(pid)
+			return n
+		}
+	}
+	return 0
+}
+
+// claim records that this session uses the port of hostPort, or with port
+// false, the data directory dir.
+func (r *registry) claim(v string, port bool) {
+	self := strconv.Itoa(os.Getpid())
+	c := r.Claims[self]
+	if c == nil {
+		c = &claim{}
+		r.Claims[self] = c
+	}
+	if port {
+		if _, p, err := net.SplitHostPort(v); err == nil {
+			v = p
+		}
+		c.Ports = append(c.Ports, v)
+	} else {
+		c.DataDirs = append(c.DataDirs, v)
+	}
+}
+
+// release removes this session's claim on the port of hostPort, or with
+// port false, the data directory dir.
+func (r *registry) release(v string, port bool) {
+	c := r.Claims[strconv.Itoa(os.Getpid())]
+	if c == nil {
+		return
+	}
+	list := &c.DataDirs
+	if port {
+		if _, p, err := net.SplitHostPort(v); err == nil {
+			v = p
+		}
+		list = &c.Ports
+	}
+	for i, w := range *list {
+		if w == v {
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			return
+		}
+	}
+}
+
+// freeHostPort is like the freeHostPort function, but skips ports claimed
+// by other sessions, and claims the port it returns.
+func (r *registry) freeHostPort(host string) (string, error) {
+	for i := 0; i < 100; i++ {
+		hp, err := freeHostPort(host)
+		if err != nil {
+			return "", err
+		}
+		if r.owner(hp, true) == 0 {
+			r.claim(hp, true)
+			return hp, nil
+		}
+	}
+	return "", fmt.Errorf("no free port that isn't claimed by another session")
+}
+
+// gcloudDataDir names gcloud's default data directory for an emulator in the
+// registry.
+func gcloudDataDir(name string) string {
+	return "gcloud:" + name
+}
+
+// releaseClaims removes this session's claims from the registry.
+func releaseClaims() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := openRegistry(ctx)
+	if err != nil {
+		return
+	}
+	delete(r.Claims, strconv.Itoa(os.Getpid()))
+	r.Close()
+}
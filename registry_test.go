@@ -0,0 +1,155 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSessionClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another live session, and one that exited without releasing its
+	// claims.
+	other := strconv.Itoa(os.Getppid())
+	b, _ := json.Marshal(map[string]interface{}{"claims": map[string]*claim{
+		other:      {Ports: []string{"8081"}, DataDirs: []string{gcloudDataDir("datastore")}},
+		"99999999": {Ports: []string{"8085"}},
+	}})
+	if err := ioutil.WriteFile(registryPath(), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s := &Session{Emulators: []*Emulator{{Name: "datastore", HostPort: "localhost:8081"}}}
+	if err := s.claim(ctx, s.Emulators, map[*Emulator]bool{}); err == nil || !strings.Contains(err.Error(), "PID "+other) {
+		t.Errorf("claiming a claimed port: got %v, want in use by PID %s", err, other)
+	}
+
+	ds := &Emulator{Name: "datastore"}
+	ps := &Emulator{Name: "pubsub", HostPort: "localhost:8085"}
+	s = &Session{Emulators: []*Emulator{ds, ps}}
+	freePort := make(map[*Emulator]bool)
+	if err := s.claim(ctx, s.Emulators, freePort); err != nil {
+		t.Fatal(err)
+	}
+	if !freePort[ds] || ds.HostPort == "" || strings.HasSuffix(ds.HostPort, ":8081") {
+		t.Errorf("datastore HostPort = %q, want a free port", ds.HostPort)
+	}
+	if ds.DataDir == "" || len(s.tempDirs) != 1 {
+		t.Errorf("datastore DataDir = %q, want a temporary one", ds.DataDir)
+	}
+
+	r, err := openRegistry(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, ok := r.Claims["99999999"]; ok {
+		t.Errorf("claims of an exited session were kept")
+	}
+	if pid := r.owner("localhost:8085", true); pid != 0 {
+		t.Errorf("pubsub port owned by PID %d, want this session", pid)
+	}
+	self := r.Claims[strconv.Itoa(os.Getpid())]
+	if self == nil || len(self.Ports) != 2 || !contains(self.DataDirs, ds.DataDir) {
+		t.Errorf("claims = %+v, want both ports and %s", self, ds.DataDir)
+	}
+}
+
+func TestStatusKeepsRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+
+	r, err := openRegistry(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.claim("localhost:8081", true)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	code := statusMain(nil)
+	os.Stdout.Close()
+	os.Stdout = stdout
+	if code != 0 {
+		t.Fatalf("status exited %d", code)
+	}
+
+	r, err = openRegistry(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if c := r.Claims[strconv.Itoa(os.Getpid())]; c == nil || !contains(c.Ports, "8081") {
+		t.Errorf("claims after status = %+v, want port 8081", c)
+	}
+}
+
+func TestRegistryPerUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the temp dir is per user on Windows")
+	}
+	tmp, restore := useTempStateDir(t)
+	defer restore()
+
+	// Another user's state dir, as shared by every user before it was
+	// per user.
+	other := filepath.Join(tmp, "with_emulators")
+	if err := os.Mkdir(other, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() == 0 {
+		if err := os.Chown(other, 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := os.Chmod(other, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(other, 0700)
+
+	ctx := context.Background()
+	r, err := openRegistry(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.claim("localhost:8081", true)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(registryPath(), filepath.Join(tmp, "with_emulators-")) {
+		t.Errorf("registry at %s, want in this user's state dir", registryPath())
+	}
+	unlock, err := lockFile(ctx, sharedLockPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reload applies cfg, a reloaded config, to the running session: it starts
+// the emulators that cfg adds, with their resources, stops those that it
+// removes, and applies its log filters. Other changes, such as to an
+// emulator's arguments, need a new session. The state file, and the
+// -env-file and -ready-file if written, are updated.
+func (s *Session) Reload(ctx context.Context, cfg *Config) (err error) {
+	if s.clientPath != "" || *backend == "remote" {
+		return fmt.Errorf("only sessions that started their emulators can reload")
+	}
+	s.span = startSpan("reload", nil)
+	defer func() { s.span.End(err) }()
+
+	configured, err := configureEmulators(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	var emulators, added, removed []*Emulator
+	for _, e := range configured {
+		if old := s.emulator(e.Name); old != nil {
+			old.SetLogFilter(e.LogFilter)
+			e = old
+		} else {
+			added = append(added, e)
+		}
+		emulators = append(emulators, e)
+	}
+	for _, e := range s.Emulators {
+		if findEmulator(configured, e.Name) == nil {
+			removed = append(removed, e)
+		}
+	}
+
+	if len(added) > 0 {
+		if err := s.startEmulators(ctx, cfg, added); err != nil {
+			for _, e := range added {
+				e.Stop()
+			}
+			releaseEmulators(added)
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.Emulators = emulators
+	s.mu.Unlock()
+	for _, e := range removed {
+		if err := e.Stop(); err != nil {
+			slog.Error("Could not stop emulator", "emulator", e.Name, "err", err)
+		}
+		os.Remove(e.LogPath)
+	}
+	releaseEmulators(removed)
+	if s.crashed != nil {
+		for _, e := range added {
+			go s.watch(e)
+		}
+	}
+
+	s.hooks = cfg.Hooks
+	s.setEnv(cfg, s.Emulators)
+	st := newState(s.State.Command, s.Emulators, s.EmulatorEnv)
+	st.Started, st.Log, st.Shared = s.State.Started, s.State.Log, s.State.Shared
+	st.Env = s.ProjectEnv
+	st.Projects = cfg.Projects
+	s.State = st
+	if _, err := s.State.Write(); err != nil {
+		return fmt.Errorf("could not write state file: %v", err)
+	}
+	if s.envPath != "" {
+		if err := writeEnvFile(s.envPath, s.State.env()); err != nil {
+			return fmt.Errorf("could not write env file: %v", err)
+		}
+	}
+	if s.readyPath != "" {
+		if err := newReadyFile(s.State).Write(s.readyPath); err != nil {
+			return fmt.Errorf("could not write ready file: %v", err)
+		}
+	}
+
+	// Only the added emulators are empty.
+	if findEmulator(added, "datastore") != nil {
+		if err := importDatastore(ctx, cfg, s.Env); err != nil {
+			return fmt.Errorf("could not import Datastore export: %v", err)
+		}
+		if err := seedFixtures(ctx, cfg, s.Env); err != nil {
+			return fmt.Errorf("could not load fixtures: %v", err)
+		}
+	}
+	if findEmulator(added, "pubsub") != nil {
+		if err := createTopics(ctx, cfg, s.Env); err != nil {
+			return fmt.Errorf("could not create topics: %v", err)
+		}
+	}
+	slog.Info("Reloaded config", "started", emulatorList(added), "stopped", emulatorList(removed))
+	return nil
+}
+
+// emulatorList returns the names of emulators, comma-separated, for logging.
+func emulatorList(emulators []*Emulator) string {
+	var names []string
+	for _, e := range emulators {
+		names = append(names, e.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// releaseEmulators removes the registry's claims on the ports and data
+// directories of emulators that this session no longer runs.
+func releaseEmulators(emulators []*Emulator) {
+	if len(emulators) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := openRegistry(ctx)
+	if err != nil {
+		return
+	}
+	for _, e := range emulators {
+		if e.HostPort != "" {
+			r.release(e.HostPort, true)
+		}
+		dir := e.DataDir
+		if dir == "" {
+			dir = gcloudDataDir(e.Name)
+		}
+		r.release(dir, false)
+	}
+	r.Close()
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// connectRemote returns those of emulators that run elsewhere, for
+// -backend=remote, once they answer on their health paths. Their
+// addresses come from the -NAME-host-port flags or Config.Remote.
+func connectRemote(ctx context.Context, cfg *Config, emulators []*Emulator) ([]*Emulator, error) {
+	var remote []*Emulator
+	for _, e := range emulators {
+		if e.HostPort == "" {
+			e.HostPort = cfg.Remote[e.Name]
+		}
+		if e.HostPort == "" {
+			continue
+		}
+		remote = append(remote, e)
+	}
+	if len(remote) == 0 {
+		return nil, fmt.Errorf("-backend=remote needs emulator addresses, from -datastore-host-port, -pubsub-host-port or the remote config field")
+	}
+	for _, e := range remote {
+		if err := e.waitRemote(ctx); err != nil {
+			return nil, err
+		}
+		emit(StreamEvent{Event: EventReady, Emulator: e.Name, Endpoint: e.HostPort})
+	}
+	return remote, nil
+}
+
+// waitRemote polls the HealthPath of the emulator running at HostPort
+// until it answers, ReadyTimeout elapses, or ctx is done.
+func (e *Emulator) waitRemote(ctx context.Context) error {
+	if e.ReadyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.ReadyTimeout)
+		defer cancel()
+	}
+	for {
+		if probe(ctx, e.HostPort, e.HealthPath) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("remote %s emulator at %s not ready: %v", e.Name, e.HostPort, ctx.Err())
+		case <-time.After(probeInterval):
+		}
+	}
+}
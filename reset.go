@@ -0,0 +1,136 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ResetDatastore deletes all entities in the Datastore emulator at host.
+// component is the gcloud component serving Datastore, which determines
+// how: the Firestore emulator is reset one project at a time.
+func ResetDatastore(ctx context.Context, host, component string, projects []string) error {
+	if component != "cloud-firestore-emulator" {
+		return emulatorPost(ctx, "http://"+host+"/reset")
+	}
+	for _, p := range projects {
+		u := "http://" + host + "/emulator/v1/projects/" + p + "/databases/(default)/documents"
+		req, err := http.NewRequest("DELETE", u, nil)
+		if err != nil {
+			return err
+		}
+		if err := doEmulatorRequest(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetPubsub deletes the topics and subscriptions of project on the
+// Pub/Sub emulator at host, along with their messages, and recreates them
+// empty.
+func ResetPubsub(ctx context.Context, host, project string) error {
+	topics, err := ListTopics(ctx, host, project)
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		for _, s := range t.Subscriptions {
+			if err := pubsubCall(ctx, "DELETE", host, "projects/"+project+"/subscriptions/"+s.Name, nil, nil); err != nil {
+				return fmt.Errorf("deleting subscription %s: %v", s.Name, err)
+			}
+		}
+		if err := pubsubCall(ctx, "DELETE", host, "projects/"+project+"/topics/"+t.Name, nil, nil); err != nil {
+			return fmt.Errorf("deleting topic %s: %v", t.Name, err)
+		}
+	}
+	return CreateTopics(ctx, host, project, topics)
+}
+
+func mapValues(m map[string]string) []string {
+	var values []string
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+func emulatorPost(ctx context.Context, u string) error {
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	return doEmulatorRequest(ctx, req)
+}
+
+func doEmulatorRequest(ctx context.Context, req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL, resp.Status)
+	}
+	return nil
+}
+
+// resetMain implements the reset subcommand, which wipes the state of a
+// running session's emulators without restarting them.
+func resetMain(args []string) int {
+	fs := flag.NewFlagSet("reset", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	timeout := fs.Duration("timeout", time.Minute, "How long to wait for the reset")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reset: %v\n", err)
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	code := 0
+	for _, e := range st.Emulators {
+		if err := resetEmulator(ctx, st, e.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "reset: %s: %v\n", e.Name, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// resetEmulator deletes all data in the named emulator of the session
+// described by st, in each of its projects.
+func resetEmulator(ctx context.Context, st *State, name string) error {
+	var projects []string
+	for _, p := range append([]string{st.project()}, mapValues(st.Projects)...) {
+		if p != "" && !contains(projects, p) {
+			projects = append(projects, p)
+		}
+	}
+	e := st.emulator(name)
+	switch {
+	case e == nil:
+		return fmt.Errorf("no %s emulator", name)
+	case name == "datastore":
+		return ResetDatastore(ctx, e.Endpoint, e.Component, projects)
+	case name == "pubsub":
+		for _, p := range projects {
+			if err := ResetPubsub(ctx, e.Endpoint, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("can't reset %s", name)
+}
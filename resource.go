@@ -0,0 +1,150 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Resource identifies a resource inside an emulator, such as a Pub/Sub topic
+// or a Datastore kind.
+type Resource struct {
+	Emulator string // "pubsub" or "datastore"
+	Type     string // "topic", "subscription" or "kind"
+	Name     string
+}
+
+func (r Resource) String() string {
+	return r.Emulator + ":" + r.Type + "/" + r.Name
+}
+
+// ParseResource parses a resource of the form EMULATOR:TYPE/NAME.
+// Accepted forms are:
+//
+//	pubsub:topic/NAME
+//	pubsub:subscription/NAME
+//	datastore:kind/NAME
+func ParseResource(s string) (Resource, error) {
+	var r Resource
+	i := strings.Index(s, ":")
+	j := strings.Index(s, "/")
+	if i < 0 || j < i || j == len(s)-1 {
+		return r, fmt.Errorf("invalid resource %q, want EMULATOR:TYPE/NAME", s)
+	}
+	r.Emulator, r.Type, r.Name = s[:i], s[i+1:j], s[j+1:]
+	switch r.Emulator + ":" + r.Type {
+	case "pubsub:topic", "pubsub:subscription", "datastore:kind":
+		return r, nil
+	}
+	return r, fmt.Errorf("invalid resource %q: unknown type %s:%s", s, r.Emulator, r.Type)
+}
+
+// Exists reports whether the resource can be found in its emulator.
+// env holds the emulator environment, as returned by Emulator.Env.
+func (r Resource) Exists(ctx context.Context, env []string, project string) (bool, error) {
+	switch r.Emulator {
+	case "pubsub":
+		host := lookupEnv(env, "PUBSUB_EMULATOR_HOST")
+		if host == "" {
+			return false, fmt.Errorf("%v: PUBSUB_EMULATOR_HOST not set", r)
+		}
+		u := fmt.Sprintf("http://%s/v1/projects/%s/%ss/%s", host,
+			url.PathEscape(project), r.Type, url.PathEscape(r.Name))
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return true, nil
+		case http.StatusNotFound:
+			return false, nil
+		}
+		return false, fmt.Errorf("%v: unexpected status %s", r, resp.Status)
+
+	case "datastore":
+		host := lookupEnv(env, "DATASTORE_EMULATOR_HOST")
+		if host == "" {
+			return false, fmt.Errorf("%v: DATASTORE_EMULATOR_HOST not set", r)
+		}
+		body, err := json.Marshal(map[string]interface{}{
+			"query": map[string]interface{}{
+				"kind":  []map[string]string{{"name": r.Name}},
+				"limit": 1,
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+		u := fmt.Sprintf("http://%s/v1/projects/%s:runQuery", host, url.PathEscape(project))
+		req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return false, fmt.Errorf("%v: unexpected status %s", r, resp.Status)
+		}
+		var result struct {
+			Batch struct {
+				EntityResults []json.RawMessage `json:"entityResults"`
+			} `json:"batch"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return false, fmt.Errorf("%v: %v", r, err)
+		}
+		return len(result.Batch.EntityResults) > 0, nil
+	}
+	return false, fmt.Errorf("%v: unknown emulator", r)
+}
+
+// WaitResources polls until all of the resources exist, or ctx is done.
+func WaitResources(ctx context.Context, rs []Resource, env []string, project string) error {
+	const interval = 250 * time.Millisecond
+	for _, r := range rs {
+		for {
+			ok, err := r.Exists(ctx, env, project)
+			if ok {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				if err != nil {
+					return fmt.Errorf("waiting for %v: %v (last error: %v)", r, ctx.Err(), err)
+				}
+				return fmt.Errorf("waiting for %v: %v", r, ctx.Err())
+			case <-time.After(interval):
+			}
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns the value of key in env, a list of KEY=VALUE pairs.
+func lookupEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return env[i][len(key)+1:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParseResource(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Resource
+		ok   bool
+	}{
+		{"pubsub:topic/foo", Resource{"pubsub", "topic", "foo"}, true},
+		{"pubsub:subscription/foo", Resource{"pubsub", "subscription", "foo"}, true},
+		{"datastore:kind/Bar", Resource{"datastore", "kind", "Bar"}, true},
+		{"datastore:kind/", Resource{}, false},
+		{"datastore:topic/foo", Resource{}, false},
+		{"pubsub/foo", Resource{}, false},
+		{"foo", Resource{}, false},
+	} {
+		got, err := ParseResource(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseResource(%q): err = %v, want ok = %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("ParseResource(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if tt.ok && got.String() != tt.in {
+			t.Errorf("%+v.String() = %q, want %q", got, got.String(), tt.in)
+		}
+	}
+}
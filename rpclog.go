@@ -0,0 +1,134 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rpcLog is the -rpc-log file, shared by the proxies in front of the
+// emulators. Each call is logged as a line of:
+//
+//	TIME EMULATOR METHOD RESOURCE LATENCY STATUS
+//
+// e.g. "15:04:05.000 pubsub Publish projects/p/topics/t 1.2ms OK".
+type rpcLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func openRPCLog(path string) (*rpcLog, io.Closer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &rpcLog{w: f}, f, nil
+}
+
+func (l *rpcLog) log(t time.Time, emulator, method, resource string, latency time.Duration, status string) {
+	if resource == "" {
+		resource = "-"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s %s %s %s %v %s\n", t.Format("15:04:05.000"), emulator, method, resource, latency.Round(100*time.Microsecond), status)
+}
+
+// callResource returns the resource that r operates on, if known. For REST
+// calls it is the request path, without the version and custom verb, e.g.
+// "projects/p/topics/t". For gRPC calls it is taken from the routing
+// parameters that Google client libraries send, e.g. "projects/p/topics/t"
+// or "project_id=p".
+func callResource(r *http.Request) string {
+	if isGRPC(r) {
+		q, err := url.ParseQuery(r.Header.Get("X-Goog-Request-Params"))
+		if err != nil || len(q) == 0 {
+			return ""
+		}
+		if len(q) == 1 {
+			for k, v := range q {
+				if strings.Contains(v[0], "/") {
+					return v[0]
+				}
+				return k + "=" + v[0]
+			}
+		}
+		var params []string
+		for k, v := range q {
+			params = append(params, k+"="+v[0])
+		}
+		sort.Strings(params)
+		return strings.Join(params, ",")
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[i+1:] // the version
+	} else {
+		return ""
+	}
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// grpcStatus returns the gRPC status code name of a response written to
+// header, or "" if it has none.
+func grpcStatus(header http.Header) string {
+	s := header.Get("Grpc-Status")
+	if s == "" {
+		s = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if s == "" {
+		return ""
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return s
+	}
+	if code == 0 {
+		return "OK"
+	}
+	for name, c := range grpcCodes {
+		if c.code == code {
+			return name
+		}
+	}
+	return s
+}
+
+// statusWriter records the HTTP status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,379 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// runMain implements the run subcommand, which runs a command with the
+// emulators, stopping them once the command exits.
+func runMain(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "with_emulators: no command given")
+		usage()
+		return 2
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Could not load config", "err", err)
+		return 2
+	}
+
+	var expectations []Expectation
+	for _, s := range append(cfg.Expect, expectFlags...) {
+		x, err := ParseExpectation(s)
+		if err != nil {
+			slog.Error(err.Error())
+			return 2
+		}
+		expectations = append(expectations, x)
+	}
+
+	switch *verifyUsage {
+	case "off", "warn", "fail":
+	default:
+		slog.Error("Invalid -verify-usage, want off, warn or fail", "value", *verifyUsage)
+		return 2
+	}
+	if err := openEvents(); err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+	if err := openOutput(); err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+	openTracing()
+	defer flushTracing()
+	switch *timings {
+	case "off", "text", "json":
+	default:
+		slog.Error("Invalid -timings, want off, text or json", "value", *timings)
+		return 2
+	}
+	if *execMode && (*verifyUsage != "off" || len(expectations) > 0) {
+		slog.Error("-verify-usage and -expect can't be used with -exec")
+		return 2
+	}
+	if *execMode && *shared {
+		slog.Error("-shared can't be used with -exec")
+		return 2
+	}
+	if *execMode && (len(cfg.Faults) > 0 || len(cfg.Throttle) > 0) {
+		slog.Error("faults and throttle can't be used with -exec")
+		return 2
+	}
+	if *execMode && *rpcLogPath != "" {
+		slog.Error("-rpc-log can't be used with -exec")
+		return 2
+	}
+	if *execMode && *unixSockets {
+		slog.Error("-unix can't be used with -exec")
+		return 2
+	}
+	if *execMode && (*tlsProxy || *mtlsProxy) {
+		slog.Error("-tls and -mtls can't be used with -exec")
+		return 2
+	}
+	if *execMode && (*recordPath != "" || *replayPath != "") {
+		slog.Error("-record and -replay can't be used with -exec")
+		return 2
+	}
+	if *recordPath != "" && *replayPath != "" {
+		slog.Error("-record can't be used with -replay")
+		return 2
+	}
+	if *shared && *replayPath != "" {
+		slog.Error("-replay can't be used with -shared")
+		return 2
+	}
+	if *execMode && *datastoreExport != "" {
+		slog.Error("-datastore-export can't be used with -exec")
+		return 2
+	}
+	if *execMode && hasPushEndpoints(cfg) {
+		slog.Error("pushEndpoint subscriptions can't be used with -exec")
+		return 2
+	}
+	if (*supervise || *chaos > 0) && *execMode {
+		slog.Error("-supervise and -chaos can't be used with -exec")
+		return 2
+	}
+	if *chaos > 0 && (*shared || *backend == "remote") {
+		slog.Error("-chaos can't be used with -shared or -backend=remote")
+		return 2
+	}
+	if _, err := superviseSignal(); err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+	if *childDir != "" {
+		if fi, err := os.Stat(*childDir); err != nil || !fi.IsDir() {
+			slog.Error("Invalid -dir, want a directory", "dir", *childDir)
+			return 2
+		}
+	}
+	if *apiAddr != "" {
+		slog.Error("-api can only be used with start")
+		return 2
+	}
+	if *keepAlive && (*execMode || *shared) {
+		slog.Error("-keep-alive can't be used with -exec or -shared")
+		return 2
+	}
+
+	return run(cfg, expectations, args)
+}
+
+// run starts the emulators, runs args with them, then stops them.
+// It returns the exit code for with_emulators.
+func run(cfg *Config, expectations []Expectation, args []string) int {
+	start := time.Now()
+
+	// Until the command starts, a signal aborts startup.
+	ctx, stopStartup := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer stopStartup()
+
+	var s *Session
+	var err error
+	if *shared {
+		s, err = attachShared(ctx)
+	} else if *replayPath != "" {
+		s, err = replaySession(*replayPath, args)
+	} else {
+		s, err = startSession(ctx, cfg, args)
+	}
+	defer s.Stop()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	emulators := s.Emulators // empty when attached to a shared session
+	env := append(s.Env, envMarker+"=1")
+	if *tune && isGoTest(args) {
+		env = tuneEnv(env, len(s.State.Emulators))
+	}
+
+	// Proxies are started after readiness checks, so that only calls made
+	// by the command are counted.
+	proxies := make(map[string]*Proxy)
+	var calls *rpcLog
+	if *rpcLogPath != "" {
+		l, f, err := openRPCLog(*rpcLogPath)
+		if err != nil {
+			slog.Error("Could not open -rpc-log", "err", err)
+			return 1
+		}
+		defer f.Close()
+		calls = l
+	}
+	var rec *recorder
+	if *recordPath != "" {
+		rec = newRecorder(s.State)
+	}
+	var tlsConfig *tls.Config
+	if *tlsProxy || *mtlsProxy {
+		c, tlsEnv, cleanup, err := setupTLS(*mtlsProxy)
+		if err != nil {
+			slog.Error("Could not set up TLS", "err", err)
+			return 1
+		}
+		defer cleanup()
+		tlsConfig = c
+		env = append(env, tlsEnv...)
+	}
+	var socketDir string
+	if *unixSockets {
+		// Keep paths short: they are limited to about 100 bytes.
+		if socketDir, err = ioutil.TempDir("", "we"); err != nil {
+			slog.Error("Could not create socket directory", "err", err)
+			return 1
+		}
+		defer os.RemoveAll(socketDir)
+	}
+	if *verifyUsage != "off" || len(expectations) > 0 || len(cfg.Faults) > 0 || len(cfg.Throttle) > 0 || calls != nil || rec != nil || tlsConfig != nil || socketDir != "" {
+		for _, e := range s.State.Emulators {
+			target := lookupEnv(env, e.HostEnv)
+			p := &Proxy{Target: target, Host: loopbackHost(), Name: e.Name, Log: calls, Record: rec, Throttle: cfg.Throttle[e.Name], TLS: tlsConfig}
+			for _, f := range cfg.Faults {
+				if f.Emulator == e.Name {
+					p.Faults = append(p.Faults, f)
+				}
+			}
+			if socketDir != "" {
+				p.Socket = filepath.Join(socketDir, e.Name+".sock")
+			}
+			if err := p.Start(); err != nil {
+				slog.Error("Could not start proxy", "emulator", e.Name, "err", err)
+				return 1
+			}
+			defer p.Close()
+			proxies[e.Name] = p
+			env = replaceEmulatorEnv(env, e.Env, target, p.Addr())
+			if p.Socket != "" {
+				env = append(env, socketEnv(e.HostEnv)+"="+p.Socket)
+			}
+		}
+	}
+
+	mdPath, err := writeMetadata(newMetadata(s.State, env))
+	if err != nil {
+		slog.Error("Could not write metadata", "err", err)
+		return 1
+	}
+	defer os.Remove(mdPath)
+	env = append(env, envMetadata+"="+mdPath)
+	runSpan := startSpan("run", nil, "command", args[0])
+	env = traceEnv(env, runSpan)
+
+	if *execMode {
+		// The command replaces with_emulators, so its span ends here.
+		flushTracing()
+		err := execCommand(args, env, *childDir, emulators, append(s.Files(), mdPath)...)
+		slog.Error("Could not exec command", "command", args[0], "err", err)
+		return 1
+	}
+
+	// From now on, signals are forwarded to the command, and the emulators
+	// are stopped once it exits.
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigch)
+	stopStartup()
+
+	ready := time.Now()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Dir = *childDir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		runSpan.End(err)
+		slog.Error(err.Error())
+		return 1
+	}
+	emit(StreamEvent{Event: EventCommandStarted, PID: cmd.Process.Pid})
+	cmdDone := make(chan error, 1)
+	go func() { cmdDone <- cmd.Wait() }()
+
+	crashed := s.Crashed()
+	var monkey *chaosMonkey
+	if *chaos > 0 {
+		monkey = startChaos(s, *chaos)
+		defer monkey.Stop()
+	}
+	for {
+		select {
+		case sig := <-sigch:
+			cmd.Process.Signal(sig)
+		case req := <-s.Control():
+			s.handle(req)
+		case c := <-crashed:
+			chaosKill := monkey.caused(c.Name)
+			if (*supervise || chaosKill) && s.emulator(c.Name) != nil {
+				if chaosKill {
+					time.Sleep(*chaosDown)
+				} else {
+					diagnose(c.Err, emulators, env)
+					notify(cfg.Notify, EventCrashed, c.Name, c.Err)
+				}
+				if err := restartCrashed(s, c, cmd.Process); err != nil {
+					cmd.Process.Kill()
+					<-cmdDone
+					slog.Error(err.Error())
+					return 1
+				}
+				continue
+			}
+			cmd.Process.Kill()
+			<-cmdDone
+			runSpan.End(fmt.Errorf("%s exited: %v", c.Name, c.Err))
+			slog.Error("Emulator exited", "emulator", c.Name, "err", c.Err)
+			diagnose(c.Err, emulators, env)
+			notify(cfg.Notify, EventCrashed, c.Name, c.Err)
+			return 1
+		case err := <-cmdDone:
+			if *timings != "off" {
+				newTimings(s.State, start, ready, time.Now()).Write(os.Stderr, *timings)
+			}
+			code := 0
+			if err != nil {
+				var ok bool
+				if code, ok = exitCode(err); !ok {
+					slog.Error(err.Error())
+					code = 1
+				}
+			}
+			emit(StreamEvent{Event: EventCommandExited, PID: cmd.Process.Pid, ExitCode: &code})
+			runSpan.Set("exit_code", strconv.Itoa(code))
+			var spanErr error
+			if code != 0 {
+				spanErr = fmt.Errorf("exit code %d", code)
+			}
+			runSpan.End(spanErr)
+			s.metrics.commandExited(code)
+			if rec != nil {
+				if err := rec.Save(*recordPath); err != nil {
+					slog.Error("Could not save recording", "err", err)
+					if code == 0 {
+						code = 1
+					}
+				}
+			}
+			if *verifyUsage != "off" {
+				if err := checkUsage(proxies); err != nil {
+					slog.Error(err.Error())
+					if *verifyUsage == "fail" && code == 0 {
+						code = 1
+					}
+				}
+			}
+			if !checkExpectations(expectations, proxies) && code == 0 {
+				code = 1
+			}
+			if err := exportDatastore(cfg, s.Env); err != nil {
+				slog.Error("Could not export Datastore", "err", err)
+				if code == 0 {
+					code = 1
+				}
+			}
+			if *keepAlive {
+				waitKeepAlive(s, code, sigch, crashed)
+			}
+			return code
+		}
+	}
+}
+
+// waitKeepAlive keeps the session's emulators running after the command
+// exited with code, until with_emulators is signalled or an emulator exits.
+func waitKeepAlive(s *Session, code int, sigch <-chan os.Signal, crashed <-chan Crash) {
+	pid := os.Getpid()
+	slog.Info(fmt.Sprintf("Command exited with code %d; emulators still running. From another shell, use them with\n"+
+		"\teval \"$(with_emulators env -session %d)\"\n"+
+		"and stop them with Ctrl-C or \"with_emulators stop -session %d\".", code, pid, pid))
+	for {
+		select {
+		case <-sigch:
+			return
+		case req := <-s.Control():
+			s.handle(req)
+		case c := <-crashed:
+			slog.Error("Emulator exited", "emulator", c.Name, "err", c.Err)
+			return
+		}
+	}
+}
@@ -0,0 +1,731 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is a set of running emulators, recorded in a state file so that
+// other with_emulators invocations can find them.
+type Session struct {
+	Emulators []*Emulator
+
+	// Env is the environment for commands using the emulators: the
+	// current environment plus EmulatorEnv.
+	Env []string
+
+	// ProjectEnv holds the variables naming the configured projects.
+	ProjectEnv []string
+
+	// EmulatorEnv holds the variables pointing clients at each emulator,
+	// in the same order as State.Emulators.
+	EmulatorEnv [][]string
+
+	// State describes the session, as recorded in its state file.
+	State *State
+
+	statePath string
+	envPath   string   // the -env-file, if written
+	readyPath string   // the -ready-file, if written
+	tempDirs  []string // removed when the session stops
+	hooks     Hooks
+	stopOnce  sync.Once
+	mu        sync.Mutex // guards Emulators while reloading; see list
+
+	crashed chan Crash // see Crashed
+
+	control       chan controlRequest // see Control
+	controlServer *http.Server
+	controlPath   string
+	apiServer     *http.Server // serves -api
+
+	stopBridges func()      // stops push bridges, if any
+	stopDump    func()      // stops dumping the emulators on SIGUSR1
+	replayers   []*replayer // serve the session's emulators, with -replay
+	ui          *ui
+	health      *http.Server // serves -health
+	metrics     *metrics     // serves -metrics
+	span        *span        // of startSession, if tracing
+
+	// clientPath is set when attached to a shared session started by
+	// another process, in which case Emulators is empty.
+	clientPath string
+}
+
+// Crash reports an emulator exiting while a session is in use.
+type Crash struct {
+	Name string // the emulator
+	Err  error
+}
+
+// defaultEmulators returns the emulators started by a session, with the GA
+// gcloud commands; see gcloudCLI for older releases.
+func defaultEmulators() []*Emulator {
+	datastore := &Emulator{
+		Name:          "datastore",
+		Component:     "cloud-datastore-emulator",
+		HostEnv:       "DATASTORE_EMULATOR_HOST",
+		Command:       []string{"gcloud", "-q", "emulators", "datastore", "start"},
+		ProjectEnv:    "DATASTORE_PROJECT_ID",
+		ReadySentinel: "is now running",
+		HealthPath:    "/",
+		Readiness:     *readiness,
+		HostPort:      *datastoreHostPort,
+		DefaultPort:   8081,
+		MinJava:       minJava,
+		DataDir:       *datastoreDataDir,
+		ReadyTimeout:  *readyTimeout,
+		StopTimeout:   *stopTimeout,
+	}
+	if *datastoreEmulator == "firestore" {
+		// Production Datastore is now Firestore in Datastore mode.
+		datastore.Component = "cloud-firestore-emulator"
+		datastore.Command = []string{"gcloud", "-q", "emulators", "firestore", "start", "--database-mode=datastore-mode"}
+		datastore.NoDataDir = true
+	}
+	return []*Emulator{
+		datastore,
+		{
+			Name:          "pubsub",
+			Component:     "pubsub-emulator",
+			HostEnv:       "PUBSUB_EMULATOR_HOST",
+			Command:       []string{"gcloud", "-q", "emulators", "pubsub", "start"},
+			ReadySentinel: "Server started, listening",
+			HealthPath:    "/",
+			Readiness:     *readiness,
+			HostPort:      *pubsubHostPort,
+			DefaultPort:   8085,
+			MinJava:       minJava,
+			ReadyTimeout:  *readyTimeout,
+			StopTimeout:   *stopTimeout,
+		},
+	}
+}
+
+// emulatorNames returns the names of the emulators started by a session.
+func emulatorNames() []string {
+	var names []string
+	for _, e := range defaultEmulators() {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// startSession starts the emulators and waits for them to be ready.
+// args is the command the session is for, recorded in the state file.
+// The returned session must be stopped even if err is non-nil.
+func startSession(ctx context.Context, cfg *Config, args []string) (s *Session, err error) {
+	sp := startSpan("start", nil, "backend", *backend)
+	defer func() { sp.End(err) }()
+	switch *readiness {
+	case "probe", "sentinel":
+	default:
+		return &Session{}, fmt.Errorf("invalid -readiness %q, want probe or sentinel", *readiness)
+	}
+	switch *datastoreEmulator {
+	case "datastore":
+	case "firestore":
+		if *datastoreDataDir != "" || *datastoreIndex != "" {
+			return &Session{}, fmt.Errorf("-datastore-data-dir and -datastore-index can't be used with -datastore-emulator=firestore")
+		}
+	default:
+		return &Session{}, fmt.Errorf("invalid -datastore-emulator %q, want datastore or firestore", *datastoreEmulator)
+	}
+	switch *backend {
+	case "local", "docker", "podman", "java", "remote":
+	default:
+		return &Session{}, fmt.Errorf("invalid -backend %q, want local, docker, podman, java or remote", *backend)
+	}
+	s = &Session{hooks: cfg.Hooks, span: sp}
+	if s.Emulators, err = configureEmulators(ctx, cfg); err != nil {
+		return s, err
+	}
+	if err := makeStateDir(); err != nil {
+		return s, err
+	}
+	if *logDir != "" {
+		if err := os.MkdirAll(*logDir, 0755); err != nil {
+			return s, err
+		}
+	}
+	if (*healthAddr != "" || *metricsAddr != "") && *backend == "remote" {
+		return s, fmt.Errorf("-health and -metrics can't be used with -backend=remote")
+	}
+	if *healthAddr != "" {
+		if s.health, err = startHealth(*healthAddr, s.list); err != nil {
+			return s, fmt.Errorf("could not start health endpoint: %v", err)
+		}
+	}
+	if *metricsAddr != "" {
+		if s.metrics, err = startMetrics(*metricsAddr, s.list); err != nil {
+			return s, fmt.Errorf("could not start metrics endpoint: %v", err)
+		}
+	}
+	emulators := s.Emulators
+	if *backend == "remote" {
+		emulators, err = connectRemote(ctx, cfg, s.Emulators)
+		s.Emulators = nil // not started by the session
+	} else {
+		s.stopDump = dumpOnSignal(s.list)
+		err = s.startEmulators(ctx, cfg, s.Emulators)
+	}
+	if err != nil {
+		return s, err
+	}
+
+	s.setEnv(cfg, emulators)
+
+	s.State = newState(args, emulators, s.EmulatorEnv)
+	s.State.Env = s.ProjectEnv
+	s.State.Projects = cfg.Projects
+	s.State.Log = os.Getenv(envDaemonLog)
+	s.State.Shared = *shared
+	if s.statePath, err = s.State.Write(); err != nil {
+		return s, fmt.Errorf("could not write state file: %v", err)
+	}
+
+	// Then resources, such as fixtures and topics.
+	setup := startSpan("setup", sp)
+	defer func() { setup.End(err) }()
+	if *envFile != "" {
+		if err := writeEnvFile(*envFile, s.State.env()); err != nil {
+			return s, fmt.Errorf("could not write env file: %v", err)
+		}
+		s.envPath = *envFile
+	}
+
+	if err := importDatastore(ctx, cfg, s.Env); err != nil {
+		return s, fmt.Errorf("could not import Datastore export: %v", err)
+	}
+	if err := seedFixtures(ctx, cfg, s.Env); err != nil {
+		return s, fmt.Errorf("could not load fixtures: %v", err)
+	}
+	if err := createTopics(ctx, cfg, s.Env); err != nil {
+		return s, fmt.Errorf("could not create topics: %v", err)
+	}
+	if hasPushEndpoints(cfg) {
+		s.stopBridges = startPushBridges(cfg, s.Env)
+	}
+	if *uiAddr != "" {
+		if s.ui, err = startUI(*uiAddr, s.State); err != nil {
+			return s, fmt.Errorf("could not start dashboard: %v", err)
+		}
+	}
+	if err := waitReadyWhen(ctx, cfg, s.Env); err != nil {
+		if ctx.Err() == nil {
+			notify(cfg.Notify, EventStartupFailed, "", err)
+		}
+		return s, fmt.Errorf("resources not ready: %v", err)
+	}
+	if *readyFile != "" {
+		if err := newReadyFile(s.State).Write(*readyFile); err != nil {
+			return s, fmt.Errorf("could not write ready file: %v", err)
+		}
+		s.readyPath = *readyFile
+	}
+	if err := runHook(ctx, "postReady", s.hooks.PostReady, s.Env); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// configureEmulators returns the emulators that cfg selects, configured by
+// it and the flags, but not started.
+func configureEmulators(ctx context.Context, cfg *Config) ([]*Emulator, error) {
+	emulators := defaultEmulators()
+	find := func(name string) *Emulator { return findEmulator(emulators, name) }
+	if *backend == "docker" || *backend == "podman" {
+		runtime, err := containerRuntime(*backend)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range emulators {
+			containerize(e, runtime, *image)
+		}
+	} else if *backend == "local" {
+		g := detectGcloud()
+		for _, e := range emulators {
+			g.apply(e)
+		}
+	} else if *backend == "java" {
+		dir, err := componentCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		// Only download the emulators that will run.
+		for _, e := range selectEmulators(emulators, cfg.Emulators) {
+			if err := standaloneize(ctx, e, dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	limits, err := parseLimits(*limitMemory, *limitCPU)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range emulators {
+		e.Limits = limits
+	}
+	for name, args := range cfg.Args {
+		find(name).Args = append(find(name).Args, args...)
+	}
+	for name, f := range cfg.LogFilter {
+		find(name).LogFilter = f
+	}
+	for name, re := range cfg.ReadySentinel {
+		find(name).ReadyPattern = re.Regexp
+	}
+	for name, opts := range cfg.JVMOptions {
+		find(name).JVMOptions = append(find(name).JVMOptions, opts...)
+	}
+	for _, v := range jvmOptions {
+		// Options start with a dash, so NAME= prefixes are unambiguous.
+		emulators := emulators
+		if i := strings.Index(v, "="); i >= 0 && find(v[:i]) != nil {
+			emulators, v = []*Emulator{find(v[:i])}, v[i+1:]
+		} else if !strings.HasPrefix(v, "-") {
+			return nil, fmt.Errorf("invalid -jvm-options %q, want OPTIONS or NAME=OPTIONS with NAME one of %s", v, strings.Join(emulatorNames(), ", "))
+		}
+		for _, e := range emulators {
+			e.JVMOptions = append(e.JVMOptions, strings.Fields(v)...)
+		}
+	}
+	for _, v := range readySentinels {
+		i := strings.Index(v, "=")
+		if i < 0 || find(v[:i]) == nil {
+			return nil, fmt.Errorf("invalid -ready-sentinel %q, want NAME=REGEXP with NAME one of %s", v, strings.Join(emulatorNames(), ", "))
+		}
+		re, err := regexp.Compile(v[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid -ready-sentinel %q: %v", v, err)
+		}
+		find(v[:i]).ReadyPattern = re
+	}
+	find("datastore").Args = append(find("datastore").Args, datastoreArgs...)
+	find("pubsub").Args = append(find("pubsub").Args, pubsubArgs...)
+	if *datastoreConsistency != "" {
+		c, err := strconv.ParseFloat(*datastoreConsistency, 64)
+		if err != nil || c < 0 || c > 1 {
+			return nil, fmt.Errorf("invalid -datastore-consistency %q, want a number from 0 to 1", *datastoreConsistency)
+		}
+		find("datastore").Args = append(find("datastore").Args, "--consistency="+*datastoreConsistency)
+	}
+	for _, e := range emulators {
+		e.LogPath = filepath.Join(stateDir(), strconv.Itoa(os.Getpid())+"."+e.Name+".log")
+		e.LogDir = *logDir
+		e.LogMaxSize = *logMaxSize << 20
+		if fdOutput != nil {
+			e.Output = fdOutput
+		}
+		e.Project = cfg.Project
+		if e.Project == "" && e.ProjectEnv != "" {
+			// Clients need the project the emulator was started for,
+			// which gcloud takes from its configuration.
+			if *backend == "local" {
+				e.Project = gcloudProject()
+			}
+			if e.Project == "" {
+				e.Project = defaultProject
+			}
+		}
+	}
+	return selectEmulators(emulators, cfg.Emulators), nil
+}
+
+// setEnv sets the session's environment for commands using emulators.
+func (s *Session) setEnv(cfg *Config, emulators []*Emulator) {
+	s.Env = inheritedEnv()
+	s.ProjectEnv = projectEnv(cfg)
+	s.Env = append(s.Env, s.ProjectEnv...)
+	s.EmulatorEnv = nil
+	for _, e := range emulators {
+		env := e.Env()
+		// Point the command at localhost rather than a wildcard address.
+		if addr := dialAddr(e.HostPort); addr != e.HostPort {
+			env = replaceEnv(env, e.HostPort, addr)
+		}
+		env = aliasEnv(env, cfg.EnvAliases)
+		s.Env = append(s.Env, env...)
+		s.EmulatorEnv = append(s.EmulatorEnv, env)
+	}
+}
+
+// startEmulators starts emulators, the session's, or on reload those being
+// added to it, on free ports unless pinned, and waits for them to be ready.
+func (s *Session) startEmulators(ctx context.Context, cfg *Config, emulators []*Emulator) error {
+	// s.State is set once the session has started.
+	reload := s.State != nil
+	if !isLoopback(*bind) && !reload {
+		slog.Warn("Emulators are reachable from other machines, and accept any request without authentication", "bind", *bind)
+	}
+	shard, err := shardIndex()
+	if err != nil {
+		return err
+	}
+	if shard >= 0 {
+		for _, e := range emulators {
+			e.setShard(shard)
+		}
+	}
+	ds := findEmulator(emulators, "datastore")
+	if ds != nil && ds.DataDir == "" && !ds.NoDataDir && (*datastoreIndex != "" || ds.Standalone != nil) {
+		// Don't touch gcloud's default data directory. The standalone
+		// emulator has none.
+		ds.DataDir = s.newTempDir(ds)
+	}
+	// Rather than the emulators' default ports, which collide with other
+	// sessions on the same machine, use free ones unless pinned by flags.
+	freePort := make(map[*Emulator]bool)
+	if err := s.claim(ctx, emulators, freePort); err != nil {
+		return err
+	}
+	if ds != nil && *datastoreIndex != "" {
+		if err := installIndex(ds, *datastoreIndex); err != nil {
+			return fmt.Errorf("could not install Datastore indexes: %v", err)
+		}
+	}
+
+	if err := requireJava(emulators); err != nil {
+		notify(cfg.Notify, EventStartupFailed, "", err)
+		return err
+	}
+	if len(s.hooks.PreStart) > 0 && !reload {
+		s.setEnv(cfg, emulators)
+		if err := runHook(ctx, "preStart", s.hooks.PreStart, s.Env); err != nil {
+			return err
+		}
+	}
+	spans := make(map[*Emulator]*span)
+	for _, e := range emulators {
+		spans[e] = startSpan("emulator "+e.Name, s.span, "emulator", e.Name, "component", e.Component)
+		if err := e.Start(); err != nil {
+			notify(cfg.Notify, EventStartupFailed, e.Name, err)
+			spans[e].End(err)
+			return fmt.Errorf("could not start %s: %v", e.Name, err)
+		}
+		emit(StreamEvent{Event: EventStarting, Emulator: e.Name, PID: e.cmd.Process.Pid})
+	}
+	installed := make(map[string]bool) // gcloud components
+	for _, e := range emulators {
+		installTried := false
+		for retries := *startRetries; ; retries-- {
+			err := e.WaitReady(ctx)
+			if err == nil {
+				break
+			}
+			reinstalled := false
+			if ctx.Err() == nil && !installTried {
+				installTried = true
+				reinstalled = installMissing(e, installed)
+			}
+			if reinstalled {
+				// Installing components doesn't count as a retry.
+				retries++
+				slog.Info("Restarting emulator with the installed components", "emulator", e.Name)
+			} else if ctx.Err() != nil || retries <= 0 {
+				if ctx.Err() == nil {
+					diagnose(err, emulators, os.Environ())
+					notify(cfg.Notify, EventStartupFailed, e.Name, err)
+				}
+				spans[e].End(err)
+				return fmt.Errorf("%s not ready: %v", e.Name, err)
+			} else {
+				slog.Warn("Emulator not ready; restarting", "emulator", e.Name, "retries", retries, "err", err)
+			}
+			if freePort[e] {
+				// The port may have been taken meanwhile.
+				r, err := openRegistry(ctx)
+				if err != nil {
+					return err
+				}
+				e.HostPort, err = r.freeHostPort(*bind)
+				if cerr := r.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					return fmt.Errorf("could not find a port for %s: %v", e.Name, err)
+				}
+			}
+			if err := e.Restart(); err != nil {
+				return fmt.Errorf("could not restart %s: %v", e.Name, err)
+			}
+			emit(StreamEvent{Event: EventStarting, Emulator: e.Name, PID: e.cmd.Process.Pid})
+		}
+		emit(StreamEvent{Event: EventReady, Emulator: e.Name, Endpoint: e.HostPort})
+		spans[e].Set("endpoint", e.HostPort)
+		spans[e].End(nil)
+	}
+	return nil
+}
+
+// claim records the emulators' ports and data directories in the
+// registry, picking free ports for those without one, which are marked in
+// freePort. It fails if another session claimed a port or data directory
+// pinned by flags, and moves emulators off gcloud's default data directory
+// while another session uses it.
+func (s *Session) claim(ctx context.Context, emulators []*Emulator, freePort map[*Emulator]bool) (err error) {
+	r, err := openRegistry(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for _, e := range emulators {
+		if e.HostPort == "" {
+			if e.HostPort, err = r.freeHostPort(*bind); err != nil {
+				return fmt.Errorf("could not find a port for %s: %v", e.Name, err)
+			}
+			freePort[e] = true
+		} else if pid := r.owner(e.HostPort, true); pid != 0 {
+			return fmt.Errorf("%s port %s is in use by another with_emulators session (PID %d)", e.Name, e.HostPort, pid)
+		} else {
+			r.claim(e.HostPort, true)
+		}
+
+		if e.NoDataDir || e.Container != nil || e.Standalone != nil {
+			continue
+		}
+		dir := e.DataDir
+		if dir == "" {
+			dir = gcloudDataDir(e.Name)
+		}
+		if pid := r.owner(dir, false); pid != 0 {
+			if e.DataDir != "" {
+				return fmt.Errorf("%s data directory %s is in use by another with_emulators session (PID %d)", e.Name, e.DataDir, pid)
+			}
+			slog.Info("Another session is using gcloud's data directory; using a temporary one", "emulator", e.Name, "pid", pid)
+			e.DataDir = s.newTempDir(e)
+			dir = e.DataDir
+		}
+		r.claim(dir, false)
+	}
+	return nil
+}
+
+// newTempDir returns a data directory for e that is removed when the
+// session stops.
+func (s *Session) newTempDir(e *Emulator) string {
+	dir := filepath.Join(stateDir(), strconv.Itoa(os.Getpid())+"."+e.Name)
+	s.tempDirs = append(s.tempDirs, dir)
+	return dir
+}
+
+// projectEnv returns the variables naming the projects in cfg: those that
+// client libraries read the project ID from, and one per cfg.Projects, with
+// their cfg.EnvAliases.
+func projectEnv(cfg *Config) []string {
+	var env []string
+	if cfg.Project != "" {
+		env = append(env, "GOOGLE_CLOUD_PROJECT="+cfg.Project, "GCLOUD_PROJECT="+cfg.Project)
+	}
+	var names []string
+	for name := range cfg.Projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, projectVar(name)+"="+cfg.Projects[name])
+	}
+	return aliasEnv(env, cfg.EnvAliases)
+}
+
+// projectVar returns the variable holding the ID of the named project in
+// Config.Projects.
+func projectVar(name string) string {
+	v := []byte(strings.ToUpper(name))
+	for i, c := range v {
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			v[i] = '_'
+		}
+	}
+	return string(v) + "_PROJECT_ID"
+}
+
+// list returns the session's emulators, for goroutines that may run while
+// the session reloads.
+func (s *Session) list() []*Emulator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Emulator(nil), s.Emulators...)
+}
+
+// emulator returns the session's emulator with the given name, or nil.
+func (s *Session) emulator(name string) *Emulator {
+	return findEmulator(s.Emulators, name)
+}
+
+func findEmulator(emulators []*Emulator, name string) *Emulator {
+	for _, e := range emulators {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// selectEmulators returns those of emulators named in names, or all of them
+// if names is empty.
+func selectEmulators(emulators []*Emulator, names []string) []*Emulator {
+	if len(names) == 0 {
+		return emulators
+	}
+	var selected []*Emulator
+	for _, e := range emulators {
+		if contains(names, e.Name) {
+			selected = append(selected, e)
+		}
+	}
+	return selected
+}
+
+// Files returns the files owned by the session: its state file, the
+// emulator logs and any temporary data directory.
+func (s *Session) Files() []string {
+	var files []string
+	if s.statePath != "" {
+		files = append(files, s.statePath)
+	}
+	if s.envPath != "" {
+		files = append(files, s.envPath)
+	}
+	if s.readyPath != "" {
+		files = append(files, s.readyPath)
+	}
+	files = append(files, s.tempDirs...)
+	for _, e := range s.Emulators {
+		files = append(files, e.LogPath)
+	}
+	return files
+}
+
+// Stop stops the started emulators and removes the session's files.
+// A session attached to a shared session detaches from it instead.
+// Calls after the first do nothing.
+func (s *Session) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *Session) stop() {
+	if s.clientPath != "" {
+		os.Remove(s.clientPath)
+		return
+	}
+	sp := startSpan("stop", nil)
+	defer sp.End(nil)
+	// Stop hooks only run once the emulators have addresses.
+	started := s.Env != nil
+	if started {
+		if err := runHook(context.Background(), "preStop", s.hooks.PreStop, s.Env); err != nil {
+			slog.Error("Hook failed", "err", err)
+		}
+	}
+	if s.stopBridges != nil {
+		s.stopBridges()
+	}
+	if s.stopDump != nil {
+		s.stopDump()
+	}
+	s.closeControl()
+	if s.ui != nil {
+		s.ui.Close()
+	}
+	for _, rp := range s.replayers {
+		rp.Close()
+	}
+	for _, e := range s.Emulators {
+		if err := e.Stop(); err != nil {
+			slog.Error("Could not stop emulator", "emulator", e.Name, "err", err)
+		}
+	}
+	for _, f := range s.Files() {
+		os.RemoveAll(f)
+	}
+	if len(s.Emulators) > 0 {
+		releaseClaims()
+	}
+	if s.health != nil {
+		s.health.Close()
+	}
+	s.metrics.Close()
+	if started {
+		if err := runHook(context.Background(), "postStop", s.hooks.PostStop, s.Env); err != nil {
+			slog.Error("Hook failed", "err", err)
+		}
+	}
+}
+
+// Restart restarts the named emulator, on the same port, and waits for it
+// to be ready.
+func (s *Session) Restart(ctx context.Context, name string) error {
+	e := s.emulator(name)
+	if e == nil {
+		return fmt.Errorf("no %s emulator", name)
+	}
+	if err := e.Restart(); err != nil {
+		return err
+	}
+	if err := e.WaitReady(ctx); err != nil {
+		return err
+	}
+	if st := s.State.emulator(name); st != nil {
+		st.PID = e.cmd.Process.Pid
+		st.StartupDuration = e.StartupDuration()
+		s.State.Write()
+	}
+	if s.crashed != nil {
+		go s.watch(e)
+	}
+	return nil
+}
+
+// Crashed returns a channel that receives a Crash for each emulator that
+// exits without being stopped, including emulators restarted since; see
+// Emulator.Done. For an attached shared session, it receives a single Crash
+// when the session's process exits.
+func (s *Session) Crashed() <-chan Crash {
+	if s.crashed != nil {
+		return s.crashed
+	}
+	crashed := make(chan Crash, len(s.Emulators)+1)
+	s.crashed = crashed
+	if s.clientPath != "" {
+		go func() {
+			for processAlive(s.State.PID) {
+				time.Sleep(sharedPollInterval)
+			}
+			crashed <- Crash{
+				Name: "shared",
+				Err:  fmt.Errorf("shared session %d exited; its emulators are gone", s.State.PID),
+			}
+		}()
+		return crashed
+	}
+	for _, e := range s.Emulators {
+		go s.watch(e)
+	}
+	return crashed
+}
+
+// watch sends a Crash if e exits without being stopped.
+func (s *Session) watch(e *Emulator) {
+	if err := <-e.Done(); err != nil {
+		s.crashed <- Crash{e.Name, err}
+	}
+}
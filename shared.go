@@ -0,0 +1,156 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A shared session is a daemon started by the first "run -shared" and
+// reused by later ones. Each process using it registers itself as a client
+// by creating a file named after its PID in the session's clients
+// directory. The daemon exits once it has had no live clients for
+// -shared-idle.
+//
+// The shared lock serializes finding or starting the shared session and
+// registering with it against the daemon deciding to exit.
+
+// sharedPollInterval is how often clients and the daemon check on each other.
+const sharedPollInterval = 500 * time.Millisecond
+
+func sharedLockPath() string {
+	return filepath.Join(stateDir(), "shared.lock")
+}
+
+// clientsDir returns the directory holding the clients of the shared
+// session run by the process pid.
+func clientsDir(pid int) string {
+	return filepath.Join(stateDir(), strconv.Itoa(pid)+".clients")
+}
+
+// attachShared attaches to the shared session, starting it if needed.
+// The returned session must be stopped, to detach, even if err is non-nil.
+func attachShared(ctx context.Context) (*Session, error) {
+	s := &Session{}
+	if err := makeStateDir(); err != nil {
+		return s, err
+	}
+	unlock, err := lockFile(ctx, sharedLockPath())
+	if err != nil {
+		return s, fmt.Errorf("could not lock shared session: %v", err)
+	}
+	defer unlock()
+
+	st, err := findShared()
+	if err != nil {
+		return s, err
+	}
+	if st == nil {
+		if code := startDaemon(ioutil.Discard); code != 0 {
+			return s, fmt.Errorf("could not start shared session")
+		}
+		if st, err = findShared(); err != nil {
+			return s, err
+		}
+		if st == nil {
+			return s, fmt.Errorf("shared session started, but its state file is missing")
+		}
+	}
+
+	dir := clientsDir(st.PID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return s, err
+	}
+	s.clientPath = filepath.Join(dir, strconv.Itoa(os.Getpid()))
+	if err := ioutil.WriteFile(s.clientPath, nil, 0600); err != nil {
+		return s, err
+	}
+	s.State = st
+	s.ProjectEnv = st.Env
+	s.Env = append(inheritedEnv(), st.Env...)
+	for _, e := range st.Emulators {
+		s.Env = append(s.Env, e.Env...)
+		s.EmulatorEnv = append(s.EmulatorEnv, e.Env)
+	}
+	return s, nil
+}
+
+// findShared returns the running shared session, or nil.
+func findShared() (*State, error) {
+	states, _, err := readStates()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(states) - 1; i >= 0; i-- {
+		if states[i].Shared && processAlive(states[i].PID) {
+			return states[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// liveClients counts the live clients of the shared session run by this
+// process, removing the registrations of clients that died.
+func liveClients() int {
+	dir := clientsDir(os.Getpid())
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, f := range files {
+		pid, err := strconv.Atoi(f.Name())
+		if err == nil && processAlive(pid) {
+			n++
+			continue
+		}
+		os.Remove(filepath.Join(dir, f.Name()))
+	}
+	return n
+}
+
+// waitIdle blocks until the shared session run by this process has had no
+// clients for idle, or ctx is done. When it returns nil, the shared lock
+// is held and the session's state file has been removed, so no new
+// clients can attach; the caller must call the returned unlock function
+// once the emulators are stopped.
+func waitIdle(ctx context.Context, s *Session, idle time.Duration) (unlock func(), err error) {
+	defer os.RemoveAll(clientsDir(os.Getpid()))
+	lastUsed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return func() {}, ctx.Err()
+		case <-time.After(sharedPollInterval):
+		}
+		if liveClients() > 0 {
+			lastUsed = time.Now()
+			continue
+		}
+		if time.Since(lastUsed) < idle {
+			continue
+		}
+		unlock, err := lockFile(ctx, sharedLockPath())
+		if err != nil {
+			return func() {}, err
+		}
+		if liveClients() > 0 {
+			// A client attached while we were taking the lock.
+			unlock()
+			lastUsed = time.Now()
+			continue
+		}
+		os.Remove(s.statePath)
+		slog.Info("Shared session idle; stopping", "idle", idle)
+		return unlock, nil
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const shellHelp = `Commands:
+  topics                    list Pub/Sub topics and subscriptions
+  publish TOPIC DATA        publish a message with the rest of the line as data
+  pull SUBSCRIPTION [N]     pull and ack up to N (default 10) messages
+  get KEY                   print a Datastore entity, e.g. get Shelf/fiction/Book/1
+  list KIND                 print the entities of a kind
+  put KEY PROPERTIES        store an entity; KEY may end in a kind to allocate an ID,
+                            e.g. put Book {"title": "Dune"}
+  help                      print this help
+  quit                      exit (or Ctrl-D)
+`
+
+// shellMain implements the shell subcommand, an interactive prompt for
+// exploring a running session's emulators.
+func shellMain(args []string) int {
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	project := fs.String("project", "", "Project to use (default: the session's)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shell: %v\n", err)
+		return 1
+	}
+	if *project == "" {
+		*project = st.project()
+	}
+	sh := &shell{st: st, project: *project, out: os.Stdout}
+	if ds := st.emulator("datastore"); ds != nil {
+		sh.ds = &datastoreClient{host: ds.Endpoint, project: *project}
+	}
+	if ps := st.emulator("pubsub"); ps != nil {
+		sh.pubsub = ps.Endpoint
+	}
+	fmt.Fprintf(os.Stderr, "Connected to session %d, project %s. Type help for commands.\n", st.PID, *project)
+	sc := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "> ")
+		if !sc.Scan() {
+			fmt.Fprintln(os.Stderr)
+			return 0
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "quit" || line == "exit" {
+			return 0
+		}
+		if line == "" {
+			continue
+		}
+		if err := sh.exec(line); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+	}
+}
+
+type shell struct {
+	st      *State
+	project string
+	ds      *datastoreClient
+	pubsub  string // Pub/Sub emulator host
+	out     io.Writer
+}
+
+// exec runs a single command line.
+func (sh *shell) exec(line string) error {
+	f := strings.Fields(line)
+	cmd, args := f[0], f[1:]
+	// rest returns the line after the command and n arguments.
+	rest := func(n int) string {
+		s := strings.TrimSpace(strings.TrimPrefix(line, cmd))
+		for i := 0; i < n; i++ {
+			s = strings.TrimSpace(strings.TrimPrefix(s, args[i]))
+		}
+		return s
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch {
+	case cmd == "help":
+		fmt.Fprint(sh.out, shellHelp)
+		return nil
+	case cmd == "topics" && len(args) == 0:
+		topics, err := ListTopics(ctx, sh.pubsub, sh.project)
+		if err != nil {
+			return err
+		}
+		for _, t := range topics {
+			fmt.Fprintln(sh.out, t.Name)
+			for _, s := range t.Subscriptions {
+				fmt.Fprintf(sh.out, "  %s\n", s.Name)
+			}
+		}
+		return nil
+	case cmd == "publish" && len(args) >= 2:
+		id, err := Publish(ctx, sh.pubsub, sh.project, args[0], []byte(rest(1)), nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "published %s\n", id)
+		return nil
+	case cmd == "pull" && (len(args) == 1 || len(args) == 2):
+		n := 10
+		if len(args) == 2 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+				return fmt.Errorf("invalid count %q", args[1])
+			}
+		}
+		return sh.pull(ctx, args[0], n)
+	case cmd == "get" && len(args) == 1:
+		key, err := sh.ds.parseKey(args[0])
+		if err != nil {
+			return err
+		}
+		fixtures, err := sh.ds.lookup(ctx, []interface{}{key})
+		if err != nil {
+			return err
+		}
+		if len(fixtures) == 0 {
+			return fmt.Errorf("%s not found", args[0])
+		}
+		return sh.print(fixtures[0])
+	case cmd == "list" && len(args) == 1:
+		fixtures, err := sh.ds.query(ctx, map[string]interface{}{"kind": []map[string]string{{"name": args[0]}}}, 0)
+		if err != nil {
+			return err
+		}
+		for _, f := range fixtures {
+			if err := sh.print(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	case cmd == "put" && len(args) >= 2:
+		key, err := sh.ds.put(ctx, args[0], rest(1))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "put %s\n", key)
+		return nil
+	}
+	return fmt.Errorf("invalid command %q; type help for commands", line)
+}
+
+func (sh *shell) print(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "%s\n", b)
+	return nil
+}
+
+func (sh *shell) pull(ctx context.Context, sub string, n int) error {
+	name := "projects/" + sh.project + "/subscriptions/" + sub
+	var resp struct {
+		ReceivedMessages []struct {
+			AckID   string      `json:"ackId"`
+			Message pushMessage `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	body := map[string]interface{}{"maxMessages": n, "returnImmediately": true}
+	if err := pubsubCall(ctx, "POST", sh.pubsub, name+":pull", body, &resp); err != nil {
+		return err
+	}
+	var acks []string
+	for _, m := range resp.ReceivedMessages {
+		data, _ := base64.StdEncoding.DecodeString(m.Message.Data)
+		fmt.Fprintf(sh.out, "%s %s", m.Message.MessageID, data)
+		for k, v := range m.Message.Attributes {
+			fmt.Fprintf(sh.out, " %s=%s", k, v)
+		}
+		fmt.Fprintln(sh.out)
+		acks = append(acks, m.AckID)
+	}
+	if len(acks) == 0 {
+		fmt.Fprintln(sh.out, "no messages")
+		return nil
+	}
+	return pubsubCall(ctx, "POST", sh.pubsub, name+":acknowledge", map[string]interface{}{"ackIds": acks}, nil)
+}
+
+// put stores an entity with the given key path and JSON properties. If the
+// path ends in a kind, the emulator allocates an ID. It returns the key
+// path of the stored entity.
+func (c *datastoreClient) put(ctx context.Context, path, props string) (string, error) {
+	parts := strings.Split(path, "/")
+	incomplete := len(parts)%2 == 1
+	complete := path
+	if incomplete {
+		// Parse with a placeholder ID, then drop it.
+		complete += "/1"
+	}
+	key, err := c.parseKey(complete)
+	if err != nil {
+		return "", err
+	}
+	if incomplete {
+		elems := key["path"].([]map[string]interface{})
+		delete(elems[len(elems)-1], "id")
+	}
+	dec := json.NewDecoder(strings.NewReader(props))
+	dec.UseNumber()
+	var properties map[string]interface{}
+	if err := dec.Decode(&properties); err != nil {
+		return "", fmt.Errorf("properties: %v", err)
+	}
+	op := "upsert"
+	if incomplete {
+		op = "insert"
+	}
+	body := map[string]interface{}{
+		"mode": "NON_TRANSACTIONAL",
+		"mutations": []interface{}{map[string]interface{}{
+			op: map[string]interface{}{"key": key, "properties": datastoreProperties(properties)},
+		}},
+	}
+	var resp struct {
+		MutationResults []struct {
+			Key *struct {
+				Path []struct {
+					ID string `json:"id"`
+				} `json:"path"`
+			} `json:"key"`
+		} `json:"mutationResults"`
+	}
+	if err := c.call(ctx, "commit", body, &resp); err != nil {
+		return "", err
+	}
+	if incomplete && len(resp.MutationResults) == 1 && resp.MutationResults[0].Key != nil {
+		p := resp.MutationResults[0].Key.Path
+		return path + "/" + p[len(p)-1].ID, nil
+	}
+	return path, nil
+}
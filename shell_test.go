@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShell(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = append(got, r.URL.Path+" "+string(b))
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":publish"):
+			w.Write([]byte(`{"messageIds": ["7"]}`))
+		case strings.HasSuffix(r.URL.Path, ":commit"):
+			w.Write([]byte(`{"mutationResults": [{"key": {"path": [{"kind": "Book", "id": "42"}]}}]}`))
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	var out bytes.Buffer
+	sh := &shell{project: "p", ds: &datastoreClient{host: host, project: "p"}, pubsub: host, out: &out}
+	for _, line := range []string{`publish orders {"id": 1}`, `put Book {"title": "Dune"}`} {
+		if err := sh.exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if err := sh.exec("frobnicate"); err == nil {
+		t.Error("invalid command: got nil error")
+	}
+
+	want := []string{
+		`/v1/projects/p/topics/orders:publish {"messages":[{"data":"eyJpZCI6IDF9"}]}`,
+		`/v1/projects/p:commit {"mode":"NON_TRANSACTIONAL","mutations":[{"insert":{"key":{"partitionId":{"namespaceId":"","projectId":"p"},"path":[{"kind":"Book"}]},"properties":{"title":{"stringValue":"Dune"}}}}]}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if want := "published 7\nput Book/42\n"; out.String() != want {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+}
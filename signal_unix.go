@@ -0,0 +1,31 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+// signals are the signals that can be named in flags.
+var signals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// dumpSignal is the signal that makes a session dump its emulators' state.
+var dumpSignal os.Signal = syscall.SIGUSR1
+
+// parseSignal returns the signal named name, e.g. "HUP" or "SIGHUP".
+func parseSignal(name string) (os.Signal, bool) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	return sig, ok
+}
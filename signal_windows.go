@@ -0,0 +1,24 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// dumpSignal is nil: Windows has no signal to spare for dumping a session's
+// emulators' state.
+var dumpSignal os.Signal
+
+// parseSignal returns the signal named name. Windows can only deliver
+// os.Kill to another process.
+func parseSignal(name string) (os.Signal, bool) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "KILL":
+		return os.Kill, true
+	}
+	return nil, false
+}
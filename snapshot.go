@@ -0,0 +1,203 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A snapshot captures the state of a session's emulators: a Datastore
+// export, and the Pub/Sub topics and subscriptions (but not their
+// messages). Snapshots are kept in directories named after them:
+//
+//	NAME/datastore/    the Datastore export
+//	NAME/topics.json   the topics, as in Config.Topics
+
+// defaultSnapshotDir returns the directory snapshots are kept in by default.
+func defaultSnapshotDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "with_emulators", "snapshots")
+}
+
+// snapshotMain implements the snapshot subcommand:
+//
+//	with_emulators snapshot save NAME
+//	with_emulators snapshot restore NAME
+//	with_emulators snapshot list
+func snapshotMain(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	dir := fs.String("dir", defaultSnapshotDir(), "Directory holding snapshots")
+	project := fs.String("project", "", "Project to snapshot (default: the session's)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "How long to wait for the snapshot to be saved or restored")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: with_emulators snapshot save|restore NAME\n       with_emulators snapshot list")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 1 && args[0] == "list" {
+		return snapshotList(*dir)
+	}
+	if len(args) != 2 || (args[0] != "save" && args[0] != "restore") {
+		fs.Usage()
+		return 2
+	}
+	name := args[1]
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		fmt.Fprintf(os.Stderr, "snapshot: invalid name %q\n", name)
+		return 2
+	}
+
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+		return 1
+	}
+	if *project == "" {
+		*project = st.project()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	path, err := filepath.Abs(filepath.Join(*dir, name))
+	if err == nil {
+		if args[0] == "save" {
+			err = saveSnapshot(ctx, st, *project, path)
+		} else {
+			err = restoreSnapshot(ctx, st, *project, path)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// saveSnapshot saves the state of project in the session st to dir,
+// replacing any snapshot already there.
+func saveSnapshot(ctx context.Context, st *State, project, dir string) error {
+	ds, ps := st.emulator("datastore"), st.emulator("pubsub")
+	if ds == nil || ps == nil {
+		return fmt.Errorf("session %d has no datastore or pubsub emulator", st.PID)
+	}
+	topics, err := ListTopics(ctx, ps.Endpoint, project)
+	if err != nil {
+		return fmt.Errorf("listing topics: %v", err)
+	}
+	for i := range topics {
+		// Leave out the subscriptions of tap and the dashboard.
+		subs := topics[i].Subscriptions[:0]
+		for _, s := range topics[i].Subscriptions {
+			if !strings.HasPrefix(s.Name, "with_emulators-") {
+				subs = append(subs, s)
+			}
+		}
+		topics[i].Subscriptions = subs
+	}
+	b, err := json.MarshalIndent(topics, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Save to a temporary directory, so that a failure leaves any previous
+	// snapshot in place.
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if _, err := DatastoreExport(ctx, ds.Endpoint, project, filepath.Join(tmp, "datastore")); err != nil {
+		return fmt.Errorf("exporting Datastore: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "topics.json"), b, 0600); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// restoreSnapshot restores the snapshot in dir into project in the session
+// st. Entities and topics are added to those already there.
+func restoreSnapshot(ctx context.Context, st *State, project, dir string) error {
+	ds, ps := st.emulator("datastore"), st.emulator("pubsub")
+	if ds == nil || ps == nil {
+		return fmt.Errorf("session %d has no datastore or pubsub emulator", st.PID)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "topics.json"))
+	if err != nil {
+		return err
+	}
+	var topics []Topic
+	if err := json.Unmarshal(b, &topics); err != nil {
+		return fmt.Errorf("%s: %v", filepath.Join(dir, "topics.json"), err)
+	}
+	if err := CreateTopics(ctx, ps.Endpoint, project, topics); err != nil {
+		return fmt.Errorf("creating topics: %v", err)
+	}
+	md, err := findExportMetadata(filepath.Join(dir, "datastore"))
+	if err != nil {
+		return err
+	}
+	if err := DatastoreImport(ctx, ds.Endpoint, project, md); err != nil {
+		return fmt.Errorf("importing Datastore: %v", err)
+	}
+	return nil
+}
+
+// snapshotList prints the names of the snapshots in dir.
+func snapshotList(dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "snapshot list: %v\n", err)
+		return 1
+	}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			fmt.Println(f.Name())
+		}
+	}
+	return 0
+}
+
+// emulator returns the named emulator of the session, or nil.
+func (st *State) emulator(name string) *EmulatorState {
+	for i := range st.Emulators {
+		if st.Emulators[i].Name == name {
+			return &st.Emulators[i]
+		}
+	}
+	return nil
+}
+
+// project returns the session's project: the configured one or, by
+// default, the one reported by the Datastore emulator.
+func (st *State) project() string {
+	if p := lookupEnv(st.Env, "GOOGLE_CLOUD_PROJECT"); p != "" {
+		return p
+	}
+	if ds := st.emulator("datastore"); ds != nil {
+		return lookupEnv(ds.Env, "DATASTORE_PROJECT_ID")
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// componentsURL is where gcloud downloads its components from, listed in
+// components-2.json.
+var componentsURL = "https://dl.google.com/dl/cloudsdk/channels/rapid/"
+
+// Standalone runs an emulator from the gcloud component's distribution,
+// with java, rather than with gcloud.
+type Standalone struct {
+	Component string // gcloud component ID
+	Dir       string // where the component is unpacked
+}
+
+// standaloneize makes e run from its component unpacked in cacheDir,
+// downloading it first if needed, for -backend=java.
+func standaloneize(ctx context.Context, e *Emulator, cacheDir string) error {
+	dir, err := fetchComponent(ctx, cacheDir, e.Component)
+	if err != nil {
+		return fmt.Errorf("could not get the %s emulator: %v", e.Name, err)
+	}
+	e.Standalone = &Standalone{Component: e.Component, Dir: dir}
+	return nil
+}
+
+// command returns the command line that runs the emulator on hostPort,
+// with its data in dataDir, for project, with args, extra arguments in
+// gcloud's form. It creates the Datastore emulator's data directory if
+// needed.
+func (s *Standalone) command(hostPort, dataDir, project string, args []string) ([]string, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	listen := []string{"--host=" + host, "--port=" + port}
+	platform := filepath.Join(s.Dir, "platform", s.Component)
+	switch s.Component {
+	case "pubsub-emulator":
+		jars, _ := filepath.Glob(filepath.Join(platform, "lib", "cloud-pubsub-emulator-*.jar"))
+		if len(jars) == 0 {
+			return nil, fmt.Errorf("no emulator jar in %s", platform)
+		}
+		cmd := append([]string{"java", "-jar", jars[0]}, listen...)
+		return append(cmd, args...), nil
+	case "cloud-firestore-emulator":
+		cmd := append([]string{"java", "-jar", filepath.Join(platform, "cloud-firestore-emulator.jar")}, listen...)
+		cmd = append(cmd, "--database-mode=datastore-mode")
+		return append(cmd, args...), nil
+	case "cloud-datastore-emulator":
+		script := filepath.Join(platform, "cloud_datastore_emulator")
+		if runtime.GOOS == "windows" {
+			script += ".cmd"
+		}
+		if names, _ := ioutil.ReadDir(dataDir); len(names) == 0 {
+			// Like gcloud, only create the data directory if it is empty.
+			out, err := exec.Command(script, "create", "--project_id="+project, dataDir).CombinedOutput()
+			if err != nil {
+				return nil, fmt.Errorf("could not create Datastore data directory: %v: %s", err, out)
+			}
+		}
+		cmd := append([]string{script, "start"}, listen...)
+		cmd = append(cmd, "--allow_remote_shutdown")
+		for _, a := range args {
+			// The emulator's flags are spelled with underscores, e.g.
+			// --store_on_disk for gcloud's --store-on-disk.
+			if strings.HasPrefix(a, "--") {
+				name := a
+				if i := strings.Index(a, "="); i >= 0 {
+					name = a[:i]
+				}
+				a = "--" + strings.Replace(name[2:], "-", "_", -1) + a[len(name):]
+			}
+			cmd = append(cmd, a)
+		}
+		return append(cmd, dataDir), nil
+	}
+	return nil, fmt.Errorf("no standalone distribution of %s", s.Component)
+}
+
+// component describes a gcloud component in components-2.json.
+type component struct {
+	ID      string `json:"id"`
+	Version struct {
+		VersionString string `json:"version_string"`
+	} `json:"version"`
+	Data *struct {
+		Source   string `json:"source"`   // relative to componentsURL
+		Checksum string `json:"checksum"` // SHA-256 of the archive
+	} `json:"data"`
+}
+
+// fetchComponent returns the directory that the gcloud component id is
+// unpacked in, under cacheDir. Once downloaded, a component is reused until
+// removed from the cache.
+func fetchComponent(ctx context.Context, cacheDir, id string) (string, error) {
+	if cached, _ := filepath.Glob(filepath.Join(cacheDir, id+"-*", ".complete")); len(cached) > 0 {
+		sort.Strings(cached)
+		return filepath.Dir(cached[len(cached)-1]), nil
+	}
+
+	var manifest struct {
+		Components []component `json:"components"`
+	}
+	if err := getJSON(ctx, componentsURL+"components-2.json", &manifest); err != nil {
+		return "", err
+	}
+	var c *component
+	for i := range manifest.Components {
+		if manifest.Components[i].ID == id {
+			c = &manifest.Components[i]
+		}
+	}
+	if c == nil || c.Data == nil {
+		return "", fmt.Errorf("component %s not found in %scomponents-2.json", id, componentsURL)
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+	slog.Info("Downloading emulator", "component", id, "version", c.Version.VersionString)
+	tmp, err := ioutil.TempDir(cacheDir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := download(ctx, componentsURL+c.Data.Source, c.Data.Checksum, tmp); err != nil {
+		return "", fmt.Errorf("%s: %v", c.Data.Source, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, ".complete"), nil, 0644); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cacheDir, id+"-"+c.Version.VersionString)
+	if err := os.Rename(tmp, dir); err != nil {
+		if _, err := os.Stat(filepath.Join(dir, ".complete")); err == nil {
+			return dir, nil // downloaded concurrently
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// download unpacks the tar.gz archive at url into dir, checking that its
+// SHA-256 is checksum.
+func download(ctx context.Context, url, checksum, dir string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	f, err := ioutil.TempFile(dir, ".archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); checksum != "" && sum != checksum {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", sum, checksum)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return untar(f, dir)
+}
+
+// untar unpacks the gzipped tar archive r into dir.
+func untar(r io.Reader, dir string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(h.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q is outside the archive", h.Name)
+		}
+		path := filepath.Join(dir, name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(h.Mode)&0755|0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// componentCacheDir returns the directory that -backend=java keeps
+// downloaded emulators in: -cache-dir, or with_emulators under the user's
+// cache directory.
+func componentCacheDir() (string, error) {
+	if *cacheDir != "" {
+		return *cacheDir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "with_emulators"), nil
+}
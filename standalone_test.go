@@ -0,0 +1,136 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarGz returns a gzipped tar archive of files, keyed by name.
+func tarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestFetchComponent(t *testing.T) {
+	archive := tarGz(t, map[string]string{"platform/pubsub-emulator/lib/cloud-pubsub-emulator-0.8.6.jar": "jar"})
+	sum := sha256.Sum256(archive)
+	checksum := hex.EncodeToString(sum[:])
+	downloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/components-2.json":
+			fmt.Fprintf(w, `{"components": [
+				{"id": "beta", "version": {"version_string": "2024.01.01"}},
+				{"id": "pubsub-emulator", "version": {"version_string": "0.8.6"},
+				 "data": {"source": "components/pubsub.tar.gz", "checksum": %q}}]}`, checksum)
+		case "/components/pubsub.tar.gz":
+			downloads++
+			w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer func(u string) { componentsURL = u }(componentsURL)
+	componentsURL = ts.URL + "/"
+
+	cache, err := ioutil.TempDir("", "with_emulators-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		dir, err := fetchComponent(ctx, cache, "pubsub-emulator")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(cache, "pubsub-emulator-0.8.6"); dir != want {
+			t.Fatalf("fetchComponent = %s, want %s", dir, want)
+		}
+		s := &Standalone{Component: "pubsub-emulator", Dir: dir}
+		cmd, err := s.command("localhost:8085", "", "", []string{"--verbose"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "java -jar " + filepath.Join(dir, "platform/pubsub-emulator/lib/cloud-pubsub-emulator-0.8.6.jar") + " --host=localhost --port=8085 --verbose"
+		if got := strings.Join(cmd, " "); got != want {
+			t.Errorf("command = %q, want %q", got, want)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("downloaded %d times, want once, then from the cache", downloads)
+	}
+
+	if _, err := fetchComponent(ctx, cache, "beta"); err == nil {
+		t.Error("fetchComponent of a component without data succeeded")
+	}
+	checksum = strings.Repeat("0", 64)
+	if _, err := fetchComponent(ctx, cache, "pubsub-emulator-other"); err == nil {
+		t.Error("fetchComponent of an unknown component succeeded")
+	}
+	os.RemoveAll(filepath.Join(cache, "pubsub-emulator-0.8.6"))
+	if _, err := fetchComponent(ctx, cache, "pubsub-emulator"); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("fetchComponent with a bad checksum: got %v, want a checksum mismatch", err)
+	}
+}
+
+func TestUntarOutside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "with_emulators-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := tarGz(t, map[string]string{"../evil": "x"})
+	if err := untar(bytes.NewReader(archive), dir); err == nil {
+		t.Error("untar of an entry outside the archive succeeded")
+	}
+}
+
+func TestStandaloneDatastoreArgs(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "with_emulators-datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	// An existing data directory is reused, not created.
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "WEB-INF"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Standalone{Component: "cloud-datastore-emulator", Dir: "/sdk"}
+	cmd, err := s.command("localhost:8081", dataDir, "p", []string{"--store-on-disk=false", "--consistency=1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "start --host=localhost --port=8081 --allow_remote_shutdown --store_on_disk=false --consistency=1.0 " + dataDir
+	if got := strings.Join(cmd[1:], " "); got != want {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// startMain implements the start subcommand, which starts the emulators,
+// prints their environment and keeps them running until interrupted.
+// Other shells can use the emulators via "with_emulators env".
+// With -daemon, it returns once the emulators are ready, leaving them
+// running in the background.
+func startMain(args []string) int {
+	if len(args) > 0 {
+		usage()
+		return 2
+	}
+	if *daemon {
+		return startDaemon(os.Stdout)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Could not load config", "err", err)
+		return 2
+	}
+	if err := openEvents(); err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+	if err := openOutput(); err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+	openTracing()
+	defer flushTracing()
+	if _, err := superviseSignal(); err != nil {
+		slog.Error(err.Error())
+		return 2
+	}
+
+	// A daemon reloads its config on SIGHUP, rather than stopping.
+	daemonized := os.Getenv(envDaemonLog) != ""
+	stopSignals := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	reload := make(chan os.Signal, 1)
+	if daemonized {
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+	} else {
+		stopSignals = append(stopSignals, syscall.SIGHUP)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), stopSignals...)
+	defer stop()
+
+	s, err := startSession(ctx, cfg, nil)
+	defer s.Stop()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	if *apiAddr != "" {
+		if err := s.serveAPI(*apiAddr); err != nil {
+			slog.Error("Could not start control API", "err", err)
+			return 1
+		}
+	}
+	printEnv(os.Stdout, s.ProjectEnv)
+	for _, env := range s.EmulatorEnv {
+		printEnv(os.Stdout, env)
+	}
+	if daemonized {
+		// Tell startDaemon we're ready, and let it exit.
+		fmt.Printf("%s%d\n", readyMarker, os.Getpid())
+		os.Stdout.Close()
+	} else {
+		slog.Info("Emulators running; stop them with Ctrl-C or \"with_emulators stop\"")
+	}
+
+	// A shared session stops by itself once it's no longer used.
+	idle := make(chan func(), 1)
+	if *shared {
+		go func() {
+			if unlock, err := waitIdle(ctx, s, *sharedIdle); err == nil {
+				idle <- unlock
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return 0
+		case unlock := <-idle:
+			notify(cfg.Notify, EventIdleShutdown, "", fmt.Errorf("no clients for %v; stopping the shared emulators", *sharedIdle))
+			// Hold the shared lock until the emulators are stopped, so that
+			// a new shared session doesn't race them for their ports.
+			s.Stop()
+			unlock()
+			if s.State.Log != "" {
+				os.Remove(s.State.Log)
+			}
+			return 0
+		case req := <-s.Control():
+			s.handle(req)
+		case <-reload:
+			newCfg, err := loadConfig()
+			if err == nil {
+				err = s.Reload(ctx, newCfg)
+			}
+			if err != nil {
+				slog.Error("Could not reload config", "err", err)
+				continue
+			}
+			cfg = newCfg
+		case c := <-s.Crashed():
+			diagnose(c.Err, s.Emulators, s.Env)
+			notify(cfg.Notify, EventCrashed, c.Name, c.Err)
+			if *supervise {
+				err := restartCrashed(s, c, nil)
+				if err == nil {
+					continue
+				}
+				c.Err = err
+			}
+			slog.Error("Emulator exited", "emulator", c.Name, "err", c.Err)
+			return 1
+		}
+	}
+}
+
+// printEnv writes env as shell export statements.
+func printEnv(w io.Writer, env []string) {
+	writeEnv(w, env, "shell")
+}
+
+// sessionFlag adds the -session flag, shared by subcommands that operate
+// on a running session, to fs.
+func sessionFlag(fs *flag.FlagSet) *int {
+	return fs.Int("session", 0, "Session to use, as shown by status (default: the most recent)")
+}
+
+// findSession returns the state of the session with the given with_emulators
+// PID, or of the most recent running session if pid is 0.
+func findSession(pid int) (*State, string, error) {
+	states, paths, err := readStates()
+	if err != nil {
+		return nil, "", err
+	}
+	for i := len(states) - 1; i >= 0; i-- {
+		st := states[i]
+		if pid != 0 && st.PID == pid {
+			return st, paths[i], nil
+		}
+		if pid == 0 && st.running() {
+			return st, paths[i], nil
+		}
+	}
+	if pid != 0 {
+		return nil, "", fmt.Errorf("no session %d", pid)
+	}
+	return nil, "", fmt.Errorf("no running session")
+}
+
+// running reports whether the session or any of its emulators is running.
+func (st *State) running() bool {
+	if processAlive(st.PID) {
+		return true
+	}
+	for _, e := range st.Emulators {
+		if processAlive(e.PID) {
+			return true
+		}
+	}
+	return false
+}
+
+// envMain implements the env subcommand, which prints the environment
+// variables pointing clients at a running session's emulators:
+//
+//	eval "$(with_emulators env)"
+func envMain(args []string) int {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	format := fs.String("format", "shell", "Output format: shell, dotenv, json, or github to append to $GITHUB_ENV")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !contains(envFormats, *format) {
+		fmt.Fprintf(os.Stderr, "env: invalid -format %q, want shell, dotenv, json or github\n", *format)
+		return 2
+	}
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "env: %v\n", err)
+		return 1
+	}
+	if *format == "github" {
+		err = appendGitHubEnv(st.env())
+	} else {
+		err = writeEnv(os.Stdout, st.env(), *format)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "env: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// env returns the variables pointing clients at the session's emulators,
+// including those naming its projects.
+func (st *State) env() []string {
+	env := append([]string(nil), st.Env...)
+	for _, e := range st.Emulators {
+		env = append(env, e.Env...)
+	}
+	return env
+}
+
+// logsMain implements the logs subcommand, which prints the output of a
+// running session's emulators.
+func logsMain(args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logs: %v\n", err)
+		return 1
+	}
+	names := fs.Args()
+	code := 0
+	for _, e := range st.Emulators {
+		if len(names) > 0 && !contains(names, e.Name) {
+			continue
+		}
+		f, err := os.Open(e.Log)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logs: %v\n", err)
+			code = 1
+			continue
+		}
+		if len(names) != 1 {
+			fmt.Printf("==> %s <==\n", e.Name)
+		}
+		io.Copy(os.Stdout, f)
+		f.Close()
+	}
+	return code
+}
+
+// stopMain implements the stop subcommand. It asks the session's
+// with_emulators process to exit, which stops its emulators, and kills
+// any emulators still running after the timeout.
+func stopMain(args []string) int {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the session to stop before killing its emulators")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	st, path, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stop: %v\n", err)
+		return 1
+	}
+	if err := stopSession(st, *timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "stop: %v\n", err)
+		return 1
+	}
+	// The session normally removes its own files, unless it died.
+	st.removeFiles(path)
+	return 0
+}
+
+// stopSession stops the session described by st, waiting up to timeout for
+// it to stop gracefully.
+func stopSession(st *State, timeout time.Duration) error {
+	if processAlive(st.PID) {
+		if err := terminateProcess(st.PID); err != nil {
+			return fmt.Errorf("session %d: %v", st.PID, err)
+		}
+	} else {
+		// Orphaned emulators; stop them directly.
+		for _, e := range st.Emulators {
+			stopProcessTree(e.PID, false)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for st.running() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !st.running() {
+		return nil
+	}
+	var failed []string
+	for _, e := range st.Emulators {
+		if !processAlive(e.PID) {
+			continue
+		}
+		if err := stopProcessTree(e.PID, true); err != nil {
+			failed = append(failed, e.Name+" (pid "+strconv.Itoa(e.PID)+"): "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not kill %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// State records a with_emulators session, so that later invocations can
+// find emulators left running by it.
+type State struct {
+	PID       int             `json:"pid"` // the with_emulators process
+	Started   time.Time       `json:"started"`
+	Command   []string        `json:"command"`
+	Emulators []EmulatorState `json:"emulators"`
+	Env       []string        `json:"env,omitempty"` // variables not specific to an emulator
+	Log       string          `json:"log,omitempty"` // stderr of a daemon session
+
+	// Projects maps logical project names to IDs, from Config.Projects.
+	Projects map[string]string `json:"projects,omitempty"`
+
+	// Shared is set for sessions that other with_emulators processes
+	// attach to with -shared.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// EmulatorState records a single emulator in a State.
+type EmulatorState struct {
+	Name            string        `json:"name"`
+	Component       string        `json:"component"`
+	PID             int           `json:"pid"`
+	Endpoint        string        `json:"endpoint"`
+	HostEnv         string        `json:"hostEnv"`
+	Env             []string      `json:"env"`
+	Log             string        `json:"log"`
+	Version         string        `json:"version,omitempty"`
+	StartupDuration time.Duration `json:"startupDuration"`
+}
+
+// stateDir returns the directory holding state files: with_emulators
+// under $XDG_RUNTIME_DIR if it is set, or a directory of the current
+// user's under the temp dir, e.g. /tmp/with_emulators-1000.
+func stateDir() string {
+	if base := os.Getenv("XDG_RUNTIME_DIR"); base != "" {
+		return filepath.Join(base, "with_emulators")
+	}
+	return filepath.Join(os.TempDir(), tempStateDirName())
+}
+
+// makeStateDir creates stateDir, if needed, and checks that it belongs to
+// the current user.
+func makeStateDir() error {
+	dir := stateDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	return checkOwner(dir, fi)
+}
+
+// newState describes the session running args with emulators, which must
+// be ready. emuEnv holds each emulator's Env, in order.
+func newState(args []string, emulators []*Emulator, emuEnv [][]string) *State {
+	st := &State{
+		PID:     os.Getpid(),
+		Started: time.Now(),
+		Command: args,
+	}
+	versions := gcloudVersions()
+	for i, e := range emulators {
+		pid := 0 // remote
+		if e.cmd != nil {
+			pid = e.cmd.Process.Pid
+		}
+		st.Emulators = append(st.Emulators, EmulatorState{
+			Name:            e.Name,
+			Component:       e.Component,
+			PID:             pid,
+			Endpoint:        lookupEnv(emuEnv[i], e.HostEnv),
+			HostEnv:         e.HostEnv,
+			Env:             emuEnv[i],
+			Log:             e.LogPath,
+			Version:         versions[e.Component],
+			StartupDuration: e.StartupDuration(),
+		})
+	}
+	return st
+}
+
+// Write writes the state file and returns its path.
+func (st *State) Write() (string, error) {
+	if err := makeStateDir(); err != nil {
+		return "", err
+	}
+	dir := stateDir()
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, strconv.Itoa(st.PID)+".json")
+	return path, ioutil.WriteFile(path, b, 0600)
+}
+
+// readStates returns the recorded sessions, oldest first, along with
+// their state file paths. Only files named PID.json are state files;
+// stateDir holds others, such as the port registry.
+func readStates() ([]*State, []string, error) {
+	dir := stateDir()
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var states []*State
+	var paths []string
+	for _, name := range names {
+		if _, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".json")); err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		st := &State{}
+		if err := json.Unmarshal(b, st); err != nil {
+			continue
+		}
+		states = append(states, st)
+		paths = append(paths, name)
+	}
+	sort.Sort(byStarted{states, paths})
+	return states, paths, nil
+}
+
+type byStarted struct {
+	states []*State
+	paths  []string
+}
+
+func (s byStarted) Len() int           { return len(s.states) }
+func (s byStarted) Less(i, j int) bool { return s.states[i].Started.Before(s.states[j].Started) }
+func (s byStarted) Swap(i, j int) {
+	s.states[i], s.states[j] = s.states[j], s.states[i]
+	s.paths[i], s.paths[j] = s.paths[j], s.paths[i]
+}
+
+// removeFiles removes the state file at path and the logs it refers to.
+func (st *State) removeFiles(path string) {
+	os.Remove(path)
+	if st.Log != "" {
+		os.Remove(st.Log)
+	}
+	for _, e := range st.Emulators {
+		os.Remove(e.Log)
+	}
+}
+
+// statusMain implements the status subcommand, which lists the emulators
+// started by with_emulators that are still running.
+func statusMain(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the state of running sessions as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	states, paths, err := readStates()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status: %v\n", err)
+		return 1
+	}
+	var live []*State
+	for i, st := range states {
+		running := false
+		for _, e := range st.Emulators {
+			running = running || processAlive(e.PID)
+		}
+		if !running && !processAlive(st.PID) {
+			// Nothing left to report; the session ended without
+			// cleaning up after itself.
+			st.removeFiles(paths[i])
+			continue
+		}
+		live = append(live, st)
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(live, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "status: %v\n", err)
+			return 1
+		}
+		fmt.Printf("%s\n", b)
+		return 0
+	}
+	if len(live) == 0 {
+		fmt.Println("No emulators running.")
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tSTATUS\tEMULATOR\tPID\tENDPOINT\tSTARTED\tCOMMAND")
+	for _, st := range live {
+		status := "running"
+		if !processAlive(st.PID) {
+			status = "orphaned"
+		}
+		command := strings.Join(st.Command, " ")
+		if command == "" {
+			command = "-"
+		}
+		for _, e := range st.Emulators {
+			estatus := status
+			if e.PID == 0 {
+				estatus = "remote"
+			} else if !processAlive(e.PID) {
+				estatus = "exited"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n", st.PID, estatus, e.Name, e.PID, e.Endpoint,
+				st.Started.Format(time.RFC3339), command)
+		}
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useTempStateDir points stateDir at a new directory under a new temp dir,
+// as when XDG_RUNTIME_DIR is unset, returning the temp dir and a function
+// restoring the environment.
+func useTempStateDir(t *testing.T) (tmp string, restore func()) {
+	tmp, err := ioutil.TempDir("", "with_emulators-tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xdg, tmpdir := os.Getenv("XDG_RUNTIME_DIR"), os.Getenv("TMPDIR")
+	os.Unsetenv("XDG_RUNTIME_DIR")
+	os.Setenv("TMPDIR", tmp)
+	return tmp, func() {
+		os.Setenv("XDG_RUNTIME_DIR", xdg)
+		os.Setenv("TMPDIR", tmpdir)
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestMakeStateDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the temp dir is per user on Windows")
+	}
+	tmp, restore := useTempStateDir(t)
+	defer restore()
+
+	want := filepath.Join(tmp, "with_emulators-"+strconv.Itoa(os.Getuid()))
+	if dir := stateDir(); dir != want {
+		t.Errorf("stateDir() = %s, want %s", dir, want)
+	}
+	if err := makeStateDir(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(want); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("state dir: got %v, %v, want mode 0700", fi, err)
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("can't give the state dir to another user")
+	}
+	if err := os.Chown(want, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeStateDir(); err == nil || !strings.Contains(err.Error(), "belongs to uid 65534") {
+		t.Errorf("makeStateDir with another user's dir: got %v, want belongs to uid 65534", err)
+	}
+}
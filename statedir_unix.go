@@ -0,0 +1,31 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// tempStateDirName names the state directory when it is under the temp
+// dir, which every user shares, after the current user.
+func tempStateDirName() string {
+	return "with_emulators-" + strconv.Itoa(os.Getuid())
+}
+
+// checkOwner returns an error if dir, described by fi, belongs to another
+// user, who would be able to tamper with this user's sessions.
+func checkOwner(dir string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) == os.Getuid() {
+		return nil
+	}
+	return fmt.Errorf("state directory %s belongs to uid %d, not the current user (uid %d); set XDG_RUNTIME_DIR or TMPDIR to a directory of your own",
+		dir, st.Uid, os.Getuid())
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// superviseSignal returns the signal named by -supervise-signal, or nil.
+func superviseSignal() (os.Signal, error) {
+	if *superviseSig == "" {
+		return nil, nil
+	}
+	sig, ok := parseSignal(*superviseSig)
+	if !ok {
+		return nil, fmt.Errorf("invalid -supervise-signal %q", *superviseSig)
+	}
+	return sig, nil
+}
+
+// restartCrashed restarts the emulator that crashed, on the same port,
+// and then sends the -supervise-signal, if any, to proc.
+// Data kept in memory by the emulator is lost.
+func restartCrashed(s *Session, c Crash, proc *os.Process) error {
+	slog.Warn("Emulator exited; restarting", "emulator", c.Name, "err", c.Err)
+	if err := s.Restart(context.Background(), c.Name); err != nil {
+		return fmt.Errorf("could not restart %s: %v", c.Name, err)
+	}
+	emit(StreamEvent{Event: EventRestarted, Emulator: c.Name, PID: s.emulator(c.Name).cmd.Process.Pid})
+	if sig, _ := superviseSignal(); sig != nil && proc != nil {
+		if err := proc.Signal(sig); err != nil {
+			slog.Warn("Could not signal command", "signal", sig, "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+)
+
+// TappedMessage is a message received by tap, printed as a line of JSON.
+type TappedMessage struct {
+	Topic       string            `json:"topic"`
+	MessageID   string            `json:"messageId"`
+	PublishTime string            `json:"publishTime"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Data        string            `json:"data"`                 // as text, if it is UTF-8
+	DataBase64  string            `json:"dataBase64,omitempty"` // otherwise
+}
+
+// tapMain implements the tap subcommand, which prints the messages
+// published to topics of a running session. It receives them through a
+// subscription of its own to each topic, deleted when it exits.
+func tapMain(args []string) int {
+	fs := flag.NewFlagSet("tap", flag.ContinueOnError)
+	session := sessionFlag(fs)
+	project := fs.String("project", "", "Project of the topics (default: the session's)")
+	out := fs.String("o", "", "File to append messages to (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: with_emulators tap [flags] [TOPIC...]\n\nWith no topics, all topics existing when tap starts are tapped.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	st, _, err := findSession(*session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tap: %v\n", err)
+		return 1
+	}
+	ps := st.emulator("pubsub")
+	if ps == nil {
+		fmt.Fprintf(os.Stderr, "tap: session %d has no pubsub emulator\n", st.PID)
+		return 1
+	}
+	if *project == "" {
+		*project = st.project()
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tap: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+	topics := fs.Args()
+	if len(topics) == 0 {
+		all, err := ListTopics(ctx, ps.Endpoint, *project)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tap: %v\n", err)
+			return 1
+		}
+		for _, t := range all {
+			topics = append(topics, t.Name)
+		}
+		if len(topics) == 0 {
+			fmt.Fprintln(os.Stderr, "tap: no topics")
+			return 1
+		}
+	}
+
+	// Subscriptions are deleted with a fresh context, since ctx is done by
+	// then.
+	cleanup := context.Background()
+	var subs []string
+	defer func() {
+		for _, s := range subs {
+			pubsubCall(cleanup, "DELETE", ps.Endpoint, s, nil, nil)
+		}
+	}()
+	for _, t := range topics {
+		sub := "projects/" + *project + "/subscriptions/with_emulators-tap-" + strconv.Itoa(os.Getpid()) + "-" + t
+		body := map[string]string{"topic": "projects/" + *project + "/topics/" + t}
+		if err := pubsubCall(ctx, "PUT", ps.Endpoint, sub, body, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "tap: subscribing to %s: %v\n", t, err)
+			return 1
+		}
+		subs = append(subs, sub)
+	}
+
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		topic, sub := topics[i], sub
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tap(ctx, ps.Endpoint, sub, func(m pushMessage) {
+				tm := TappedMessage{Topic: topic, MessageID: m.MessageID, PublishTime: m.PublishTime, Attributes: m.Attributes}
+				data, _ := base64.StdEncoding.DecodeString(m.Data)
+				if utf8.Valid(data) {
+					tm.Data = string(data)
+				} else {
+					tm.DataBase64 = m.Data
+				}
+				mu.Lock()
+				enc.Encode(tm)
+				mu.Unlock()
+			})
+		}()
+	}
+	wg.Wait()
+	return 0
+}
+
+// tap pulls and acks messages from the subscription sub, passing them to
+// f, until ctx is done.
+func tap(ctx context.Context, host, sub string, f func(pushMessage)) {
+	for ctx.Err() == nil {
+		var resp struct {
+			ReceivedMessages []struct {
+				AckID   string      `json:"ackId"`
+				Message pushMessage `json:"message"`
+			} `json:"receivedMessages"`
+		}
+		if err := pubsubCall(ctx, "POST", host, sub+":pull", map[string]interface{}{"maxMessages": 100}, &resp); err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "tap: %v\n", err)
+				sleep(ctx, pushRetryDelay)
+			}
+			continue
+		}
+		var acks []string
+		for _, m := range resp.ReceivedMessages {
+			f(m.Message)
+			acks = append(acks, m.AckID)
+		}
+		if len(acks) > 0 {
+			pubsubCall(ctx, "POST", host, sub+":acknowledge", map[string]interface{}{"ackIds": acks}, nil)
+		}
+	}
+}
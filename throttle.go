@@ -0,0 +1,120 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Throttle slows down the calls made to an emulator through the proxy,
+// configured in Config.Throttle:
+//
+//	{"pubsub": {"latency": "40ms", "jitter": "10ms", "bytesPerSecond": 1000000}}
+type Throttle struct {
+	// Latency is added to every call before it is forwarded.
+	Latency Duration `json:"latency"`
+
+	// Jitter varies Latency by up to this much either way, at random.
+	Jitter Duration `json:"jitter"`
+
+	// BytesPerSecond, if set, limits the throughput of requests and
+	// responses, shared by all calls to the emulator.
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+}
+
+func (t *Throttle) validate() error {
+	if t.Latency < 0 || t.Jitter < 0 || t.BytesPerSecond < 0 {
+		return fmt.Errorf("negative latency, jitter or bytesPerSecond")
+	}
+	return nil
+}
+
+// delay returns the latency to add to a call.
+func (t *Throttle) delay() time.Duration {
+	d := time.Duration(t.Latency)
+	if t.Jitter > 0 {
+		d += time.Duration(rand.Int63n(2*int64(t.Jitter)+1)) - time.Duration(t.Jitter)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// throttleChunk is how many bytes are sent at a time under a bandwidth
+// limit.
+const throttleChunk = 4096
+
+// bandwidth limits throughput to a number of bytes per second.
+type bandwidth struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time // when the link is free again
+}
+
+// wait blocks until n more bytes can be sent.
+func (b *bandwidth) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	b.next = b.next.Add(time.Duration(int64(n) * int64(time.Second) / b.rate))
+	d := b.next.Sub(now)
+	b.mu.Unlock()
+	time.Sleep(d)
+}
+
+// throttleReader limits the rate a request body is read at.
+type throttleReader struct {
+	io.ReadCloser
+	b *bandwidth
+}
+
+func (r *throttleReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.b.wait(n)
+	}
+	return n, err
+}
+
+// throttleWriter limits the rate a response is written at.
+type throttleWriter struct {
+	http.ResponseWriter
+	b *bandwidth
+}
+
+func (w *throttleWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		w.b.wait(len(chunk))
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (w *throttleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
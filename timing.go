@@ -0,0 +1,61 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// Timings reports where the wall time of a run went, for -timings.
+type Timings struct {
+	Emulators []EmulatorTiming `json:"emulators"`
+
+	// Startup is the time until the command could start: until every
+	// emulator and readyWhen resource was ready, or until attached to a
+	// shared session.
+	Startup time.Duration `json:"startup"`
+	Command time.Duration `json:"command"`
+	Total   time.Duration `json:"total"`
+}
+
+// EmulatorTiming is the startup time of a single emulator, from spawning
+// it to it printing its ready sentinel.
+type EmulatorTiming struct {
+	Name  string        `json:"name"`
+	Ready time.Duration `json:"ready"`
+}
+
+// newTimings returns the timings of a run that began at start, got its
+// emulators from st at ready and ran its command until done.
+func newTimings(st *State, start, ready, done time.Time) *Timings {
+	t := &Timings{
+		Startup: ready.Sub(start),
+		Command: done.Sub(ready),
+		Total:   done.Sub(start),
+	}
+	for _, e := range st.Emulators {
+		t.Emulators = append(t.Emulators, EmulatorTiming{e.Name, e.StartupDuration})
+	}
+	return t
+}
+
+// Write writes the timings to w in format, which is text or json.
+func (t *Timings) Write(w io.Writer, format string) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(t)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, e := range t.Emulators {
+		fmt.Fprintf(tw, "%s ready\t%v\n", e.Name, e.Ready.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "startup\t%v\n", t.Startup.Round(time.Millisecond))
+	fmt.Fprintf(tw, "command\t%v\n", t.Command.Round(time.Millisecond))
+	fmt.Fprintf(tw, "total\t%v\n", t.Total.Round(time.Millisecond))
+	return tw.Flush()
+}
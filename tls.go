@@ -0,0 +1,170 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// envCACert is set, with -tls, to the path of the CA certificate that
+// the proxies' certificates are signed by.
+const envCACert = "WITH_EMULATORS_CA_CERT"
+
+// With -mtls, these are set to the paths of the client certificate and
+// its key, in PEM, that the proxies require.
+const (
+	envClientCert = "WITH_EMULATORS_CLIENT_CERT"
+	envClientKey  = "WITH_EMULATORS_CLIENT_KEY"
+)
+
+// localCA is a throwaway certificate authority for the TLS proxies in
+// front of the emulators.
+type localCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	// CertPath is the PEM file holding the CA certificate.
+	CertPath string
+}
+
+// newLocalCA creates a CA, writing its certificate to dir.
+func newLocalCA(dir string) (*localCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "with_emulators local CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := createCert(tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca := &localCA{cert: cert, key: key, CertPath: filepath.Join(dir, "ca.pem")}
+	if err := writePEM(ca.CertPath, "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// serverCert issues a certificate for localhost.
+func (ca *localCA) serverCert() (tls.Certificate, error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// clientCert issues a client certificate, writing it and its key to
+// certPath and keyPath.
+func (ca *localCA) clientCert(certPath, keyPath string) (tls.Certificate, error) {
+	cert, err := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "with_emulators client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return cert, err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return cert, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", cert.Certificate[0]); err != nil {
+		return cert, err
+	}
+	return cert, writePEM(keyPath, "PRIVATE KEY", key)
+}
+
+func (ca *localCA) issue(tmpl *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	der, err := createCert(tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Pool returns a pool holding the CA certificate.
+func (ca *localCA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func createCert(tmpl, parent *x509.Certificate, pub *ecdsa.PublicKey, priv *ecdsa.PrivateKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(7 * 24 * time.Hour)
+	return x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+}
+
+func writePEM(path, typ string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+}
+
+// setupTLS creates a CA for -tls in a temporary directory, and returns the
+// TLS configuration for the proxies and the variables pointing the command
+// at the CA. With mtls, the proxies require a client certificate, which is
+// issued too. cleanup removes the directory.
+func setupTLS(mtls bool) (cfg *tls.Config, env []string, cleanup func(), err error) {
+	dir, err := ioutil.TempDir("", "with_emulators-tls")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	ca, err := newLocalCA(dir)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	cert, err := ca.serverCert()
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	cfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	env = []string{envCACert + "=" + ca.CertPath}
+	if mtls {
+		certPath, keyPath := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+		if _, err := ca.clientCert(certPath, keyPath); err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = ca.Pool()
+		env = append(env, envClientCert+"="+certPath, envClientKey+"="+keyPath)
+	}
+	return cfg, env, cleanup, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetupMTLS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cfg, env, cleanup, err := setupTLS(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	p := &Proxy{Target: strings.TrimPrefix(backend.URL, "http://"), TLS: cfg}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	caPEM, err := ioutil.ReadFile(lookupEnv(env, envCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatalf("%s holds no certificates", lookupEnv(env, envCACert))
+	}
+	cert, err := tls.LoadX509KeyPair(lookupEnv(env, envClientCert), lookupEnv(env, envClientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(certs []tls.Certificate) error {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		resp, err := c.Get("https://" + p.Addr() + "/")
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if err := get(nil); err == nil {
+		t.Error("call without a client certificate succeeded")
+	}
+	if err := get([]tls.Certificate{cert}); err != nil {
+		t.Errorf("call with the client certificate: %v", err)
+	}
+}
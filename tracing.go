@@ -0,0 +1,287 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing records OpenTelemetry spans for the phases of a session: starting
+// each emulator, setting up resources, running the command and stopping.
+// It is enabled by the standard OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) variable, and the spans are exported
+// with OTLP over HTTP, encoded as JSON, when with_emulators exits.
+var tracing struct {
+	sync.Mutex
+	endpoint string // "" unless enabled
+	headers  map[string]string
+	traceID  string
+	parentID string // of the span in TRACEPARENT, if any
+	root     *span
+	spans    []*span
+}
+
+// span is a span of the trace. Methods on a nil span do nothing, so that
+// callers needn't check whether tracing is enabled.
+type span struct {
+	name     string
+	id       string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+}
+
+// traceparentRE matches a W3C traceparent, as passed in TRACEPARENT by CI
+// systems and other instrumented tools.
+var traceparentRE = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// openTracing enables tracing if OTLP export is configured.
+func openTracing() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" || os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "http/json" {
+		slog.Warn("Not exporting traces: with_emulators only supports OTLP over http/json", "protocol", protocol)
+		return
+	}
+
+	tracing.Lock()
+	defer tracing.Unlock()
+	tracing.endpoint = endpoint
+	tracing.headers = parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for k, v := range parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		tracing.headers[k] = v
+	}
+	if m := traceparentRE.FindStringSubmatch(os.Getenv("TRACEPARENT")); m != nil {
+		tracing.traceID, tracing.parentID = m[1], m[2]
+	} else {
+		tracing.traceID = randomID(16)
+	}
+	tracing.root = &span{name: "with_emulators", id: randomID(8), parentID: tracing.parentID, start: startTime}
+	tracing.spans = append(tracing.spans, tracing.root)
+}
+
+// parseOTLPHeaders parses the value of OTEL_EXPORTER_OTLP_HEADERS, a list of
+// key=value pairs separated by commas, with URL-encoded values.
+func parseOTLPHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			continue
+		}
+		headers[strings.TrimSpace(kv[:i])] = v
+	}
+	return headers
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a span named name, a child of parent, or of the root
+// span if parent is nil, with attributes given as key, value pairs. It
+// returns nil if tracing is not enabled.
+func startSpan(name string, parent *span, attrs ...string) *span {
+	tracing.Lock()
+	defer tracing.Unlock()
+	if tracing.endpoint == "" {
+		return nil
+	}
+	if parent == nil {
+		parent = tracing.root
+	}
+	s := &span{name: name, id: randomID(8), parentID: parent.id, start: time.Now(), attrs: make(map[string]string)}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	tracing.spans = append(tracing.spans, s)
+	return s
+}
+
+// Set sets an attribute of the span.
+func (s *span) Set(key, value string) {
+	if s == nil {
+		return
+	}
+	tracing.Lock()
+	defer tracing.Unlock()
+	s.attrs[key] = value
+}
+
+// End ends the span, marking it failed if err is not nil. Calls after the
+// first do nothing.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	tracing.Lock()
+	defer tracing.Unlock()
+	if !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+}
+
+// traceparent returns the W3C traceparent identifying s, to pass to the
+// command in TRACEPARENT so that its spans join the trace, or "" if s is
+// nil.
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + tracing.traceID + "-" + s.id + "-01"
+}
+
+// traceEnv returns env with TRACEPARENT set to identify s, replacing any
+// inherited one, or env unchanged if s is nil.
+func traceEnv(env []string, s *span) []string {
+	if s == nil {
+		return env
+	}
+	out := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "TRACEPARENT=") {
+			out = append(out, kv)
+		}
+	}
+	return append(out, "TRACEPARENT="+s.traceparent())
+}
+
+// flushTracing ends the root span and exports the trace, if tracing is
+// enabled. Failures are logged.
+func flushTracing() {
+	tracing.Lock()
+	if tracing.endpoint == "" {
+		tracing.Unlock()
+		return
+	}
+	now := time.Now()
+	var spans []map[string]interface{}
+	for _, s := range tracing.spans {
+		if s.end.IsZero() {
+			s.end = now
+		}
+		spans = append(spans, s.otlp())
+	}
+	tracing.spans = nil
+	endpoint, headers := tracing.endpoint, tracing.headers
+	tracing.Unlock()
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": serviceName()}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "with_emulators"},
+				"spans": spans,
+			}},
+		}},
+	}
+	if err := postOTLP(endpoint, headers, body); err != nil {
+		slog.Warn("Could not export traces", "endpoint", endpoint, "err", err)
+	}
+}
+
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "with_emulators"
+}
+
+// otlp returns s in the OTLP JSON encoding. The caller must hold tracing's
+// lock.
+func (s *span) otlp() map[string]interface{} {
+	v := map[string]interface{}{
+		"traceId":           tracing.traceID,
+		"spanId":            s.id,
+		"name":              s.name,
+		"kind":              1, // SPAN_KIND_INTERNAL
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != "" {
+		v["parentSpanId"] = s.parentID
+	}
+	if s.err != "" {
+		v["status"] = map[string]interface{}{"code": 2, "message": s.err} // STATUS_CODE_ERROR
+	}
+	return v
+}
+
+func otlpAttributes(attrs map[string]string) []interface{} {
+	list := []interface{}{}
+	for k, v := range attrs {
+		list = append(list, map[string]interface{}{"key": k, "value": map[string]string{"stringValue": v}})
+	}
+	return list
+}
+
+// otlpTimeout bounds how long exporting the trace may take.
+const otlpTimeout = 5 * time.Second
+
+func postOTLP(endpoint string, headers map[string]string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	type otlpSpan struct {
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Status       *struct {
+			Code int `json:"code"`
+		} `json:"status"`
+	}
+	var got []otlpSpan
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("path = %s, want /v1/traces", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+			return
+		}
+		got = body.ResourceSpans[0].ScopeSpans[0].Spans
+	}))
+	defer srv.Close()
+
+	for k, v := range map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": srv.URL,
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer%20secret",
+		"TRACEPARENT":                 "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	openTracing()
+	start := startSpan("start", nil)
+	startSpan("emulator pubsub", start).End(nil)
+	start.End(nil)
+	run := startSpan("run", nil)
+	env := traceEnv([]string{"PATH=/bin", "TRACEPARENT=00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}, run)
+	if want := []string{"PATH=/bin", "TRACEPARENT=00-0af7651916cd43dd8448eb211c80319c-" + run.id + "-01"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("traceEnv = %q, want %q", env, want)
+	}
+	run.End(errors.New("exit code 1"))
+	flushTracing()
+	tracing.endpoint = ""
+
+	if auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want Bearer secret", auth)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d spans, want 4: %+v", len(got), got)
+	}
+	root := got[0]
+	for _, s := range []struct {
+		span   otlpSpan
+		name   string
+		parent string
+	}{
+		{root, "with_emulators", "b7ad6b7169203331"},
+		{got[1], "start", root.SpanID},
+		{got[2], "emulator pubsub", got[1].SpanID},
+		{got[3], "run", root.SpanID},
+	} {
+		if s.span.Name != s.name || s.span.ParentSpanID != s.parent {
+			t.Errorf("got span %s with parent %s, want %s with parent %s", s.span.Name, s.span.ParentSpanID, s.name, s.parent)
+		}
+	}
+	if got[3].Status == nil || got[3].Status.Code != 2 {
+		t.Errorf("run span status = %+v, want an error", got[3].Status)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// isGoTest reports whether args runs Go tests, either via "go test" or
+// by running a compiled test binary directly.
+func isGoTest(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	name := filepath.Base(args[0])
+	if strings.HasSuffix(name, ".test") {
+		return true
+	}
+	return name == "go" && len(args) > 1 && args[1] == "test"
+}
+
+// tuneEnv returns env with GOMAXPROCS and the go command's -p flag set
+// to leave a CPU for each of the n emulator JVMs, so that tests on small
+// machines don't starve the emulators and time out.
+// Values already present in env are left alone.
+func tuneEnv(env []string, n int) []string {
+	procs := runtime.NumCPU() - n
+	if procs < 1 {
+		procs = 1
+	}
+	if lookupEnv(env, "GOMAXPROCS") == "" {
+		env = append(env, "GOMAXPROCS="+strconv.Itoa(procs))
+	}
+
+	// Each test binary gets GOMAXPROCS threads, so only run half as many
+	// packages at once as there are CPUs left.
+	p := procs / 2
+	if p < 1 {
+		p = 1
+	}
+	goflags := lookupEnv(env, "GOFLAGS")
+	if !strings.Contains(" "+goflags, " -p=") {
+		goflags = strings.TrimSpace(goflags + " -p=" + strconv.Itoa(p))
+		env = append(env, "GOFLAGS="+goflags)
+	}
+	return env
+}
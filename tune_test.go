@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestIsGoTest(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"go", "test", "./..."}, true},
+		{[]string{"/usr/local/go/bin/go", "test"}, true},
+		{[]string{"go", "vet", "./..."}, false},
+		{[]string{"go"}, false},
+		{[]string{"./foo.test", "-test.v"}, true},
+		{[]string{"/tmp/go-build1/b001/foo.test"}, true},
+		{[]string{"gotest"}, false},
+		{[]string{"./test"}, false},
+	} {
+		if got := isGoTest(c.args); got != c.want {
+			t.Errorf("isGoTest(%q) = %v, want %v", c.args, got, c.want)
+		}
+	}
+}
+
+func TestTuneEnv(t *testing.T) {
+	cpus := runtime.NumCPU()
+	procs := cpus - 2
+	if procs < 1 {
+		procs = 1
+	}
+	p := procs / 2
+	if p < 1 {
+		p = 1
+	}
+	for _, c := range []struct {
+		name string
+		env  []string
+		n    int
+		want []string
+	}{
+		{
+			name: "unset",
+			env:  []string{"HOME=/home/me"},
+			n:    2,
+			want: []string{"HOME=/home/me", "GOMAXPROCS=" + strconv.Itoa(procs), "GOFLAGS=-p=" + strconv.Itoa(p)},
+		},
+		{
+			name: "GOMAXPROCS set",
+			env:  []string{"GOMAXPROCS=3"},
+			n:    2,
+			want: []string{"GOMAXPROCS=3", "GOFLAGS=-p=" + strconv.Itoa(p)},
+		},
+		{
+			name: "-p in GOFLAGS",
+			env:  []string{"GOFLAGS=-mod=mod -p=8"},
+			n:    2,
+			want: []string{"GOFLAGS=-mod=mod -p=8", "GOMAXPROCS=" + strconv.Itoa(procs)},
+		},
+		{
+			name: "other GOFLAGS",
+			env:  []string{"GOFLAGS=-mod=mod"},
+			n:    2,
+			want: []string{"GOFLAGS=-mod=mod", "GOMAXPROCS=" + strconv.Itoa(procs), "GOFLAGS=-mod=mod -p=" + strconv.Itoa(p)},
+		},
+		{
+			name: "more emulators than CPUs",
+			env:  nil,
+			n:    cpus + 1,
+			want: []string{"GOMAXPROCS=1", "GOFLAGS=-p=1"},
+		},
+		{
+			name: "as many emulators as CPUs",
+			env:  nil,
+			n:    cpus,
+			want: []string{"GOMAXPROCS=1", "GOFLAGS=-p=1"},
+		},
+	} {
+		if got := tuneEnv(c.env, c.n); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: tuneEnv(%q, %d) = %q, want %q", c.name, c.env, c.n, got, c.want)
+		}
+	}
+}
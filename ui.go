@@ -0,0 +1,283 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uiMessages is how many recent messages the UI keeps for each topic.
+const uiMessages = 50
+
+// ui is the web dashboard started with -ui. It shows the session's
+// emulators, Pub/Sub topics with their recent messages, and Datastore
+// entities by kind.
+//
+// To show messages, it taps each topic with a subscription of its own,
+// deleted when it stops.
+type ui struct {
+	st      *State
+	project string
+	ds      *datastoreClient
+	pubsub  string // Pub/Sub emulator host
+
+	srv    *http.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	messages map[string][]TappedMessage // by topic, oldest first
+	subs     map[string]string          // tap subscriptions, by topic
+}
+
+// startUI serves the dashboard for the session st on addr.
+func startUI(addr string, st *State) (*ui, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	u := &ui{
+		st:       st,
+		project:  st.project(),
+		messages: make(map[string][]TappedMessage),
+		subs:     make(map[string]string),
+	}
+	if ds := st.emulator("datastore"); ds != nil {
+		u.ds = &datastoreClient{host: ds.Endpoint, project: u.project}
+	}
+	if ps := st.emulator("pubsub"); ps != nil {
+		u.pubsub = ps.Endpoint
+	}
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", u.serveIndex)
+	mux.HandleFunc("/topic/", u.serveTopic)
+	mux.HandleFunc("/kind/", u.serveKind)
+	u.srv = &http.Server{Handler: mux}
+	go u.srv.Serve(l)
+	slog.Info("Dashboard running", "url", "http://"+l.Addr().String()+"/")
+	return u, nil
+}
+
+// Close stops the dashboard and deletes its subscriptions.
+func (u *ui) Close() {
+	u.srv.Close()
+	u.cancel()
+	u.wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, sub := range u.subs {
+		pubsubCall(ctx, "DELETE", u.pubsub, sub, nil, nil)
+	}
+}
+
+// topics lists the Pub/Sub topics, tapping any new ones.
+func (u *ui) topics(ctx context.Context) ([]Topic, error) {
+	if u.pubsub == "" {
+		return nil, nil
+	}
+	topics, err := ListTopics(ctx, u.pubsub, u.project)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := range topics {
+		t := &topics[i]
+		// Hide our own subscriptions.
+		subs := t.Subscriptions[:0]
+		for _, s := range t.Subscriptions {
+			if !strings.HasPrefix(s.Name, "with_emulators-") {
+				subs = append(subs, s)
+			}
+		}
+		t.Subscriptions = subs
+		if _, ok := u.subs[t.Name]; ok {
+			continue
+		}
+		sub := "projects/" + u.project + "/subscriptions/with_emulators-ui-" + strconv.Itoa(os.Getpid()) + "-" + t.Name
+		body := map[string]string{"topic": "projects/" + u.project + "/topics/" + t.Name}
+		if err := pubsubCall(ctx, "PUT", u.pubsub, sub, body, nil); err != nil {
+			slog.Warn("Dashboard could not tap topic", "topic", t.Name, "err", err)
+			continue
+		}
+		u.subs[t.Name] = sub
+		topic := t.Name
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			tap(u.ctx, u.pubsub, sub, func(m pushMessage) { u.record(topic, m) })
+		}()
+	}
+	return topics, nil
+}
+
+func (u *ui) record(topic string, m pushMessage) {
+	tm := TappedMessage{Topic: topic, MessageID: m.MessageID, PublishTime: m.PublishTime, Attributes: m.Attributes}
+	data, _ := base64.StdEncoding.DecodeString(m.Data)
+	tm.Data = string(data)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	msgs := append(u.messages[topic], tm)
+	if len(msgs) > uiMessages {
+		msgs = msgs[len(msgs)-uiMessages:]
+	}
+	u.messages[topic] = msgs
+}
+
+// kinds lists the Datastore kinds.
+func (u *ui) kinds(ctx context.Context) ([]string, error) {
+	if u.ds == nil {
+		return nil, nil
+	}
+	var resp struct {
+		Batch struct {
+			EntityResults []struct {
+				Entity struct {
+					Key struct {
+						Path []struct {
+							Name string `json:"name"`
+						} `json:"path"`
+					} `json:"key"`
+				} `json:"entity"`
+			} `json:"entityResults"`
+		} `json:"batch"`
+	}
+	body := map[string]interface{}{
+		"query": map[string]interface{}{"kind": []map[string]string{{"name": "__kind__"}}},
+	}
+	if err := u.ds.call(ctx, "runQuery", body, &resp); err != nil {
+		return nil, err
+	}
+	var kinds []string
+	for _, r := range resp.Batch.EntityResults {
+		if p := r.Entity.Key.Path; len(p) > 0 && !strings.HasPrefix(p[0].Name, "__") {
+			kinds = append(kinds, p[0].Name)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds, nil
+}
+
+var uiTemplate = template.Must(template.New("").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html><head><title>with_emulators</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+pre { margin: 0; }
+</style></head><body>
+<p><a href="/">with_emulators session {{.PID}}</a> &middot; project {{.Project}}</p>
+{{end}}
+
+{{define "index"}}{{template "head" .}}
+<h2>Emulators</h2>
+<table><tr><th>Name</th><th>Endpoint</th><th>Version</th><th>PID</th></tr>
+{{range .Emulators}}<tr><td>{{.Name}}</td><td>{{.Endpoint}}</td><td>{{.Version}}</td><td>{{.PID}}</td></tr>{{end}}
+</table>
+<h2>Pub/Sub topics</h2>
+{{with .Err}}<p>Error: {{.}}</p>{{end}}
+<table><tr><th>Topic</th><th>Subscriptions</th></tr>
+{{range .Topics}}<tr><td><a href="/topic/{{.Name}}">{{.Name}}</a></td><td>{{range .Subscriptions}}{{.Name}}<br>{{end}}</td></tr>{{end}}
+</table>
+<h2>Datastore kinds</h2>
+<ul>{{range .Kinds}}<li><a href="/kind/{{.}}">{{.}}</a></li>{{end}}</ul>
+</body></html>{{end}}
+
+{{define "topic"}}{{template "head" .}}
+<h2>Topic {{.Name}}</h2>
+<p>The last {{.Max}} messages published since the dashboard first listed the topic, newest first.</p>
+<table><tr><th>ID</th><th>Published</th><th>Attributes</th><th>Data</th></tr>
+{{range .Messages}}<tr><td>{{.MessageID}}</td><td>{{.PublishTime}}</td><td>{{range $k, $v := .Attributes}}{{$k}}={{$v}}<br>{{end}}</td><td><pre>{{.Data}}</pre></td></tr>{{end}}
+</table>
+</body></html>{{end}}
+
+{{define "kind"}}{{template "head" .}}
+<h2>Kind {{.Name}}</h2>
+{{with .Err}}<p>Error: {{.}}</p>{{end}}
+<p>Showing up to {{.Max}} entities.</p>
+<pre>{{.Entities}}</pre>
+</body></html>{{end}}
+`))
+
+// uiPage holds the fields common to all pages.
+type uiPage struct {
+	PID     int
+	Project string
+	Err     error
+}
+
+func (u *ui) page() uiPage {
+	return uiPage{PID: u.st.PID, Project: u.project}
+}
+
+func (u *ui) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		uiPage
+		Emulators []EmulatorState
+		Topics    []Topic
+		Kinds     []string
+	}{uiPage: u.page(), Emulators: u.st.Emulators}
+	data.Topics, data.Err = u.topics(r.Context())
+	if data.Err == nil {
+		data.Kinds, data.Err = u.kinds(r.Context())
+	}
+	uiTemplate.ExecuteTemplate(w, "index", data)
+}
+
+func (u *ui) serveTopic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/topic/")
+	u.mu.Lock()
+	msgs := u.messages[name]
+	var newest []TappedMessage
+	for i := len(msgs) - 1; i >= 0; i-- {
+		newest = append(newest, msgs[i])
+	}
+	u.mu.Unlock()
+	uiTemplate.ExecuteTemplate(w, "topic", struct {
+		uiPage
+		Name     string
+		Max      int
+		Messages []TappedMessage
+	}{u.page(), name, uiMessages, newest})
+}
+
+// uiEntities is how many entities the UI shows for a kind.
+const uiEntities = 100
+
+func (u *ui) serveKind(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/kind/")
+	data := struct {
+		uiPage
+		Name     string
+		Max      int
+		Entities string
+	}{uiPage: u.page(), Name: name, Max: uiEntities}
+	if u.ds != nil {
+		var fixtures []Fixture
+		fixtures, data.Err = u.ds.query(r.Context(), map[string]interface{}{"kind": []map[string]string{{"name": name}}}, uiEntities)
+		b, _ := json.MarshalIndent(fixtures, "", "  ")
+		data.Entities = string(b)
+	}
+	uiTemplate.ExecuteTemplate(w, "kind", data)
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// waitForMain implements the wait-for subcommand, which blocks until the
+// given emulator resources exist. It is meant to be run by the wrapped
+// command (or a container entrypoint), so it reads the emulator locations
+// from the current environment, or from the ready file of a session started
+// with -ready-file.
+//
+//	with_emulators wait-for pubsub:topic/foo datastore:kind/Bar --timeout=30s
+//	with_emulators wait-for -ready-file=emulators.json
+func waitForMain(args []string) int {
+	fs := flag.NewFlagSet("wait-for", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", time.Minute, "How long to wait for the resources to exist")
+	project := fs.String("project", "", "Project ID containing the resources (default: $DATASTORE_PROJECT_ID)")
+	readyPath := fs.String("ready-file", "", "Wait for this -ready-file of a session, and use its emulators")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: with_emulators wait-for [flags] [RESOURCE...]\n\n")
+		fmt.Fprintf(os.Stderr, "RESOURCE is one of pubsub:topic/NAME, pubsub:subscription/NAME or datastore:kind/NAME.\n\n")
+		fs.PrintDefaults()
+	}
+
+	// Allow flags to be interleaved with resources.
+	var rs []Resource
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		r, err := ParseResource(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "wait-for: %v\n", err)
+			return 2
+		}
+		rs = append(rs, r)
+		args = fs.Args()[1:]
+	}
+	if len(rs) == 0 && *readyPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	env := os.Environ()
+	if *readyPath != "" {
+		rf, err := waitReadyFile(ctx, *readyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "wait-for: %v\n", err)
+			return 1
+		}
+		for k, v := range rf.Env {
+			env = append(env, k+"="+v)
+		}
+	}
+	if *project == "" {
+		*project = lookupEnv(env, "DATASTORE_PROJECT_ID")
+	}
+	if err := WaitResources(ctx, rs, env, *project); err != nil {
+		fmt.Fprintf(os.Stderr, "wait-for: %v\n", err)
+		return 1
+	}
+	return 0
+}